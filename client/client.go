@@ -1,16 +1,25 @@
 package client
 
 import (
+	"io"
+	"net"
 	"net/rpc"
+	"sync"
 	"time"
 
-	. "github.com/eaciit/mq/helper"
 	. "github.com/eaciit/mq/msg"
 )
 
 type MqClient struct {
 	connection *rpc.Client
 	ClientInfo *ClientInfo
+
+	dsn        string
+	blockingMu sync.Mutex
+	blocking   *rpc.Client // used by calls that wait on the server
+
+	subsMu sync.Mutex
+	subs   map[<-chan MqMsg]*clientSubscription
 }
 
 type ClientInfo struct {
@@ -29,7 +38,17 @@ func NewMqClient(dsn string, timeout time.Duration) (*MqClient, error) {
 	ci := ClientInfo{}
 	ci.IsLoggedIn = false
 
-	return &MqClient{rpcClient, &ci}, nil
+	return &MqClient{connection: rpcClient, ClientInfo: &ci, dsn: dsn}, nil
+}
+
+// IsConnectionError tells whether err comes from a broken connection rather
+// than from the server refusing the call.
+func IsConnectionError(err error) bool {
+	if err == rpc.ErrShutdown || err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+	_, isNetError := err.(net.Error)
+	return isNetError
 }
 
 // func (c *MqClient) SetClientInfo() (bool, error) {
@@ -38,18 +57,50 @@ func NewMqClient(dsn string, timeout time.Duration) (*MqClient, error) {
 // }
 
 func (c *MqClient) Close() {
+	c.stopSubscriptions()
 	c.connection.Close()
+	c.blockingMu.Lock()
+	if c.blocking != nil {
+		c.blocking.Close()
+		c.blocking = nil
+	}
+	c.blockingMu.Unlock()
+}
+
+// blockingConnection returns the connection used by calls that wait on the
+// server, dialing it on first use, so they never hold up the other calls.
+func (c *MqClient) blockingConnection() (*rpc.Client, error) {
+	c.blockingMu.Lock()
+	defer c.blockingMu.Unlock()
+	if c.blocking == nil {
+		conn, e := rpc.Dial("tcp", c.dsn)
+		if e != nil {
+			return nil, e
+		}
+		c.blocking = conn
+	}
+	return c.blocking, nil
+}
+
+// dropBlockingConnection forgets conn after it broke, the next blocking call dials again.
+func (c *MqClient) dropBlockingConnection(conn *rpc.Client) {
+	c.blockingMu.Lock()
+	defer c.blockingMu.Unlock()
+	if c.blocking == conn {
+		c.blocking.Close()
+		c.blocking = nil
+	}
 }
 
 func (c *MqClient) Call(op string, key interface{}) (*MqMsg, error) {
 	var result MqMsg
 	err := c.connection.Call("MqRPC."+op, key, &result)
-	return &result, err
+	return &result, ParseError(err)
 }
 
 func (c *MqClient) CallDirect(op string, key interface{}, result interface{}) error {
 	err := c.connection.Call("MqRPC."+op, key, result)
-	return err
+	return ParseError(err)
 }
 
 func (c *MqClient) CallInc(op string, data string, key string) (*MqMsg, error) {
@@ -62,6 +113,307 @@ func (c *MqClient) CallInc(op string, data string, key string) (*MqMsg, error) {
 	return &result, err
 }
 
+// IncrBy atomically adds n to the integer stored at key and returns the new value.
+func (c *MqClient) IncrBy(key string, n int64) (int64, error) {
+	result, e := c.Call("IncrBy", MqMsg{Key: key, Value: n})
+	if e != nil {
+		return 0, e
+	}
+	return result.Value.(int64), nil
+}
+
+// DecrBy atomically subtracts n from the integer stored at key and returns the new value.
+func (c *MqClient) DecrBy(key string, n int64) (int64, error) {
+	result, e := c.Call("DecrBy", MqMsg{Key: key, Value: n})
+	if e != nil {
+		return 0, e
+	}
+	return result.Value.(int64), nil
+}
+
+// IncrByFloat atomically adds n to the number stored at key and returns the new value.
+func (c *MqClient) IncrByFloat(key string, n float64) (float64, error) {
+	result, e := c.Call("IncrByFloat", MqMsg{Key: key, Value: n})
+	if e != nil {
+		return 0, e
+	}
+	return result.Value.(float64), nil
+}
+
+// CompareAndSet stores value at key only when the key is still at version,
+// zero meaning the key must not exist yet. It returns ErrVersionConflict when
+// another writer changed the key first.
+func (c *MqClient) CompareAndSet(key string, version int64, value interface{}) (*MqMsg, error) {
+	return c.Call("CompareAndSet", MqMsg{Key: key, Value: value, Version: version})
+}
+
+// SetIfNotExists stores msg unless its key exists, returning ErrKeyExists otherwise.
+func (c *MqClient) SetIfNotExists(msg MqMsg) (*MqMsg, error) {
+	return c.Call("SetIfNotExists", msg)
+}
+
+// SetIfExists stores msg only if its key exists, returning ErrKeyNotFound otherwise.
+func (c *MqClient) SetIfExists(msg MqMsg) (*MqMsg, error) {
+	return c.Call("SetIfExists", msg)
+}
+
+// Delete removes key from the whole cluster and tells whether it existed.
+func (c *MqClient) Delete(key string) (bool, error) {
+	result, e := c.Call("Delete", key)
+	if e != nil {
+		return false, e
+	}
+	return result.Value.(bool), nil
+}
+
+// DeleteMany removes keys from the whole cluster and returns how many existed.
+func (c *MqClient) DeleteMany(keys ...string) (int64, error) {
+	result, e := c.Call("DeleteMany", keys)
+	if e != nil {
+		return 0, e
+	}
+	return result.Value.(int64), nil
+}
+
+// DeleteByPattern removes every key matching the glob pattern and returns how many were deleted.
+func (c *MqClient) DeleteByPattern(pattern string) (int64, error) {
+	result, e := c.Call("DeleteByPattern", pattern)
+	if e != nil {
+		return 0, e
+	}
+	return result.Value.(int64), nil
+}
+
+// MSet stores every item in one call and returns the result of each, in order.
+func (c *MqClient) MSet(items ...MqMsg) ([]KeyResult, error) {
+	results := []KeyResult{}
+	e := c.CallDecode("MSet", items, &results)
+	return results, e
+}
+
+// MGet reads every key in one call and returns the result of each, in order.
+func (c *MqClient) MGet(keys ...string) ([]KeyResult, error) {
+	results := []KeyResult{}
+	e := c.CallDecode("MGet", keys, &results)
+	return results, e
+}
+
+// MDelete removes every key in one call and tells for each whether it existed.
+func (c *MqClient) MDelete(keys ...string) ([]KeyResult, error) {
+	results := []KeyResult{}
+	e := c.CallDecode("MDelete", keys, &results)
+	return results, e
+}
+
+// Scan returns one page of keys; pass the returned Cursor to get the next one.
+func (c *MqClient) Scan(args ScanArgs) (ScanResult, error) {
+	page := ScanResult{}
+	e := c.CallDecode("Scan", args, &page)
+	return page, e
+}
+
+// Keys returns every key matching the glob pattern, scanning page by page.
+func (c *MqClient) Keys(match string) ([]string, error) {
+	keys := []string{}
+	args := ScanArgs{Match: match, Count: 1000}
+	for {
+		page, e := c.Scan(args)
+		if e != nil {
+			return keys, e
+		}
+		keys = append(keys, page.Keys...)
+		if page.Cursor == "" {
+			return keys, nil
+		}
+		args.Cursor = page.Cursor
+	}
+}
+
+// Push appends value to the end of queue.
+func (c *MqClient) Push(queue string, value interface{}) (*MqMsg, error) {
+	return c.Call("Push", MqMsg{Key: queue, Value: value})
+}
+
+// PushMsg appends msg to the end of queue, with its headers, content type,
+// correlation id, reply-to queue and message id. A push repeated with the
+// same msg.DedupKey within the dedup window of the server returns the message
+// pushed the first time and is not applied again.
+func (c *MqClient) PushMsg(queue string, msg MqMsg) (*MqMsg, error) {
+	msg.Key = queue
+	return c.Call("Push", msg)
+}
+
+// PushPriority appends value to queue with priority. A priority queue delivers
+// it before every message of lower priority; other queues ignore priority.
+func (c *MqClient) PushPriority(queue string, value interface{}, priority int64) (*MqMsg, error) {
+	return c.Call("Push", MqMsg{Key: queue, Value: value, Priority: priority})
+}
+
+// Pop removes and returns the first message of queue, or ErrQueueEmpty.
+func (c *MqClient) Pop(queue string) (*MqMsg, error) {
+	return c.Call("Pop", queue)
+}
+
+// BlockingPop pops the first message of the first non empty queue, waiting up
+// to timeout for a message to be pushed when they are all empty. A zero timeout
+// waits forever. ErrTimeout is returned when nothing arrived in time. The Key
+// of the result is the queue the message was popped from.
+func (c *MqClient) BlockingPop(timeout time.Duration, queues ...string) (*MqMsg, error) {
+	conn, e := c.blockingConnection()
+	if e != nil {
+		return nil, e
+	}
+	result := MqMsg{}
+	e = conn.Call("MqSession.BlockingPop", BlockingPopArgs{Queues: queues, Timeout: timeout}, &result)
+	if IsConnectionError(e) {
+		c.dropBlockingConnection(conn)
+	}
+	return &result, ParseError(e)
+}
+
+// Peek returns the first message of queue without removing it, or ErrQueueEmpty.
+func (c *MqClient) Peek(queue string) (*MqMsg, error) {
+	return c.Call("Peek", queue)
+}
+
+// Browse lists the first count messages of queue in the order they will be
+// delivered, 100 when count is zero.
+func (c *MqClient) Browse(queue string, count int) ([]QueuedMsg, error) {
+	msgs := []QueuedMsg{}
+	e := c.CallDecode("Browse", BrowseArgs{Queue: queue, Count: count}, &msgs)
+	return msgs, e
+}
+
+// Receive leases the first message of queue for visibility, 30 seconds when
+// zero. The message is delivered again unless it is acked before the lease
+// ends; Delivery.Msg.Attempts counts its deliveries.
+func (c *MqClient) Receive(queue string, visibility time.Duration) (*Delivery, error) {
+	delivery := Delivery{}
+	e := c.CallDecode("Receive", LeaseArgs{Queue: queue, Visibility: visibility}, &delivery)
+	if e != nil {
+		return nil, e
+	}
+	return &delivery, nil
+}
+
+// Ack removes a received message for good. ErrLeaseNotFound is returned when
+// its lease ended and the message may have gone to another consumer.
+func (c *MqClient) Ack(queue string, leaseID string) error {
+	_, e := c.Call("Ack", LeaseArgs{Queue: queue, LeaseID: leaseID})
+	return e
+}
+
+// Nack gives a received message back to the queue at once.
+func (c *MqClient) Nack(queue string, leaseID string) error {
+	_, e := c.Call("Nack", LeaseArgs{Queue: queue, LeaseID: leaseID})
+	return e
+}
+
+// Reject removes a received message from its queue and moves it to the
+// dead-letter queue with reason.
+func (c *MqClient) Reject(queue string, leaseID string, reason string) error {
+	_, e := c.Call("Reject", LeaseArgs{Queue: queue, LeaseID: leaseID, Reason: reason})
+	return e
+}
+
+// ExtendLease makes the lease of a received message end visibility from now
+// and returns the new end.
+func (c *MqClient) ExtendLease(queue string, leaseID string, visibility time.Duration) (time.Time, error) {
+	result, e := c.Call("ExtendLease", LeaseArgs{Queue: queue, LeaseID: leaseID, Visibility: visibility})
+	if e != nil {
+		return time.Time{}, e
+	}
+	return result.Value.(time.Time), nil
+}
+
+// DeclareQueue sets the dead-letter queue, max deliveries and priority mode of a queue.
+func (c *MqClient) DeclareQueue(config QueueConfig) error {
+	_, e := c.Call("DeclareQueue", config)
+	return e
+}
+
+// Queues returns the status of every queue.
+func (c *MqClient) Queues() ([]QueueStatus, error) {
+	queues := []QueueStatus{}
+	e := c.CallDecode("Queues", "", &queues)
+	return queues, e
+}
+
+// DeadLetters lists the first count messages of the dead-letter queue dlq,
+// 100 when count is zero.
+func (c *MqClient) DeadLetters(dlq string, count int) ([]DeadLetter, error) {
+	letters := []DeadLetter{}
+	e := c.CallDecode("DeadLetters", DeadLetterArgs{Queue: dlq, Count: count}, &letters)
+	return letters, e
+}
+
+// RequeueDeadLetters moves the messages ids of dlq, or all of them when no id
+// is given, back to the queue they come from and returns how many were moved.
+func (c *MqClient) RequeueDeadLetters(dlq string, ids ...int64) (int64, error) {
+	result, e := c.Call("RequeueDeadLetters", DeadLetterArgs{Queue: dlq, IDs: ids})
+	if e != nil {
+		return 0, e
+	}
+	return result.Value.(int64), nil
+}
+
+// PurgeDeadLetters removes every message of the dead-letter queue dlq.
+func (c *MqClient) PurgeDeadLetters(dlq string) (int64, error) {
+	return c.Purge(dlq)
+}
+
+// PushDelayed pushes value to queue once delay has passed and returns the id
+// of the scheduled message.
+func (c *MqClient) PushDelayed(queue string, value interface{}, delay time.Duration) (int64, error) {
+	return c.schedule(ScheduleArgs{Msg: MqMsg{Key: queue, Value: value}, Delay: delay})
+}
+
+// PushAt pushes value to queue at t and returns the id of the scheduled message.
+func (c *MqClient) PushAt(queue string, value interface{}, t time.Time) (int64, error) {
+	return c.schedule(ScheduleArgs{Msg: MqMsg{Key: queue, Value: value}, At: t})
+}
+
+func (c *MqClient) schedule(args ScheduleArgs) (int64, error) {
+	result, e := c.Call("Schedule", args)
+	if e != nil {
+		return 0, e
+	}
+	return result.Value.(int64), nil
+}
+
+// Scheduled lists the first count messages waiting to be pushed to queue, or
+// to any queue when queue is empty, 100 when count is zero.
+func (c *MqClient) Scheduled(queue string, count int) ([]ScheduledMsg, error) {
+	msgs := []ScheduledMsg{}
+	e := c.CallDecode("Scheduled", ScheduledArgs{Queue: queue, Count: count}, &msgs)
+	return msgs, e
+}
+
+// CancelSchedule drops a scheduled message before it is pushed.
+// ErrScheduleNotFound is returned when it has already been pushed.
+func (c *MqClient) CancelSchedule(id int64) error {
+	_, e := c.Call("CancelSchedule", id)
+	return e
+}
+
+// Len returns the number of messages in queue.
+func (c *MqClient) Len(queue string) (int64, error) {
+	result, e := c.Call("Len", queue)
+	if e != nil {
+		return 0, e
+	}
+	return result.Value.(int64), nil
+}
+
+// Purge removes every message of queue and returns how many were removed.
+func (c *MqClient) Purge(queue string) (int64, error) {
+	result, e := c.Call("Purge", queue)
+	if e != nil {
+		return 0, e
+	}
+	return result.Value.(int64), nil
+}
+
 func (c *MqClient) CallToLogin(key MqMsg) (*MqMsg, error) {
 	result := MqMsg{}
 	ci := ClientInfo{}
@@ -88,17 +440,16 @@ func (c *MqClient) CallDecode(op string, key interface{}, resultPointer interfac
 	result := MqMsg{}
 	err := c.connection.Call("MqRPC."+op, key, &result)
 	if err != nil {
-		return err
+		return ParseError(err)
 	}
-	Decode(result.Value.([]byte), resultPointer)
-	return nil
+	return DecodeValue(result.Value, resultPointer)
 }
 
 func (c *MqClient) CallString(op string, key interface{}) (string, error) {
 	result := MqMsg{}
 	err := c.connection.Call("MqRPC."+op, key, &result)
 	if err != nil {
-		return "", err
+		return "", ParseError(err)
 	}
 	return result.Value.(string), nil
 }
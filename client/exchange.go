@@ -0,0 +1,49 @@
+package client
+
+import (
+	. "github.com/eaciit/mq/msg"
+)
+
+// DeclareExchange creates exchange name of type kind: direct, fanout, topic
+// or headers.
+func (c *MqClient) DeclareExchange(name string, kind string) error {
+	_, e := c.Call("DeclareExchange", ExchangeConfig{Name: name, Type: kind})
+	return e
+}
+
+// DeleteExchange removes exchange name and its bindings.
+func (c *MqClient) DeleteExchange(name string) error {
+	_, e := c.Call("DeleteExchange", name)
+	return e
+}
+
+// Bind routes the messages of binding.Exchange matching the binding into
+// binding.Queue.
+func (c *MqClient) Bind(binding Binding) error {
+	_, e := c.Call("Bind", binding)
+	return e
+}
+
+// Unbind removes a binding and tells whether it existed.
+func (c *MqClient) Unbind(binding Binding) (bool, error) {
+	result, e := c.Call("Unbind", binding)
+	if e != nil {
+		return false, e
+	}
+	return result.Value.(bool), nil
+}
+
+// Exchanges returns every exchange with its bindings.
+func (c *MqClient) Exchanges() ([]ExchangeStatus, error) {
+	exchanges := []ExchangeStatus{}
+	e := c.CallDecode("Exchanges", "", &exchanges)
+	return exchanges, e
+}
+
+// Route publishes msg to exchange with routingKey and returns the result of
+// each queue it matched, Found when the message has been pushed to it.
+func (c *MqClient) Route(exchange string, routingKey string, msg MqMsg) ([]KeyResult, error) {
+	results := []KeyResult{}
+	e := c.CallDecode("Route", RouteArgs{Exchange: exchange, RoutingKey: routingKey, Msg: msg}, &results)
+	return results, e
+}
@@ -0,0 +1,54 @@
+package client
+
+import (
+	"time"
+
+	. "github.com/eaciit/mq/msg"
+)
+
+// ReceiveGroup leases the first message of queue for visibility as consumer
+// of group, from the partitions the group gives to it. Messages with the same
+// partition key are held by one consumer of the group at a time.
+func (c *MqClient) ReceiveGroup(queue string, group string, consumer string, visibility time.Duration) (*Delivery, error) {
+	delivery := Delivery{}
+	e := c.CallDecode("Receive", LeaseArgs{Queue: queue, Group: group, Consumer: consumer, Visibility: visibility}, &delivery)
+	if e != nil {
+		return nil, e
+	}
+	return &delivery, nil
+}
+
+// ReadGroupAs returns up to count entries of stream following the offsets
+// committed by group, from the partitions the group gives to consumer.
+// Commit them once processed so the partitions can move on.
+func (c *MqClient) ReadGroupAs(stream string, group string, consumer string, count int) ([]StreamEntry, error) {
+	entries := []StreamEntry{}
+	e := c.CallDecode("ReadGroup", GroupReadArgs{Stream: stream, Group: group, Consumer: consumer, Count: count}, &entries)
+	return entries, e
+}
+
+// JoinGroup adds the consumer of args to its group, or keeps it there, and
+// returns the partitions of the group. A consumer leaves its group when it
+// neither reads nor joins for 30 seconds.
+func (c *MqClient) JoinGroup(args GroupArgs) (ConsumerGroupStatus, error) {
+	status := ConsumerGroupStatus{}
+	e := c.CallDecode("JoinGroup", args, &status)
+	return status, e
+}
+
+// LeaveGroup removes the consumer of args from its group and tells whether it
+// was there.
+func (c *MqClient) LeaveGroup(args GroupArgs) (bool, error) {
+	result, e := c.Call("LeaveGroup", args)
+	if e != nil {
+		return false, e
+	}
+	return result.Value.(bool), nil
+}
+
+// ConsumerGroups returns every consumer group with members.
+func (c *MqClient) ConsumerGroups() ([]ConsumerGroupStatus, error) {
+	groups := []ConsumerGroupStatus{}
+	e := c.CallDecode("ConsumerGroups", "", &groups)
+	return groups, e
+}
@@ -0,0 +1,48 @@
+package client
+
+import (
+	"time"
+
+	. "github.com/eaciit/mq/msg"
+)
+
+// Request pushes msg to queue with a temporary reply queue as its reply-to
+// queue and waits up to timeout, forever when zero, for the reply carrying
+// its correlation id, set when msg has none. The reply queue is deleted once
+// the call returns, or when the connection of c closes.
+func (c *MqClient) Request(queue string, msg MqMsg, timeout time.Duration) (*MqMsg, error) {
+	declared, e := c.callSession("DeclareReplyQueue", "")
+	if e != nil {
+		return nil, e
+	}
+	replyTo := declared.Key
+
+	msg.ReplyTo = replyTo
+	if msg.CorrelationID == "" {
+		msg.CorrelationID = NewMessageID()
+	}
+	if _, e = c.PushMsg(queue, msg); e != nil {
+		c.callSession("DeleteReplyQueue", replyTo)
+		return nil, e
+	}
+	return c.callSession("ReceiveReply", ReplyWait{Queue: replyTo, CorrelationID: msg.CorrelationID, Timeout: timeout})
+}
+
+// Reply answers request with msg, pushed to the reply-to queue of request
+// with its correlation id, or its message id when it has none.
+func (c *MqClient) Reply(request *MqMsg, msg MqMsg) error {
+	msg.ReplyTo = request.ReplyTo
+	msg.CorrelationID = request.CorrelationID
+	if msg.CorrelationID == "" {
+		msg.CorrelationID = request.MessageID
+	}
+	_, e := c.Call("Reply", msg)
+	return e
+}
+
+// callSession calls op of the session the server binds to the connection of c.
+func (c *MqClient) callSession(op string, args interface{}) (*MqMsg, error) {
+	var result MqMsg
+	err := c.connection.Call("MqSession."+op, args, &result)
+	return &result, ParseError(err)
+}
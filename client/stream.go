@@ -0,0 +1,84 @@
+package client
+
+import (
+	"time"
+
+	. "github.com/eaciit/mq/msg"
+)
+
+// DeclareStream creates a stream with its partitions and trimming, or changes
+// the trimming of an existing one.
+func (c *MqClient) DeclareStream(config StreamConfig) error {
+	_, e := c.Call("DeclareStream", config)
+	return e
+}
+
+// Append adds value to stream and returns the ID of the new entry. Entries
+// with the same partitionKey are kept in order in one partition; an empty key
+// spreads them over every partition.
+func (c *MqClient) Append(stream string, partitionKey string, value interface{}) (int64, error) {
+	result, e := c.Call("Append", AppendArgs{Stream: stream, PartitionKey: partitionKey, Msg: MqMsg{Value: value}})
+	if e != nil {
+		return 0, e
+	}
+	return result.Value.(int64), nil
+}
+
+// ReadStream returns up to count entries of stream with an ID from from to
+// to, zero meaning up to the last one, from every partition.
+func (c *MqClient) ReadStream(stream string, from int64, to int64, count int) ([]StreamEntry, error) {
+	return c.ReadStreamArgs(StreamReadArgs{Stream: stream, From: from, To: to, Count: count})
+}
+
+// ReadStreamArgs reads the entries selected by args.
+func (c *MqClient) ReadStreamArgs(args StreamReadArgs) ([]StreamEntry, error) {
+	entries := []StreamEntry{}
+	e := c.CallDecode("ReadStream", args, &entries)
+	return entries, e
+}
+
+// ReadGroup returns up to count entries of stream following the offsets
+// committed by group. Commit them once processed so the group resumes after
+// them.
+func (c *MqClient) ReadGroup(stream string, group string, count int) ([]StreamEntry, error) {
+	entries := []StreamEntry{}
+	e := c.CallDecode("ReadGroup", GroupReadArgs{Stream: stream, Group: group, Count: count}, &entries)
+	return entries, e
+}
+
+// Commit moves the offsets of group past entries, in each of their partitions.
+func (c *MqClient) Commit(stream string, group string, entries ...StreamEntry) error {
+	offsets := make(map[int]int64)
+	for _, entry := range entries {
+		if entry.ID > offsets[entry.Partition] {
+			offsets[entry.Partition] = entry.ID
+		}
+	}
+	if len(offsets) == 0 {
+		return nil
+	}
+	return c.CommitOffsets(stream, group, offsets)
+}
+
+// CommitOffsets sets the offset of group in each partition of offsets.
+func (c *MqClient) CommitOffsets(stream string, group string, offsets map[int]int64) error {
+	_, e := c.Call("CommitOffsets", CommitArgs{Stream: stream, Group: group, Offsets: offsets})
+	return e
+}
+
+// TrimStream removes the entries of stream beyond maxLen per partition or
+// older than maxAge and returns how many were removed.
+func (c *MqClient) TrimStream(stream string, maxLen int64, maxAge time.Duration) (int64, error) {
+	result, e := c.Call("TrimStream", StreamTrimArgs{Stream: stream, MaxLen: maxLen, MaxAge: maxAge})
+	if e != nil {
+		return 0, e
+	}
+	return result.Value.(int64), nil
+}
+
+// Streams returns the status of every stream.
+func (c *MqClient) Streams() ([]StreamStatus, error) {
+	streams := []StreamStatus{}
+	e := c.CallDecode("Streams", "", &streams)
+	return streams, e
+}
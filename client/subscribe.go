@@ -0,0 +1,171 @@
+package client
+
+import (
+	"time"
+
+	. "github.com/eaciit/mq/msg"
+)
+
+const (
+	subscriptionPollWait time.Duration = 30 * time.Second
+	subscriptionRetry    time.Duration = time.Second
+	pollMessages         int           = 100
+)
+
+// clientSubscription is a subscription kept alive by a goroutine that polls
+// the server and feeds out until stop is closed. Only that goroutine changes
+// id, under subsMu.
+type clientSubscription struct {
+	id      string
+	pattern string
+	out     chan MqMsg
+	stop    chan struct{}
+}
+
+// Publish sends value to every current subscriber of topic and returns how
+// many subscriptions got it.
+func (c *MqClient) Publish(topic string, value interface{}) (int64, error) {
+	result, e := c.Call("Publish", MqMsg{Key: topic, Value: value})
+	if e != nil {
+		return 0, e
+	}
+	return result.Value.(int64), nil
+}
+
+// Subscribe returns a channel receiving the messages published from now on
+// topics matching pattern. Topics are dot separated words; in a pattern "*"
+// matches exactly one word and "#" zero or more, so "orders.*" matches
+// "orders.new" and "orders.#" also matches "orders" and "orders.eu.new". The
+// Key of every message is the topic it was published on. The channel is
+// closed once Unsubscribe or Close ended the subscription.
+func (c *MqClient) Subscribe(pattern string) (<-chan MqMsg, error) {
+	result, e := c.Call("Subscribe", pattern)
+	if e != nil {
+		return nil, e
+	}
+
+	s := &clientSubscription{
+		id:      result.Value.(string),
+		pattern: pattern,
+		out:     make(chan MqMsg, pollMessages),
+		stop:    make(chan struct{}),
+	}
+	c.subsMu.Lock()
+	if c.subs == nil {
+		c.subs = make(map[<-chan MqMsg]*clientSubscription)
+	}
+	c.subs[s.out] = s
+	c.subsMu.Unlock()
+
+	go c.runSubscription(s)
+	return s.out, nil
+}
+
+// Unsubscribe ends the subscription feeding ch.
+func (c *MqClient) Unsubscribe(ch <-chan MqMsg) error {
+	c.subsMu.Lock()
+	s, exist := c.subs[ch]
+	delete(c.subs, ch)
+	id := ""
+	if exist {
+		id = s.id
+	}
+	c.subsMu.Unlock()
+
+	if !exist {
+		return ErrSubscriptionNotFound
+	}
+	close(s.stop)
+	_, e := c.Call("Unsubscribe", id)
+	if e == ErrSubscriptionNotFound {
+		return nil
+	}
+	return e
+}
+
+// stopSubscriptions ends every subscription, when the client is closed.
+func (c *MqClient) stopSubscriptions() {
+	c.subsMu.Lock()
+	ids := []string{}
+	for _, s := range c.subs {
+		close(s.stop)
+		ids = append(ids, s.id)
+	}
+	c.subs = nil
+	c.subsMu.Unlock()
+
+	for _, id := range ids {
+		c.Call("Unsubscribe", id)
+	}
+}
+
+// runSubscription polls the server for the messages of s until it is
+// stopped. A broken connection is dialed again, and a subscription the server
+// dropped meanwhile is started again; messages published in between are lost.
+func (c *MqClient) runSubscription(s *clientSubscription) {
+	defer close(s.out)
+
+	retry := func() bool {
+		select {
+		case <-s.stop:
+			return false
+		case <-time.After(subscriptionRetry):
+			return true
+		}
+	}
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		default:
+		}
+
+		conn, e := c.blockingConnection()
+		if e != nil {
+			if !retry() {
+				return
+			}
+			continue
+		}
+
+		result := MqMsg{}
+		e = conn.Call("MqRPC.Poll", PollArgs{ID: s.id, Max: pollMessages, Wait: subscriptionPollWait}, &result)
+		if IsConnectionError(e) {
+			c.dropBlockingConnection(conn)
+		}
+		e = ParseError(e)
+		if e == ErrSubscriptionNotFound {
+			select {
+			case <-s.stop:
+				return
+			default:
+			}
+			if renewed, err := c.Call("Subscribe", s.pattern); err == nil {
+				// s.id is read under subsMu by Unsubscribe
+				c.subsMu.Lock()
+				s.id = renewed.Value.(string)
+				c.subsMu.Unlock()
+				continue
+			}
+		}
+		if e != nil {
+			if !retry() {
+				return
+			}
+			continue
+		}
+
+		msgs := []MqMsg{}
+		if e = DecodeValue(result.Value, &msgs); e != nil {
+			continue
+		}
+		for _, msg := range msgs {
+			select {
+			case s.out <- msg:
+			case <-s.stop:
+				return
+			}
+		}
+	}
+}
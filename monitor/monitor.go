@@ -19,6 +19,7 @@ const (
 	ReconnectDelay   time.Duration = 3
 	ConnectionTimout time.Duration = time.Second * 10
 	ItemsLimit       int           = 50
+	ItemsScanPages   int           = 20
 	BaseView         string        = "monitor/web/"
 	DevelopmentMode  bool          = true
 )
@@ -64,6 +65,14 @@ func (m *MqMonitor) Start() {
 		handleUser(w, r, client, err)
 	})
 
+	http.HandleFunc("/queues", func(w http.ResponseWriter, r *http.Request) {
+		handleQueues(w, r, client, err)
+	})
+
+	http.HandleFunc("/deadletters", func(w http.ResponseWriter, r *http.Request) {
+		handleDeadLetters(w, r, client, err)
+	})
+
 	http.HandleFunc("/console", func(w http.ResponseWriter, r *http.Request) {
 		handleConsole(w, r, client, err)
 	})
@@ -80,6 +89,14 @@ func (m *MqMonitor) Start() {
 		handleDataUsers(w, r, client, err)
 	})
 
+	http.HandleFunc("/data/queues", func(w http.ResponseWriter, r *http.Request) {
+		handleDataQueues(w, r, client, err)
+	})
+
+	http.HandleFunc("/data/deadletters", func(w http.ResponseWriter, r *http.Request) {
+		handleDataDeadLetters(w, r, client, err)
+	})
+
 	fmt.Printf("starting http at :%d, connecting to master %s\n", m.port, ConnectionServerHost)
 	err = http.ListenAndServe(fmt.Sprintf(":%d", m.port), nil)
 	Errorable(err, func() {
@@ -169,6 +186,24 @@ func handleUser(w http.ResponseWriter, r *http.Request, client *MqClient, err er
 	executeTemplate(w, "user", nil)
 }
 
+func handleQueues(w http.ResponseWriter, r *http.Request, client *MqClient, err error) {
+	if !clientInfo.IsLoggedIn {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	executeTemplate(w, "queues", nil)
+}
+
+func handleDeadLetters(w http.ResponseWriter, r *http.Request, client *MqClient, err error) {
+	if !clientInfo.IsLoggedIn {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	executeTemplate(w, "deadletters", nil)
+}
+
 func handleConsole(w http.ResponseWriter, r *http.Request, client *MqClient, err error) {
 	if r.Method != "GET" {
 		w.Header().Set("Content-type", "application/json")
@@ -287,7 +322,7 @@ func handleDataNodes(w http.ResponseWriter, r *http.Request, client *MqClient, e
 				"ConfigPort":    node.Config.Port,
 				"ConfigRole":    node.Config.Role,
 				"DataCount":     node.DataCount,
-				"DataSize":      node.DataSize,
+				"DataSize":      node.DataSize / dataSizeUnit,
 				"AllocatedSize": node.AllocatedSize / dataSizeUnit,
 				"StartTime":     node.StartTime.Format("2006-01-02 15:04:05"),
 				"Duration":      FormatDuration(time.Since(node.StartTime)),
@@ -334,7 +369,7 @@ func handleDataNodes(w http.ResponseWriter, r *http.Request, client *MqClient, e
 				if eachNodeTimeInt <= eachNowTimeInt {
 					totalHost += 1
 					totalDataCount += node.DataCount
-					totalDataSize += node.DataSize
+					totalDataSize += (node.DataSize / dataSizeUnit)
 					totalAllocatedSize += (node.AllocatedSize / dataSizeUnit)
 				}
 			}
@@ -375,17 +410,27 @@ func handleDataItems(w http.ResponseWriter, r *http.Request, client *MqClient, e
 	}
 
 	if r.Method == "GET" {
-		var items map[string]MqMsg
-
-		if success := rpcDo(w, client, func() error {
-			return client.CallDecode("Items", "", &items)
-		}); !success {
-			return
-		}
-
 		searchKeyword := strings.ToLower(r.FormValue("search"))
 		var resultGrid []map[string]interface{}
 
+		// Scan page by page until the grid is full, values are searched here
+		// so only a bounded number of pages is read
+		var items []MqMsg
+		args := ScanArgs{Count: ItemsLimit, WithValues: true}
+		for pages := 0; pages < ItemsScanPages; pages++ {
+			page := ScanResult{}
+			if success := rpcDo(w, client, func() error {
+				return client.CallDecode("Scan", args, &page)
+			}); !success {
+				return
+			}
+			items = append(items, page.Items...)
+			if page.Cursor == "" || (searchKeyword == "" && len(items) >= ItemsLimit) {
+				break
+			}
+			args.Cursor = page.Cursor
+		}
+
 		i := 0
 		for _, v := range items {
 			if !(i < ItemsLimit) {
@@ -393,11 +438,15 @@ func handleDataItems(w http.ResponseWriter, r *http.Request, client *MqClient, e
 			}
 
 			dataNode := map[string]interface{}{
-				"Key":        v.Key,
-				"Value":      v.Value.(string),
-				"Created":    v.Created.Format("2006-01-02 15:04:05"),
-				"LastAccess": v.LastAccess.Format("2006-01-02 15:04:05"),
-				"Expiry":     FormatDuration(v.Expiry),
+				"Key":         v.Key,
+				"Value":       FormatValue(v.Value),
+				"Type":        ValueType(v.Value),
+				"Created":     v.Created.Format("2006-01-02 15:04:05"),
+				"LastAccess":  v.LastAccess.Format("2006-01-02 15:04:05"),
+				"Expiry":      FormatDuration(v.Expiry),
+				"ContentType": v.ContentType,
+				"Headers":     FormatHeaders(v.Headers),
+				"MessageID":   v.MessageID,
 			}
 
 			isExist := (len(searchKeyword) == 0)
@@ -410,9 +459,8 @@ func handleDataItems(w http.ResponseWriter, r *http.Request, client *MqClient, e
 
 			if isExist {
 				resultGrid = append(resultGrid, dataNode)
+				i += 1
 			}
-
-			i += 1
 		}
 
 		result := map[string]interface{}{
@@ -537,6 +585,235 @@ func handleDataUsers(w http.ResponseWriter, r *http.Request, client *MqClient, e
 	PrintJSON(w, true, make([]interface{}, 0), "")
 }
 
+func handleDataQueues(w http.ResponseWriter, r *http.Request, client *MqClient, err error) {
+	w.Header().Set("Content-type", "application/json")
+	r.ParseForm()
+
+	if !clientInfo.IsLoggedIn {
+		PrintJSON(w, false, "", "you are not logged in. login first")
+		return
+	}
+
+	if isServerAlive(w, r, client) == false {
+		return
+	}
+
+	queue := r.FormValue("queue")
+
+	if r.Method == "GET" {
+		var queues []QueueStatus
+
+		if success := rpcDo(w, client, func() error {
+			return client.CallDecode("Queues", "", &queues)
+		}); !success {
+			return
+		}
+
+		var resultQueues []map[string]interface{}
+		for _, q := range queues {
+			mode := "fifo"
+			if q.Priority {
+				mode = "priority"
+			}
+			depth := fmt.Sprintf("%d", q.Len+q.Leased)
+			if q.MaxLen > 0 {
+				depth += fmt.Sprintf(" / %d", q.MaxLen)
+			}
+			size := fmt.Sprintf("%d", q.Size)
+			if q.MaxBytes > 0 {
+				size += fmt.Sprintf(" / %d", q.MaxBytes)
+			}
+			resultQueues = append(resultQueues, map[string]interface{}{
+				"Name":          q.Name,
+				"Mode":          mode,
+				"Len":           q.Len,
+				"Leased":        q.Leased,
+				"Size":          q.Size,
+				"DeadLetter":    q.DeadLetter,
+				"MaxDeliveries": q.MaxDeliveries,
+				"Depth":         depth,
+				"Bytes":         size,
+				"Overflow":      q.Overflow,
+			})
+		}
+		if queue == "" && len(queues) > 0 {
+			queue = queues[0].Name
+		}
+
+		var msgs []QueuedMsg
+		if queue != "" {
+			if success := rpcDo(w, client, func() error {
+				return client.CallDecode("Browse", BrowseArgs{Queue: queue, Count: ItemsLimit}, &msgs)
+			}); !success {
+				return
+			}
+		}
+
+		searchKeyword := strings.ToLower(r.FormValue("search"))
+		var resultGrid []map[string]interface{}
+
+		for _, v := range msgs {
+			dataMsg := map[string]interface{}{
+				"Position":      v.Position,
+				"ID":            v.ID,
+				"Priority":      v.Msg.Priority,
+				"Attempts":      v.Msg.Attempts,
+				"Value":         FormatValue(v.Msg.Value),
+				"Type":          ValueType(v.Msg.Value),
+				"Created":       v.Msg.Created.Format("2006-01-02 15:04:05"),
+				"ContentType":   v.Msg.ContentType,
+				"Headers":       FormatHeaders(v.Msg.Headers),
+				"CorrelationID": v.Msg.CorrelationID,
+				"MessageID":     v.Msg.MessageID,
+			}
+
+			isExist := (len(searchKeyword) == 0)
+			for _, w := range dataMsg {
+				if strings.Contains(strings.ToLower(AsString(w)), searchKeyword) {
+					isExist = true
+					break
+				}
+			}
+
+			if isExist {
+				resultGrid = append(resultGrid, dataMsg)
+			}
+		}
+
+		result := map[string]interface{}{
+			"queue":  queue,
+			"queues": resultQueues,
+			"grid":   resultGrid,
+		}
+
+		PrintJSON(w, true, result, "")
+		return
+	}
+
+	PrintJSON(w, true, make([]interface{}, 0), "")
+}
+
+func handleDataDeadLetters(w http.ResponseWriter, r *http.Request, client *MqClient, err error) {
+	w.Header().Set("Content-type", "application/json")
+	r.ParseForm()
+
+	if !clientInfo.IsLoggedIn {
+		PrintJSON(w, false, "", "you are not logged in. login first")
+		return
+	}
+
+	if isServerAlive(w, r, client) == false {
+		return
+	}
+
+	queue := r.FormValue("queue")
+
+	if r.Method == "GET" {
+		var queues []QueueStatus
+
+		if success := rpcDo(w, client, func() error {
+			return client.CallDecode("Queues", "", &queues)
+		}); !success {
+			return
+		}
+
+		// Dead-letter queues are the ones named as such by another queue
+		deadLetterQueues := []string{}
+		isDeadLetter := map[string]bool{}
+		for _, q := range queues {
+			if q.DeadLetter != "" && !isDeadLetter[q.DeadLetter] {
+				isDeadLetter[q.DeadLetter] = true
+				deadLetterQueues = append(deadLetterQueues, q.DeadLetter)
+			}
+		}
+		if queue == "" && len(deadLetterQueues) > 0 {
+			queue = deadLetterQueues[0]
+		}
+
+		var letters []DeadLetter
+		if queue != "" {
+			if success := rpcDo(w, client, func() error {
+				return client.CallDecode("DeadLetters", DeadLetterArgs{Queue: queue, Count: ItemsLimit}, &letters)
+			}); !success {
+				return
+			}
+		}
+
+		searchKeyword := strings.ToLower(r.FormValue("search"))
+		var resultGrid []map[string]interface{}
+
+		for _, v := range letters {
+			dataLetter := map[string]interface{}{
+				"ID":            v.ID,
+				"Origin":        v.Msg.Origin,
+				"Reason":        v.Msg.Reason,
+				"Attempts":      v.Msg.Attempts,
+				"Value":         FormatValue(v.Msg.Value),
+				"Type":          ValueType(v.Msg.Value),
+				"Created":       v.Msg.Created.Format("2006-01-02 15:04:05"),
+				"ContentType":   v.Msg.ContentType,
+				"Headers":       FormatHeaders(v.Msg.Headers),
+				"CorrelationID": v.Msg.CorrelationID,
+				"MessageID":     v.Msg.MessageID,
+			}
+
+			isExist := (len(searchKeyword) == 0)
+			for _, w := range dataLetter {
+				if strings.Contains(strings.ToLower(AsString(w)), searchKeyword) {
+					isExist = true
+					break
+				}
+			}
+
+			if isExist {
+				resultGrid = append(resultGrid, dataLetter)
+			}
+		}
+
+		result := map[string]interface{}{
+			"queue":  queue,
+			"queues": deadLetterQueues,
+			"grid":   resultGrid,
+		}
+
+		PrintJSON(w, true, result, "")
+		return
+	} else if r.Method == "POST" {
+		ids := []int64{}
+		for _, id := range strings.Split(r.FormValue("ids"), ",") {
+			if n, e := strconv.ParseInt(strings.TrimSpace(id), 10, 64); e == nil {
+				ids = append(ids, n)
+			}
+		}
+
+		var requeued int64
+		if success := rpcDo(w, client, func() error {
+			var e error
+			requeued, e = client.RequeueDeadLetters(queue, ids...)
+			return e
+		}); !success {
+			return
+		}
+
+		PrintJSON(w, true, map[string]interface{}{"count": requeued}, "")
+		return
+	} else if r.Method == "DELETE" {
+		var purged int64
+		if success := rpcDo(w, client, func() error {
+			var e error
+			purged, e = client.PurgeDeadLetters(queue)
+			return e
+		}); !success {
+			return
+		}
+
+		PrintJSON(w, true, map[string]interface{}{"count": purged}, "")
+		return
+	}
+
+	PrintJSON(w, true, make([]interface{}, 0), "")
+}
+
 func connect() (*MqClient, error) {
 	return NewMqClient(ConnectionServerHost, ConnectionTimout)
 }
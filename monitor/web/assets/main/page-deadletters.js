@@ -0,0 +1,162 @@
+(function () {
+	'use strict';
+
+	var DeadLetters = function () { 
+		var self = this;
+		var $body = $('body');
+		var $section = $body.find('.section-deadletters');
+		var queue = '';
+
+		this.init = function () {
+			$section.find('.grid').kendoGrid({
+				dataSource: { 
+					data: [], 
+					pageSize: 10
+				},
+				pageable: {
+					pageSizes: [5, 10, 15, 20]
+				},
+				sortable: true, 
+				scrollable: false,
+				columns: [
+					{ field: 'ID', title: 'ID', width: 70 },
+					{ field: 'Origin', title: 'Origin Queue' },
+					{ field: 'Reason', title: 'Reason' },
+					{ field: 'Attempts', title: 'Attempts', width: 80 },
+					{ field: 'Value', title: 'Value' },
+					{ field: 'Type', title: 'Type' },
+					{ field: 'Created', title: 'Created' },
+					{ field: 'Headers', title: 'Headers' },
+					{ title: 'Options', width: 100, 
+						template: '<button class="btn btn-xs btn-primary btn-row-requeue"><i class="fa fa-repeat"></i>&nbsp;requeue</button>',
+						attributes: { style: 'text-align: center' }
+				 	}
+				]
+			});
+
+			$section.find('[name=queue]').kendoDropDownList({
+				dataSource: {
+					data: []
+				},
+				optionLabel: 'Select queue',
+				change: function () {
+					queue = this.value();
+					$section.find('.btn-search').trigger('click');
+				}
+			});
+		}
+
+		this.requeue = function (ids) {
+			$.ajax({
+				url: '/data/deadletters',
+				data: {
+					queue: queue,
+					ids: ids.join(',')
+				},
+				type: 'post',
+				dataType: 'json'
+			})
+			.success(function (res) {
+				if (!res.success) {
+					toastr.error(res.message);
+					return;
+				}
+
+				$section.find('.btn-search').trigger('click');
+				toastr.success(res.data.count + ' message(s) requeued');
+			})
+			.error(function (a, b, c) {
+				toastr.error('error when requeuing messages of ' + queue);
+			});
+		};
+
+		// register event listener
+		this.registerEventListener = function () {
+			$section.find('.btn-search').on('click', function () {
+				$.ajax({
+					url: '/data/deadletters',
+					data: {
+						queue: queue,
+						search: $section.find('.nav-search .input-search').val()
+					},
+					type: 'get',
+					dataType: 'json'
+				})
+				.success(function (res) {
+					if (!res.success) {
+						toastr.error(res.message);
+						return;
+					}
+
+					queue = res.data.queue;
+					var $queues = $section.find('[name=queue]').data('kendoDropDownList');
+					$queues.setDataSource(new kendo.data.DataSource({ data: res.data.queues || [] }));
+					$queues.value(queue);
+
+					var $grid = $section.find('.grid').data('kendoGrid');
+					$grid.setDataSource(new kendo.data.DataSource({
+						data: res.data.grid || [],
+						pageSize: $grid.dataSource.pageSize()
+					}));
+				})
+				.error(function (a, b, c) {
+					toastr.error('error occured when fetching dead letters');
+				});
+			});
+
+			$body.find('.input-search').on('keyup', function (e) {
+				if (e.keyCode !== 13)
+					return;
+
+				$(this).closest('.nav-search').find('.btn-search').trigger('click');
+			});
+
+			$section.find('.k-grid').on('click', '.btn-row-requeue', function () {
+				var uid = $(this).closest('tr[data-uid]').attr('data-uid');
+				var data = $section.find('.k-grid').data('kendoGrid').dataSource.data();
+				var rowData = Lazy(data).find(function (d) { return d.uid === uid; });
+
+				self.requeue([rowData.ID]);
+			});
+
+			$section.find('.btn-requeue-all').on('click', function () {
+				if (queue === '' || !confirm('Requeue every message of ' + queue + ' ?'))
+					return;
+
+				self.requeue([]);
+			});
+
+			$section.find('.btn-purge').on('click', function () {
+				if (queue === '' || !confirm('Are you sure want to remove every message of ' + queue + ' ?'))
+					return;
+
+				$.ajax({
+					url: '/data/deadletters?' + $.param({ queue: queue }),
+					type: 'delete',
+					dataType: 'json'
+				})
+				.success(function (res) {
+					if (!res.success) {
+						toastr.error(res.message);
+						return;
+					}
+
+					$section.find('.btn-search').trigger('click');
+					toastr.success(res.data.count + ' message(s) purged');
+				})
+				.error(function (a, b, c) {
+					toastr.error('error when purging ' + queue);
+				});
+			});
+		};
+	};
+
+	// start the magic
+	$(function () {
+		var deadLetters = new DeadLetters();
+		deadLetters.init();
+		deadLetters.registerEventListener();
+
+		$('.btn-search').trigger('click');
+	});
+}());
@@ -171,10 +171,14 @@
 				columns: [
 					{ field: 'Key', title: 'Key' },
 					{ field: 'Value', title: 'Value' },
+					{ field: 'Type', title: 'Type', width: 80,
+						attributes: { style: 'text-align: center;' } },
 					{ field: 'Created', title: 'Created', width: 140,
 						attributes: { style: 'text-align: center;' } },
 					{ field: 'Expiry', title: 'Expiry', width: 80,
 						attributes: { style: 'text-align: center;' } },
+					{ field: 'ContentType', title: 'Content Type', width: 120 },
+					{ field: 'Headers', title: 'Headers' },
 				]
 			});
 		};
@@ -0,0 +1,139 @@
+(function () {
+	'use strict';
+
+	var Queues = function () { 
+		var self = this;
+		var $body = $('body');
+		var $section = $body.find('.section-queues');
+		var $messages = $body.find('.section-messages');
+		var queue = '';
+
+		this.init = function () {
+			$section.find('.grid-queues').kendoGrid({
+				dataSource: { 
+					data: [], 
+					pageSize: 10
+				},
+				pageable: {
+					pageSizes: [5, 10, 15, 20]
+				},
+				sortable: true, 
+				scrollable: false,
+				columns: [
+					{ field: 'Name', title: 'Queue' },
+					{ field: 'Mode', title: 'Mode', width: 90 },
+					{ field: 'Len', title: 'Waiting', width: 90 },
+					{ field: 'Leased', title: 'Leased', width: 90 },
+					{ field: 'Size', title: 'Size', width: 90 },
+					{ field: 'DeadLetter', title: 'Dead-letter Queue' },
+					{ field: 'MaxDeliveries', title: 'Max Deliveries', width: 120 },
+					{ field: 'Depth', title: 'Depth / Max', width: 110 },
+					{ field: 'Bytes', title: 'Bytes / Max', width: 130 },
+					{ field: 'Overflow', title: 'Overflow', width: 120 }
+				]
+			});
+
+			$messages.find('.grid').kendoGrid({
+				dataSource: { 
+					data: [], 
+					pageSize: 10
+				},
+				pageable: {
+					pageSizes: [5, 10, 15, 20]
+				},
+				sortable: true, 
+				scrollable: false,
+				columns: [
+					{ field: 'Position', title: 'Position', width: 80 },
+					{ field: 'ID', title: 'ID', width: 70 },
+					{ field: 'Priority', title: 'Priority', width: 80 },
+					{ field: 'Attempts', title: 'Attempts', width: 80 },
+					{ field: 'Value', title: 'Value' },
+					{ field: 'Type', title: 'Type' },
+					{ field: 'Created', title: 'Created' },
+					{ field: 'ContentType', title: 'Content Type' },
+					{ field: 'Headers', title: 'Headers' },
+					{ field: 'CorrelationID', title: 'Correlation ID' }
+				]
+			});
+
+			$messages.find('[name=queue]').kendoDropDownList({
+				dataSource: {
+					data: []
+				},
+				optionLabel: 'Select queue',
+				change: function () {
+					queue = this.value();
+					$messages.find('.btn-search').trigger('click');
+				}
+			});
+		}
+
+		// register event listener
+		this.registerEventListener = function () {
+			$messages.find('.btn-search').on('click', function () {
+				$.ajax({
+					url: '/data/queues',
+					data: {
+						queue: queue,
+						search: $messages.find('.nav-search .input-search').val()
+					},
+					type: 'get',
+					dataType: 'json'
+				})
+				.success(function (res) {
+					if (!res.success) {
+						toastr.error(res.message);
+						return;
+					}
+
+					var queues = res.data.queues || [];
+					var $queuesGrid = $section.find('.grid-queues').data('kendoGrid');
+					$queuesGrid.setDataSource(new kendo.data.DataSource({
+						data: queues,
+						pageSize: $queuesGrid.dataSource.pageSize()
+					}));
+
+					queue = res.data.queue;
+					var $queues = $messages.find('[name=queue]').data('kendoDropDownList');
+					$queues.setDataSource(new kendo.data.DataSource({ data: Lazy(queues).map(function (q) { return q.Name; }).toArray() }));
+					$queues.value(queue);
+
+					var $grid = $messages.find('.grid').data('kendoGrid');
+					$grid.setDataSource(new kendo.data.DataSource({
+						data: res.data.grid || [],
+						pageSize: $grid.dataSource.pageSize()
+					}));
+				})
+				.error(function (a, b, c) {
+					toastr.error('error occured when fetching queues');
+				});
+			});
+
+			$body.find('.input-search').on('keyup', function (e) {
+				if (e.keyCode !== 13)
+					return;
+
+				$(this).closest('.nav-search').find('.btn-search').trigger('click');
+			});
+
+			$section.find('.k-grid').on('click', 'tr[data-uid]', function () {
+				var uid = $(this).attr('data-uid');
+				var data = $section.find('.k-grid').data('kendoGrid').dataSource.data();
+				var rowData = Lazy(data).find(function (d) { return d.uid === uid; });
+
+				queue = rowData.Name;
+				$messages.find('.btn-search').trigger('click');
+			});
+		};
+	};
+
+	// start the magic
+	$(function () {
+		var queues = new Queues();
+		queues.init();
+		queues.registerEventListener();
+
+		$('.btn-search').trigger('click');
+	});
+}());
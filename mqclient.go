@@ -64,7 +64,7 @@ func main() {
 		command := string(line)
 		handleError(e)
 		lowerCommand := ""
-		if strings.HasPrefix(command, "get") || strings.HasPrefix(command, "set") || strings.HasPrefix(command, "inc") || strings.HasPrefix(command, "gettable") {
+		if strings.HasPrefix(command, "get") || strings.HasPrefix(command, "set") || strings.HasPrefix(command, "mset") || strings.HasPrefix(command, "mget") || strings.HasPrefix(command, "inc") || strings.HasPrefix(command, "decr") || strings.HasPrefix(command, "gettable") {
 			stringsPart := strings.Split(command, "(")
 			lowerCommand = strings.ToLower(stringsPart[0])
 		} else {
@@ -123,32 +123,85 @@ func main() {
 				value = " "
 			}
 
-			msg := MqMsg{Key: keygenerate, Value: value}
+			msg := MqMsg{Key: keygenerate, Value: value, Duration: data.Duration, Owner: data.Owner, Table: data.Table, Permission: data.Permission,
+				Headers: data.Headers, ContentType: data.ContentType, CorrelationID: data.CorrelationID, ReplyTo: data.ReplyTo, MessageID: data.MessageID,
+				DedupKey: data.DedupKey}
 			_, e := c.Call("Set", msg)
 			if e != nil {
 				fmt.Println("Unable to store message: " + e.Error())
 			}
 
-		} else if lowerCommand == "inc" {
+		} else if lowerCommand == "mset" {
+			m := MqMsg{}
+			items := []MqMsg{}
+			for _, pair := range parseBatchCommand(command) {
+				parts := strings.SplitN(pair, "=", 2)
+				if len(parts) < 2 {
+					fmt.Println("Expected key=value : " + pair)
+					continue
+				}
+				items = append(items, MqMsg{Key: m.BuildKey("public", "", parts[0]), Value: strings.TrimSpace(parts[1])})
+			}
+			results, e := c.MSet(items...)
+			if e != nil {
+				fmt.Println("Unable to store message: " + e.Error())
+			}
+			for _, result := range results {
+				if result.Error != "" {
+					fmt.Println(strings.TrimPrefix(result.Key, "public|"), ": ", result.Error)
+				}
+			}
+		} else if lowerCommand == "mget" {
+			m := MqMsg{}
+			keys := []string{}
+			for _, k := range parseBatchCommand(command) {
+				keys = append(keys, m.BuildKey("public", "", k))
+			}
+			results, e := c.MGet(keys...)
+			if e != nil {
+				fmt.Println("Unable to get message: " + e.Error())
+			}
+			for _, result := range results {
+				key := strings.TrimPrefix(result.Key, "public|")
+				if result.Error != "" {
+					fmt.Println(key, ": ", result.Error)
+				} else if !result.Found {
+					fmt.Println(key, ": (nil)")
+				} else {
+					fmt.Println(key, ": ", FormatValue(result.Msg.Value))
+				}
+			}
+		} else if lowerCommand == "inc" || lowerCommand == "decr" {
 			Orikey, incVal := parseIncCommand(command)
 			//owner := c.ClientInfo.Username
 			m := MqMsg{}
 			keygenerate := m.BuildKey("public", "", Orikey)
 			//keygenerate := m.BuildKey(owner, "", Orikey)
-			msg, e := c.Call("Get", keygenerate)
-			if e != nil {
-				fmt.Println("No Data with Key : " + keygenerate)
-			} else {
-				val, _ := strconv.Atoi(incVal)
-				valstr := msg.Value.(string)
-				newval, _ := strconv.Atoi(valstr)
-				xxx := newval + val
-				_, e := c.CallInc("Inc", strconv.Itoa(xxx), keygenerate)
+			incVal = strings.TrimSpace(incVal)
+			if n, e := strconv.ParseInt(incVal, 10, 64); e == nil {
+				newVal := int64(0)
+				if lowerCommand == "inc" {
+					newVal, e = c.IncrBy(keygenerate, n)
+				} else {
+					newVal, e = c.DecrBy(keygenerate, n)
+				}
 				if e != nil {
 					fmt.Println("Unable to Increase value, message: " + e.Error())
+				} else {
+					fmt.Printf("Value: %d \n", newVal)
 				}
-
-				//fmt.Printf("Value: %v \n", msg.Value)
+			} else if n, e := strconv.ParseFloat(incVal, 64); e == nil {
+				if lowerCommand == "decr" {
+					n = -n
+				}
+				newVal, e := c.IncrByFloat(keygenerate, n)
+				if e != nil {
+					fmt.Println("Unable to Increase value, message: " + e.Error())
+				} else {
+					fmt.Printf("Value: %v \n", newVal)
+				}
+			} else {
+				fmt.Println("Increment must be a number : " + incVal)
 			}
 
 		} else if lowerCommand == "get" {
@@ -187,28 +240,771 @@ func main() {
 			}
 			//fmt.Println("keyx:", keyx)
 
-			valPublic := ""
-			valOwner := ""
+			var valPublic, valOwner *MqMsg
 
 			//if owner = "", looping 2x, first get as public, second get as specified user
 			if own == "" {
-				valPublic = getValue("public|"+keyx, c)
-				valOwner = getValue(ActiveUser+"|"+keyx, c)
+				valPublic = getItem("public|"+keyx, c)
+				valOwner = getItem(ActiveUser+"|"+keyx, c)
 			} else {
-				valOwner = getValue(ActiveUser+"|"+keyx, c)
+				valOwner = getItem(ActiveUser+"|"+keyx, c)
 			}
 
-			if valPublic != "" {
-				fmt.Println("Value (public) : ", valPublic)
+			if valPublic != nil {
+				fmt.Println("Value (public) : ", FormatValue(valPublic.Value))
+				printMeta(valPublic)
 			}
-			if valOwner != "" {
+			if valOwner != nil {
 				//fmt.Println("Value (owner:"+ActiveUser+"): ", valOwner)
-				fmt.Println("Value : ", valOwner)
+				fmt.Println("Value : ", FormatValue(valOwner.Value))
+				printMeta(valOwner)
 			}
-			if valPublic == "" && valOwner == "" {
+			if valPublic == nil && valOwner == nil {
 				fmt.Println("Unable to store message: Data doesn't exist")
 			}
 
+		} else if lowerCommand == "expire" {
+			commandParts := strings.Fields(command)
+			if len(commandParts) < 3 {
+				fmt.Println("Usage : expire key seconds")
+			} else {
+				m := MqMsg{}
+				duration, _ := strconv.ParseInt(commandParts[2], 10, 64)
+				msg := MqMsg{Key: m.BuildKey("public", "", commandParts[1]), Duration: duration}
+				_, e := c.Call("Expire", msg)
+				if e != nil {
+					fmt.Println("Unable to set expiry: " + e.Error())
+				}
+			}
+		} else if lowerCommand == "persist" {
+			commandParts := strings.Fields(command)
+			if len(commandParts) < 2 {
+				fmt.Println("Usage : persist key")
+			} else {
+				m := MqMsg{}
+				_, e := c.Call("Persist", m.BuildKey("public", "", commandParts[1]))
+				if e != nil {
+					fmt.Println("Unable to remove expiry: " + e.Error())
+				}
+			}
+		} else if lowerCommand == "ttl" {
+			commandParts := strings.Fields(command)
+			if len(commandParts) < 2 {
+				fmt.Println("Usage : ttl key")
+			} else {
+				m := MqMsg{}
+				msg, e := c.Call("TTL", m.BuildKey("public", "", commandParts[1]))
+				if e != nil {
+					fmt.Println("Unable to get ttl: " + e.Error())
+				} else {
+					fmt.Println("TTL : ", msg.Value)
+				}
+			}
+		} else if lowerCommand == "keys" {
+			commandParts := strings.Fields(command)
+			match := "*"
+			if len(commandParts) > 1 {
+				match = commandParts[1]
+			}
+			keys, e := c.Keys(match)
+			if e != nil {
+				fmt.Println("Unable to list keys: " + e.Error())
+			}
+			for _, key := range keys {
+				fmt.Println(key)
+			}
+		} else if lowerCommand == "scan" {
+			// scan cursor [match] [count], use 0 as the first cursor
+			commandParts := strings.Fields(command)
+			args := ScanArgs{}
+			if len(commandParts) > 1 && commandParts[1] != "0" {
+				args.Cursor = commandParts[1]
+			}
+			if len(commandParts) > 2 {
+				args.Match = commandParts[2]
+			}
+			if len(commandParts) > 3 {
+				args.Count, _ = strconv.Atoi(commandParts[3])
+			}
+			page, e := c.Scan(args)
+			if e != nil {
+				fmt.Println("Unable to scan: " + e.Error())
+			} else {
+				for _, key := range page.Keys {
+					fmt.Println(key)
+				}
+				if page.Cursor == "" {
+					page.Cursor = "0"
+				}
+				fmt.Println("Next cursor : ", page.Cursor)
+			}
+		} else if lowerCommand == "del" {
+			commandParts := strings.Fields(command)
+			m := MqMsg{}
+			keys := []string{}
+			for _, k := range commandParts[1:] {
+				keys = append(keys, m.BuildKey("public", "", k))
+			}
+			n, e := c.DeleteMany(keys...)
+			if e != nil {
+				fmt.Println("Unable to delete: " + e.Error())
+			} else {
+				fmt.Println("Deleted : ", n)
+			}
+		} else if lowerCommand == "delpattern" {
+			commandParts := strings.Fields(command)
+			n, e := c.DeleteByPattern(strings.Join(commandParts[1:], " "))
+			if e != nil {
+				fmt.Println("Unable to delete: " + e.Error())
+			} else {
+				fmt.Println("Deleted : ", n)
+			}
+		} else if lowerCommand == "push" {
+			// push queue [contenttype=.. correlationid=.. replyto=.. messageid=.. dedup=.. partition=.. header.name=..] value
+			commandParts := strings.Fields(command)
+			m := MqMsg{}
+			for len(commandParts) > 3 && parseMeta(&m, commandParts[2]) {
+				commandParts = append(commandParts[:2], commandParts[3:]...)
+			}
+			if len(commandParts) < 3 {
+				fmt.Println("Usage : push queue [field=value...] value")
+			} else {
+				m.Value = strings.Join(commandParts[2:], " ")
+				_, e := c.PushMsg(commandParts[1], m)
+				if e != nil {
+					fmt.Println("Unable to push message: " + e.Error())
+				}
+			}
+		} else if lowerCommand == "request" {
+			// request queue seconds [field=value...] value, 0 seconds waits forever
+			commandParts := strings.Fields(command)
+			m := MqMsg{}
+			for len(commandParts) > 4 && parseMeta(&m, commandParts[3]) {
+				commandParts = append(commandParts[:3], commandParts[4:]...)
+			}
+			seconds := -1
+			if len(commandParts) > 3 {
+				if n, err := strconv.Atoi(commandParts[2]); err == nil {
+					seconds = n
+				}
+			}
+			if seconds < 0 {
+				fmt.Println("Usage : request queue seconds [field=value...] value")
+			} else {
+				m.Value = strings.Join(commandParts[3:], " ")
+				msg, e := c.Request(commandParts[1], m, time.Duration(seconds)*time.Second)
+				if e == ErrTimeout {
+					fmt.Println("No reply after", seconds, "second(s)")
+				} else if e != nil {
+					fmt.Println("Unable to send request: " + e.Error())
+				} else {
+					fmt.Println("Value : ", FormatValue(msg.Value))
+					printMeta(msg)
+				}
+			}
+		} else if lowerCommand == "reply" {
+			// reply replyto correlationid [field=value...] value
+			commandParts := strings.Fields(command)
+			m := MqMsg{}
+			for len(commandParts) > 4 && parseMeta(&m, commandParts[3]) {
+				commandParts = append(commandParts[:3], commandParts[4:]...)
+			}
+			if len(commandParts) < 4 {
+				fmt.Println("Usage : reply replyto correlationid [field=value...] value")
+			} else {
+				m.Value = strings.Join(commandParts[3:], " ")
+				request := MqMsg{ReplyTo: commandParts[1], CorrelationID: commandParts[2]}
+				if e := c.Reply(&request, m); e != nil {
+					fmt.Println("Unable to send reply: " + e.Error())
+				}
+			}
+		} else if lowerCommand == "ppush" {
+			// ppush queue priority value
+			commandParts := strings.Fields(command)
+			var priority int64
+			var err error
+			if len(commandParts) > 3 {
+				priority, err = strconv.ParseInt(commandParts[2], 10, 64)
+			}
+			if len(commandParts) < 4 || err != nil {
+				fmt.Println("Usage : ppush queue priority value")
+			} else {
+				value := strings.Join(commandParts[3:], " ")
+				_, e := c.PushPriority(commandParts[1], value, priority)
+				if e != nil {
+					fmt.Println("Unable to push message: " + e.Error())
+				}
+			}
+		} else if lowerCommand == "browse" {
+			// browse queue [count]
+			commandParts := strings.Fields(command)
+			if len(commandParts) < 2 {
+				fmt.Println("Usage : browse queue [count]")
+			} else {
+				count := 0
+				if len(commandParts) > 2 {
+					count, _ = strconv.Atoi(commandParts[2])
+				}
+				msgs, e := c.Browse(commandParts[1], count)
+				if e != nil {
+					fmt.Println("Unable to read queue: " + e.Error())
+				}
+				for _, m := range msgs {
+					fmt.Printf("%d\tpriority %d\t%s\n", m.Position, m.Msg.Priority, FormatValue(m.Msg.Value))
+				}
+			}
+		} else if lowerCommand == "pop" || lowerCommand == "peek" {
+			commandParts := strings.Fields(command)
+			if len(commandParts) < 2 {
+				fmt.Println("Usage : " + lowerCommand + " queue")
+			} else {
+				pop := c.Pop
+				if lowerCommand == "peek" {
+					pop = c.Peek
+				}
+				msg, e := pop(commandParts[1])
+				if e == ErrQueueEmpty {
+					fmt.Println("Queue is empty")
+				} else if e != nil {
+					fmt.Println("Unable to read queue: " + e.Error())
+				} else {
+					fmt.Println("Priority : ", msg.Priority)
+					fmt.Println("Value : ", FormatValue(msg.Value))
+					printMeta(msg)
+				}
+			}
+		} else if lowerCommand == "bpop" {
+			// bpop seconds queue [queue...], 0 seconds waits forever
+			commandParts := strings.Fields(command)
+			seconds := -1
+			if len(commandParts) > 2 {
+				if n, err := strconv.Atoi(commandParts[1]); err == nil {
+					seconds = n
+				}
+			}
+			if seconds < 0 {
+				fmt.Println("Usage : bpop seconds queue [queue...]")
+			} else {
+				msg, e := c.BlockingPop(time.Duration(seconds)*time.Second, commandParts[2:]...)
+				if e == ErrTimeout {
+					fmt.Println("No message after", seconds, "second(s)")
+				} else if e != nil {
+					fmt.Println("Unable to read queue: " + e.Error())
+				} else {
+					fmt.Println("Queue : ", msg.Key)
+					fmt.Println("Value : ", FormatValue(msg.Value))
+				}
+			}
+		} else if lowerCommand == "publish" {
+			commandParts := strings.Fields(command)
+			if len(commandParts) < 3 {
+				fmt.Println("Usage : publish topic value")
+			} else {
+				value := strings.Join(commandParts[2:], " ")
+				n, e := c.Publish(commandParts[1], value)
+				if e != nil {
+					fmt.Println("Unable to publish message: " + e.Error())
+				} else {
+					fmt.Println("Subscribers : ", n)
+				}
+			}
+		} else if lowerCommand == "subscribe" {
+			// subscribe pattern [seconds], prints what is published for that long
+			commandParts := strings.Fields(command)
+			if len(commandParts) < 2 {
+				fmt.Println("Usage : subscribe pattern [seconds]")
+			} else {
+				seconds := 10
+				if len(commandParts) > 2 {
+					if n, err := strconv.Atoi(commandParts[2]); err == nil && n > 0 {
+						seconds = n
+					}
+				}
+				ch, e := c.Subscribe(commandParts[1])
+				if e != nil {
+					fmt.Println("Unable to subscribe: " + e.Error())
+				} else {
+					timeout := time.After(time.Duration(seconds) * time.Second)
+				listen:
+					for {
+						select {
+						case msg, ok := <-ch:
+							if !ok {
+								break listen
+							}
+							fmt.Println(msg.Key, ":", FormatValue(msg.Value))
+						case <-timeout:
+							break listen
+						}
+					}
+					c.Unsubscribe(ch)
+				}
+			}
+		} else if lowerCommand == "xdeclare" {
+			// xdeclare stream partitions [maxlen] [maxage seconds]
+			commandParts := strings.Fields(command)
+			if len(commandParts) < 3 {
+				fmt.Println("Usage : xdeclare stream partitions [maxlen] [maxage seconds]")
+			} else {
+				config := StreamConfig{Name: commandParts[1]}
+				config.Partitions, _ = strconv.Atoi(commandParts[2])
+				if len(commandParts) > 3 {
+					config.MaxLen, _ = strconv.ParseInt(commandParts[3], 10, 64)
+				}
+				if len(commandParts) > 4 {
+					seconds, _ := strconv.Atoi(commandParts[4])
+					config.MaxAge = time.Duration(seconds) * time.Second
+				}
+				if e := c.DeclareStream(config); e != nil {
+					fmt.Println("Unable to declare stream: " + e.Error())
+				}
+			}
+		} else if lowerCommand == "xadd" {
+			// xadd stream partitionkey value, a partition key of - spreads entries
+			commandParts := strings.Fields(command)
+			if len(commandParts) < 4 {
+				fmt.Println("Usage : xadd stream partitionkey|- value")
+			} else {
+				key := commandParts[2]
+				if key == "-" {
+					key = ""
+				}
+				id, e := c.Append(commandParts[1], key, strings.Join(commandParts[3:], " "))
+				if e != nil {
+					fmt.Println("Unable to append entry: " + e.Error())
+				} else {
+					fmt.Println("ID : ", id)
+				}
+			}
+		} else if lowerCommand == "xrange" || lowerCommand == "xread" {
+			// xrange stream from [to] [count], xread stream group [count] [consumer]
+			commandParts := strings.Fields(command)
+			if len(commandParts) < 3 {
+				fmt.Println("Usage : xrange stream from [to] [count], xread stream group [count] [consumer]")
+			} else {
+				var entries []StreamEntry
+				var e error
+				if lowerCommand == "xrange" {
+					from, _ := strconv.ParseInt(commandParts[2], 10, 64)
+					var to int64
+					count := 0
+					if len(commandParts) > 3 {
+						to, _ = strconv.ParseInt(commandParts[3], 10, 64)
+					}
+					if len(commandParts) > 4 {
+						count, _ = strconv.Atoi(commandParts[4])
+					}
+					entries, e = c.ReadStream(commandParts[1], from, to, count)
+				} else {
+					count := 0
+					if len(commandParts) > 3 {
+						count, _ = strconv.Atoi(commandParts[3])
+					}
+					consumer := ""
+					if len(commandParts) > 4 {
+						consumer = commandParts[4]
+					}
+					entries, e = c.ReadGroupAs(commandParts[1], commandParts[2], consumer, count)
+				}
+				if e != nil {
+					fmt.Println("Unable to read stream: " + e.Error())
+				}
+				for _, entry := range entries {
+					fmt.Printf("%d\tpartition %d\t%s\n", entry.ID, entry.Partition, FormatValue(entry.Msg.Value))
+				}
+			}
+		} else if lowerCommand == "xcommit" {
+			// xcommit stream group partition id
+			commandParts := strings.Fields(command)
+			if len(commandParts) < 5 {
+				fmt.Println("Usage : xcommit stream group partition id")
+			} else {
+				partition, _ := strconv.Atoi(commandParts[3])
+				id, _ := strconv.ParseInt(commandParts[4], 10, 64)
+				if e := c.CommitOffsets(commandParts[1], commandParts[2], map[int]int64{partition: id}); e != nil {
+					fmt.Println("Unable to commit offset: " + e.Error())
+				}
+			}
+		} else if lowerCommand == "xtrim" {
+			// xtrim stream maxlen [maxage seconds]
+			commandParts := strings.Fields(command)
+			if len(commandParts) < 3 {
+				fmt.Println("Usage : xtrim stream maxlen [maxage seconds]")
+			} else {
+				maxLen, _ := strconv.ParseInt(commandParts[2], 10, 64)
+				seconds := 0
+				if len(commandParts) > 3 {
+					seconds, _ = strconv.Atoi(commandParts[3])
+				}
+				n, e := c.TrimStream(commandParts[1], maxLen, time.Duration(seconds)*time.Second)
+				if e != nil {
+					fmt.Println("Unable to trim stream: " + e.Error())
+				} else {
+					fmt.Println("Trimmed : ", n)
+				}
+			}
+		} else if lowerCommand == "streams" {
+			streams, e := c.Streams()
+			if e != nil {
+				fmt.Println("Unable to list streams: " + e.Error())
+			}
+			for _, s := range streams {
+				fmt.Printf("%s\tpartitions %d\tlen %d\tlast id %d\tgroups %v\n", s.Name, s.Partitions, s.Len, s.LastID, s.Groups)
+			}
+		} else if lowerCommand == "groups" {
+			groups, e := c.ConsumerGroups()
+			if e != nil {
+				fmt.Println("Unable to list consumer groups: " + e.Error())
+			}
+			for _, g := range groups {
+				source := "queue " + g.Queue
+				if g.Stream != "" {
+					source = "stream " + g.Stream
+				}
+				fmt.Printf("%s\tgroup %s\tmembers %v\n", source, g.Group, g.Members)
+				for p := range g.Targets {
+					fmt.Printf("\tpartition %d\tgiven to %s\theld by %s\n", p, g.Targets[p], g.Owners[p])
+				}
+			}
+		} else if lowerCommand == "gleave" {
+			// gleave queue|stream name group consumer
+			commandParts := strings.Fields(command)
+			if len(commandParts) < 5 || (commandParts[1] != "queue" && commandParts[1] != "stream") {
+				fmt.Println("Usage : gleave queue|stream name group consumer")
+			} else {
+				args := GroupArgs{Group: commandParts[3], Consumer: commandParts[4]}
+				if commandParts[1] == "queue" {
+					args.Queue = commandParts[2]
+				} else {
+					args.Stream = commandParts[2]
+				}
+				left, e := c.LeaveGroup(args)
+				if e != nil {
+					fmt.Println("Unable to leave consumer group: " + e.Error())
+				} else if !left {
+					fmt.Println("Consumer is not in the group")
+				}
+			}
+		} else if lowerCommand == "exdeclare" {
+			// exdeclare exchange direct|fanout|topic|headers
+			commandParts := strings.Fields(command)
+			if len(commandParts) < 3 {
+				fmt.Println("Usage : exdeclare exchange direct|fanout|topic|headers")
+			} else if e := c.DeclareExchange(commandParts[1], strings.ToLower(commandParts[2])); e != nil {
+				fmt.Println("Unable to declare exchange: " + e.Error())
+			}
+		} else if lowerCommand == "exdelete" {
+			commandParts := strings.Fields(command)
+			if len(commandParts) < 2 {
+				fmt.Println("Usage : exdelete exchange")
+			} else if e := c.DeleteExchange(commandParts[1]); e != nil {
+				fmt.Println("Unable to delete exchange: " + e.Error())
+			}
+		} else if lowerCommand == "bind" || lowerCommand == "unbind" {
+			// bind exchange queue [routingkey] [any] [header.name=value...]
+			commandParts := strings.Fields(command)
+			if len(commandParts) < 3 {
+				fmt.Println("Usage : " + lowerCommand + " exchange queue [routingkey] [any] [header.name=value...]")
+			} else {
+				binding := Binding{Exchange: commandParts[1], Queue: commandParts[2]}
+				for _, part := range commandParts[3:] {
+					m := MqMsg{}
+					if strings.ToLower(part) == "any" {
+						binding.MatchAny = true
+					} else if strings.HasPrefix(strings.ToLower(part), "header.") && parseMeta(&m, part) {
+						if binding.Headers == nil {
+							binding.Headers = map[string]string{}
+						}
+						for k, v := range m.Headers {
+							binding.Headers[k] = v
+						}
+					} else {
+						binding.RoutingKey = part
+					}
+				}
+				if lowerCommand == "bind" {
+					if e := c.Bind(binding); e != nil {
+						fmt.Println("Unable to bind queue: " + e.Error())
+					}
+				} else {
+					removed, e := c.Unbind(binding)
+					if e != nil {
+						fmt.Println("Unable to unbind queue: " + e.Error())
+					} else if !removed {
+						fmt.Println("Queue is not bound that way")
+					}
+				}
+			}
+		} else if lowerCommand == "exchanges" {
+			exchanges, e := c.Exchanges()
+			if e != nil {
+				fmt.Println("Unable to list exchanges: " + e.Error())
+			}
+			for _, x := range exchanges {
+				fmt.Printf("%s\t%s\n", x.Name, x.Type)
+				for _, b := range x.Bindings {
+					match := "all"
+					if b.MatchAny {
+						match = "any"
+					}
+					fmt.Printf("\t-> %s\tkey '%s'\theaders %s (%s)\n", b.Queue, b.RoutingKey, FormatHeaders(b.Headers), match)
+				}
+			}
+		} else if lowerCommand == "route" {
+			// route exchange routingkey|- [header.name=value...] value
+			commandParts := strings.Fields(command)
+			m := MqMsg{}
+			for len(commandParts) > 4 && parseMeta(&m, commandParts[3]) {
+				commandParts = append(commandParts[:3], commandParts[4:]...)
+			}
+			if len(commandParts) < 4 {
+				fmt.Println("Usage : route exchange routingkey|- [field=value...] value")
+			} else {
+				key := commandParts[2]
+				if key == "-" {
+					key = ""
+				}
+				m.Value = strings.Join(commandParts[3:], " ")
+				results, e := c.Route(commandParts[1], key, m)
+				if e != nil {
+					fmt.Println("Unable to route message: " + e.Error())
+				} else {
+					n := 0
+					for _, result := range results {
+						if result.Error != "" {
+							fmt.Println(result.Key, ": ", result.Error)
+						} else {
+							n++
+						}
+					}
+					fmt.Println("Queues : ", n)
+				}
+			}
+		} else if lowerCommand == "recv" {
+			// recv queue [seconds] [group consumer], the message is leased for that long
+			commandParts := strings.Fields(command)
+			if len(commandParts) < 2 || len(commandParts) == 4 {
+				fmt.Println("Usage : recv queue [seconds] [group consumer]")
+			} else {
+				seconds := 0
+				if len(commandParts) > 2 {
+					seconds, _ = strconv.Atoi(commandParts[2])
+				}
+				var d *Delivery
+				var e error
+				if len(commandParts) > 4 {
+					d, e = c.ReceiveGroup(commandParts[1], commandParts[3], commandParts[4], time.Duration(seconds)*time.Second)
+				} else {
+					d, e = c.Receive(commandParts[1], time.Duration(seconds)*time.Second)
+				}
+				if e == ErrQueueEmpty {
+					fmt.Println("Queue is empty")
+				} else if e != nil {
+					fmt.Println("Unable to receive message: " + e.Error())
+				} else {
+					fmt.Println("Lease : ", d.LeaseID, "until", d.Until.Format(time.RFC3339))
+					fmt.Println("Attempts : ", d.Msg.Attempts)
+					fmt.Println("Partition : ", d.Partition)
+					fmt.Println("Value : ", FormatValue(d.Msg.Value))
+					printMeta(&d.Msg)
+				}
+			}
+		} else if lowerCommand == "declare" {
+			// declare [priority] queue [deadletterqueue] [maxdeliveries] [maxlen=n] [maxbytes=n] [overflow=policy] [timeout=seconds] [partitions=n]
+			commandParts := []string{}
+			limits := map[string]string{}
+			for _, part := range strings.Fields(command) {
+				if pair := strings.SplitN(part, "=", 2); len(pair) == 2 {
+					limits[strings.ToLower(pair[0])] = pair[1]
+				} else {
+					commandParts = append(commandParts, part)
+				}
+			}
+			priority := len(commandParts) > 1 && strings.ToLower(commandParts[1]) == "priority"
+			if priority {
+				commandParts = append(commandParts[:1], commandParts[2:]...)
+			}
+			if len(commandParts) < 2 {
+				fmt.Println("Usage : declare [priority] queue [deadletterqueue] [maxdeliveries] [maxlen=n] [maxbytes=n] [overflow=reject-publish|drop-head|block] [timeout=seconds] [partitions=n]")
+			} else {
+				config := QueueConfig{Name: commandParts[1], Priority: priority}
+				if len(commandParts) > 2 {
+					config.DeadLetter = commandParts[2]
+				}
+				if len(commandParts) > 3 {
+					config.MaxDeliveries, _ = strconv.Atoi(commandParts[3])
+				}
+				config.MaxLen, _ = strconv.ParseInt(limits["maxlen"], 10, 64)
+				config.MaxBytes, _ = strconv.ParseInt(limits["maxbytes"], 10, 64)
+				config.Overflow = limits["overflow"]
+				seconds, _ := strconv.Atoi(limits["timeout"])
+				config.BlockTimeout = time.Duration(seconds) * time.Second
+				config.Partitions, _ = strconv.Atoi(limits["partitions"])
+				if e := c.DeclareQueue(config); e != nil {
+					fmt.Println("Unable to declare queue: " + e.Error())
+				}
+			}
+		} else if lowerCommand == "queues" {
+			queues, e := c.Queues()
+			if e != nil {
+				fmt.Println("Unable to list queues: " + e.Error())
+			}
+			for _, q := range queues {
+				fmt.Printf("%s\tlen %d\tleased %d\tdead-letter %s\tmax deliveries %d\tpriority %v", q.Name, q.Len, q.Leased, q.DeadLetter, q.MaxDeliveries, q.Priority)
+				if q.MaxLen > 0 || q.MaxBytes > 0 {
+					fmt.Printf("\tmax len %d\tmax bytes %d\toverflow %s", q.MaxLen, q.MaxBytes, q.Overflow)
+				}
+				if q.Partitions > 1 {
+					fmt.Printf("\tpartitions %d", q.Partitions)
+				}
+				fmt.Println()
+			}
+		} else if lowerCommand == "reject" {
+			// reject queue lease [reason]
+			commandParts := strings.Fields(command)
+			if len(commandParts) < 3 {
+				fmt.Println("Usage : reject queue lease [reason]")
+			} else if e := c.Reject(commandParts[1], commandParts[2], strings.Join(commandParts[3:], " ")); e != nil {
+				fmt.Println("Unable to reject message: " + e.Error())
+			}
+		} else if lowerCommand == "dlq" {
+			// dlq list queue [count], dlq requeue queue [id...], dlq purge queue
+			commandParts := strings.Fields(command)
+			if len(commandParts) < 3 {
+				fmt.Println("Usage : dlq list|requeue|purge queue")
+			} else if strings.ToLower(commandParts[1]) == "list" {
+				count := 0
+				if len(commandParts) > 3 {
+					count, _ = strconv.Atoi(commandParts[3])
+				}
+				letters, e := c.DeadLetters(commandParts[2], count)
+				if e != nil {
+					fmt.Println("Unable to list dead letters: " + e.Error())
+				}
+				for _, l := range letters {
+					fmt.Printf("%d\t%s\t%s\t%s\n", l.ID, l.Msg.Origin, l.Msg.Reason, FormatValue(l.Msg.Value))
+				}
+			} else if strings.ToLower(commandParts[1]) == "requeue" {
+				ids := []int64{}
+				for _, id := range commandParts[3:] {
+					n, _ := strconv.ParseInt(id, 10, 64)
+					ids = append(ids, n)
+				}
+				n, e := c.RequeueDeadLetters(commandParts[2], ids...)
+				if e != nil {
+					fmt.Println("Unable to requeue dead letters: " + e.Error())
+				} else {
+					fmt.Println("Requeued : ", n)
+				}
+			} else if strings.ToLower(commandParts[1]) == "purge" {
+				n, e := c.PurgeDeadLetters(commandParts[2])
+				if e != nil {
+					fmt.Println("Unable to purge dead letters: " + e.Error())
+				} else {
+					fmt.Println("Purged : ", n)
+				}
+			}
+		} else if lowerCommand == "schedule" {
+			// schedule seconds queue value, pushes value once seconds have passed
+			commandParts := strings.Fields(command)
+			seconds := -1
+			if len(commandParts) > 3 {
+				if n, err := strconv.Atoi(commandParts[1]); err == nil {
+					seconds = n
+				}
+			}
+			if seconds < 0 {
+				fmt.Println("Usage : schedule seconds queue value")
+			} else {
+				value := strings.Join(commandParts[3:], " ")
+				id, e := c.PushDelayed(commandParts[2], value, time.Duration(seconds)*time.Second)
+				if e != nil {
+					fmt.Println("Unable to schedule message: " + e.Error())
+				} else {
+					fmt.Println("Scheduled : ", id)
+				}
+			}
+		} else if lowerCommand == "scheduled" {
+			// scheduled [queue]
+			commandParts := strings.Fields(command)
+			queue := ""
+			if len(commandParts) > 1 {
+				queue = commandParts[1]
+			}
+			msgs, e := c.Scheduled(queue, 0)
+			if e != nil {
+				fmt.Println("Unable to list scheduled messages: " + e.Error())
+			}
+			for _, m := range msgs {
+				fmt.Printf("%d\t%s\t%s\t%s\n", m.ID, m.Due.Format(time.RFC3339), m.Queue, FormatValue(m.Msg.Value))
+			}
+		} else if lowerCommand == "unschedule" {
+			commandParts := strings.Fields(command)
+			if len(commandParts) < 2 {
+				fmt.Println("Usage : unschedule id")
+			} else {
+				id, _ := strconv.ParseInt(commandParts[1], 10, 64)
+				if e := c.CancelSchedule(id); e != nil {
+					fmt.Println("Unable to cancel scheduled message: " + e.Error())
+				}
+			}
+		} else if lowerCommand == "ack" || lowerCommand == "nack" || lowerCommand == "extend" {
+			// ack queue lease, nack queue lease, extend queue lease seconds
+			commandParts := strings.Fields(command)
+			if len(commandParts) < 3 {
+				fmt.Println("Usage : " + lowerCommand + " queue lease")
+			} else if lowerCommand == "extend" {
+				seconds := 0
+				if len(commandParts) > 3 {
+					seconds, _ = strconv.Atoi(commandParts[3])
+				}
+				until, e := c.ExtendLease(commandParts[1], commandParts[2], time.Duration(seconds)*time.Second)
+				if e != nil {
+					fmt.Println("Unable to extend lease: " + e.Error())
+				} else {
+					fmt.Println("Leased until : ", until.Format(time.RFC3339))
+				}
+			} else {
+				settle := c.Ack
+				if lowerCommand == "nack" {
+					settle = c.Nack
+				}
+				if e := settle(commandParts[1], commandParts[2]); e != nil {
+					fmt.Println("Unable to " + lowerCommand + " message: " + e.Error())
+				}
+			}
+		} else if lowerCommand == "qlen" || lowerCommand == "purge" {
+			commandParts := strings.Fields(command)
+			if len(commandParts) < 2 {
+				fmt.Println("Usage : " + lowerCommand + " queue")
+			} else if lowerCommand == "qlen" {
+				n, e := c.Len(commandParts[1])
+				if e != nil {
+					fmt.Println("Unable to read queue: " + e.Error())
+				} else {
+					fmt.Println("Length : ", n)
+				}
+			} else {
+				n, e := c.Purge(commandParts[1])
+				if e != nil {
+					fmt.Println("Unable to purge queue: " + e.Error())
+				} else {
+					fmt.Println("Purged : ", n)
+				}
+			}
+		} else if lowerCommand == "save" || lowerCommand == "bgsave" || lowerCommand == "bgrewriteaof" {
+			op := "Save"
+			if lowerCommand == "bgsave" {
+				op = "BgSave"
+			} else if lowerCommand == "bgrewriteaof" {
+				op = "BgRewriteAOF"
+			}
+			s, e := c.CallString(op, "")
+			if e != nil {
+				fmt.Println("Unable to save snapshot: " + e.Error())
+			} else {
+				fmt.Println(s)
+			}
 		} else if lowerCommand == "getlog" {
 			commandParts := strings.Split(command, " ")
 			key := commandParts[1]
@@ -311,11 +1107,65 @@ func commandToObject(data string) MqMsg {
 			m.Value = strings.Split(obj, "=")[1]
 
 		}
+		parseMeta(&m, strings.TrimSpace(anotherkeys[i]))
 
 	}
 	return m
 }
 
+// parseMeta sets the metadata field of m named by option, one of
+// contenttype=, correlationid=, replyto=, messageid=, dedup= or header.name=, and
+// tells whether option was one of them.
+func parseMeta(m *MqMsg, option string) bool {
+	parts := strings.SplitN(option, "=", 2)
+	if len(parts) < 2 {
+		return false
+	}
+	field := strings.ToLower(strings.TrimSpace(parts[0]))
+	value := strings.Trim(strings.TrimSpace(parts[1]), "\"")
+	switch {
+	case field == "contenttype":
+		m.ContentType = value
+	case field == "correlationid":
+		m.CorrelationID = value
+	case field == "replyto":
+		m.ReplyTo = value
+	case field == "messageid":
+		m.MessageID = value
+	case field == "dedup":
+		m.DedupKey = value
+	case field == "partition":
+		m.PartitionKey = value
+	case strings.HasPrefix(field, "header.") && len(field) > len("header."):
+		if m.Headers == nil {
+			m.Headers = map[string]string{}
+		}
+		m.Headers[strings.TrimSpace(parts[0])[len("header."):]] = value
+	default:
+		return false
+	}
+	return true
+}
+
+// printMeta prints the metadata fields of msg that are set.
+func printMeta(msg *MqMsg) {
+	if msg.ContentType != "" {
+		fmt.Println("Content Type : ", msg.ContentType)
+	}
+	if msg.CorrelationID != "" {
+		fmt.Println("Correlation ID : ", msg.CorrelationID)
+	}
+	if msg.ReplyTo != "" {
+		fmt.Println("Reply To : ", msg.ReplyTo)
+	}
+	if len(msg.Headers) > 0 {
+		fmt.Println("Headers : ", FormatHeaders(msg.Headers))
+	}
+	if msg.MessageID != "" {
+		fmt.Println("Message ID : ", msg.MessageID)
+	}
+}
+
 func parseSetCommand(command string) (string, MqMsg) {
 	match, _ := regexp.MatchString("set()", command)
 	if match == true {
@@ -331,10 +1181,25 @@ func parseSetCommand(command string) (string, MqMsg) {
 	}
 }
 
+// parseBatchCommand returns the comma separated arguments of mset(...) and mget(...).
+func parseBatchCommand(command string) []string {
+	args := []string{}
+	parts := strings.SplitN(command, "(", 2)
+	if len(parts) < 2 {
+		return args
+	}
+	for _, arg := range strings.Split(strings.TrimRight(parts[1], ")"), ",") {
+		if strings.TrimSpace(arg) != "" {
+			args = append(args, strings.TrimSpace(arg))
+		}
+	}
+	return args
+}
+
 func parseIncCommand(command string) (string, string) {
-	match, _ := regexp.MatchString("inc()", command)
+	match, _ := regexp.MatchString("(inc|decr)\\(.*,.*\\)", command)
 	if match == true {
-		splitSet := strings.Split(command, "inc(")[1]
+		splitSet := strings.SplitN(command, "(", 2)[1]
 		data := strings.TrimRight(splitSet, ")")
 		return strings.Split(data, ",")[0], strings.Split(data, ",")[1]
 
@@ -369,14 +1234,12 @@ func parseGetCommand(command string) (string, string) {
 	}
 }
 
-func getValue(key string, c *MqClient) string {
+func getItem(key string, c *MqClient) *MqMsg {
 	//fmt.Println("key:", key)
 	msg, e := c.Call("Get", key)
 	if e != nil {
 		//fmt.Println("Unable to store message: " + e.Error())
-		return ""
-	} else {
-		return msg.Value.(string)
-		//fmt.Printf("Value: %v \n", msg.Value)
+		return nil
 	}
+	return msg
 }
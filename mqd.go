@@ -20,6 +20,13 @@ func main() {
 	hostFlag := flag.String("master", "", "Master host. Default is localhost:7890")
 	mirrorFlag := flag.Bool("mirror", false, "Mirror host. Default is false")
 	memoryFlag := flag.Int64("memory", 10485760, "Max Allocated memory node Default is 10 Mb")
+	evictionFlag := flag.String("eviction", "noeviction", "Eviction policy when memory is full: noeviction, allkeys-lru, allkeys-lfu or volatile-ttl. Default is noeviction")
+	dataDirFlag := flag.String("dir", "", "Directory for snapshot files, persistence is disabled without it. Default is empty")
+	saveSecondsFlag := flag.Int64("save-seconds", 300, "Save a snapshot every N seconds when there are writes, 0 to disable. Default is 300")
+	saveWritesFlag := flag.Int64("save-writes", 1000, "Save a snapshot after M writes, 0 to disable. Default is 1000")
+	appendOnlyFlag := flag.Bool("appendonly", false, "Log every write to an append only file in the data directory. Default is false")
+	fsyncFlag := flag.String("appendfsync", "everysec", "When to fsync the append only file: always, everysec or no. Default is everysec")
+	dedupFlag := flag.Int64("dedup-seconds", 600, "Seconds a deduplication key of Set and Push is remembered, 0 to disable. Default is 600")
 	flag.Parse()
 
 	hostName := "127.0.0.1"
@@ -42,11 +49,22 @@ func main() {
 		}
 	}
 
-	startStatus := make(chan string)
+	startStatus := make(chan string, 1)
 	fmt.Printf("Starting MQ server at port %d \n", *portFlag)
 	go func() {
 		// Starting server on localhost
-		e = StartMQServer("127.0.0.1", *portFlag, *memoryFlag)
+		e = StartMQServer(&ServerConfig{
+			Name:             "127.0.0.1",
+			Port:             *portFlag,
+			Memory:           *memoryFlag,
+			EvictionPolicy:   *evictionFlag,
+			DataDir:          *dataDirFlag,
+			SnapshotInterval: *saveSecondsFlag,
+			SnapshotWrites:   *saveWritesFlag,
+			AppendOnly:       *appendOnlyFlag,
+			AppendFsync:      *fsyncFlag,
+			DedupWindow:      time.Duration(*dedupFlag) * time.Second,
+		})
 		if e != nil {
 			//panic("Unable to start server: " + e.Error())
 			startStatus <- fmt.Sprintf("\nUnable to start service : %s \n", e.Error())
@@ -55,6 +73,12 @@ func main() {
 	}()
 
 	time.Sleep(5 * time.Second)
+	select {
+	case status := <-startStatus:
+		fmt.Print(status)
+		return
+	default:
+	}
 	currentListenerAddress := "127.0.0.1:" + strconv.Itoa(*portFlag)
 	c, e := NewMqClient(currentListenerAddress, time.Second*10)
 	if e != nil {
@@ -0,0 +1,25 @@
+package msg
+
+import (
+	"errors"
+)
+
+// KeyResult is the outcome for one key of a batch operation. Found tells
+// whether the key existed for MGet and MDelete, whether it was stored for
+// MSet and, with the queue name as Key, whether Route pushed the message to
+// that queue; Error holds the reason a key failed. A key of MSet stored on its node
+// but not on every mirror is Found with ErrMirrorDegraded as Error.
+type KeyResult struct {
+	Key   string
+	Found bool
+	Msg   MqMsg
+	Error string
+}
+
+// Err returns the error of the key, nil when it succeeded.
+func (k KeyResult) Err() error {
+	if k.Error == "" {
+		return nil
+	}
+	return ParseError(errors.New(k.Error))
+}
@@ -0,0 +1,70 @@
+package msg
+
+import (
+	"errors"
+)
+
+// Errors shared by server and client. net/rpc only carries the error text,
+// so ParseError turns a received error back into one of these values.
+var (
+	ErrOutOfMemory  = errors.New("out of memory: every node reached its allocated size")
+	ErrNotInteger   = errors.New("value is not an integer or out of range")
+	ErrNotFloat     = errors.New("value is not a valid float")
+	ErrIncrOverflow = errors.New("increment or decrement would overflow")
+
+	ErrVersionConflict = errors.New("version conflict: key has been changed by another writer")
+	ErrKeyExists       = errors.New("key already exists")
+	ErrKeyNotFound     = errors.New("key does not exist")
+	ErrMirrorDegraded  = errors.New("written to its node, but not to every mirror")
+
+	ErrQueueEmpty = errors.New("queue is empty")
+	ErrQueueFull  = errors.New("queue is full")
+	ErrTimeout    = errors.New("timed out waiting for a message")
+	ErrTooLarge   = errors.New("message is larger than the queue can hold")
+
+	ErrLeaseNotFound = errors.New("lease does not exist or has expired")
+
+	ErrSubscriptionNotFound = errors.New("subscription does not exist or has expired")
+
+	ErrScheduleNotFound = errors.New("scheduled message does not exist or has been delivered")
+
+	ErrExchangeNotFound = errors.New("exchange does not exist")
+
+	ErrNoReplyTo      = errors.New("message has no reply-to queue")
+	ErrReplyQueueGone = errors.New("reply queue does not exist or its requester is gone")
+	ErrExclusiveQueue = errors.New("queue is exclusive to the connection that declared it")
+)
+
+var knownErrors = []error{
+	ErrOutOfMemory,
+	ErrNotInteger,
+	ErrNotFloat,
+	ErrIncrOverflow,
+	ErrVersionConflict,
+	ErrKeyExists,
+	ErrKeyNotFound,
+	ErrMirrorDegraded,
+	ErrQueueEmpty,
+	ErrQueueFull,
+	ErrTimeout,
+	ErrTooLarge,
+	ErrLeaseNotFound,
+	ErrSubscriptionNotFound,
+	ErrScheduleNotFound,
+	ErrExchangeNotFound,
+	ErrNoReplyTo,
+	ErrReplyQueueGone,
+	ErrExclusiveQueue,
+}
+
+func ParseError(err error) error {
+	if err == nil {
+		return nil
+	}
+	for _, known := range knownErrors {
+		if err.Error() == known.Error() {
+			return known
+		}
+	}
+	return err
+}
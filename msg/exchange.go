@@ -0,0 +1,53 @@
+package msg
+
+// Exchange types. A direct exchange routes a message to the queues bound with
+// its routing key, a fanout exchange to every bound queue, a topic exchange
+// to the queues whose binding pattern matches the routing key, with the
+// wildcards of Subscribe, and a headers exchange to the queues whose binding
+// headers match the headers of the message.
+const (
+	ExchangeDirect  string = "direct"
+	ExchangeFanout  string = "fanout"
+	ExchangeTopic   string = "topic"
+	ExchangeHeaders string = "headers"
+)
+
+// IsExchangeType tells whether kind is one of the exchange types.
+func IsExchangeType(kind string) bool {
+	switch kind {
+	case ExchangeDirect, ExchangeFanout, ExchangeTopic, ExchangeHeaders:
+		return true
+	}
+	return false
+}
+
+// ExchangeConfig describes an exchange.
+type ExchangeConfig struct {
+	Name string
+	Type string
+}
+
+// Binding routes the messages of Exchange matching it into Queue. RoutingKey
+// is the key of a direct exchange or the pattern of a topic exchange. Headers
+// are matched by a headers exchange, all of them or, with MatchAny, at least
+// one.
+type Binding struct {
+	Exchange   string
+	Queue      string
+	RoutingKey string
+	Headers    map[string]string
+	MatchAny   bool
+}
+
+// ExchangeStatus describes one exchange as returned by Exchanges.
+type ExchangeStatus struct {
+	ExchangeConfig
+	Bindings []Binding
+}
+
+// RouteArgs publishes Msg to Exchange with RoutingKey.
+type RouteArgs struct {
+	Exchange   string
+	RoutingKey string
+	Msg        MqMsg
+}
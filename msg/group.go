@@ -0,0 +1,23 @@
+package msg
+
+// GroupArgs names Consumer of Group, reading queue Queue or stream Stream.
+type GroupArgs struct {
+	Queue    string
+	Stream   string
+	Group    string
+	Consumer string
+}
+
+// ConsumerGroupStatus describes a consumer group of a queue or a stream, as
+// returned by ConsumerGroups and JoinGroup. Each partition is given to one
+// of Members, its Target. Owners is the consumer holding each partition,
+// until its messages in flight are settled and the partition moves to its
+// target. An empty name means nobody.
+type ConsumerGroupStatus struct {
+	Queue   string
+	Stream  string
+	Group   string
+	Members []string
+	Targets []string
+	Owners  []string
+}
@@ -1,6 +1,9 @@
 package msg
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"sort"
 	"strings"
 	"time"
 )
@@ -15,6 +18,19 @@ type MqMsg struct {
 	Duration   int64
 	Table      string
 	Permission string
+	Version    int64  // bumped on every write of the key
+	Attempts   int    // times a queue message has been delivered under a lease
+	Origin     string // queue a dead-lettered message comes from
+	Reason     string // why the message was dead-lettered
+	Priority   int64  // messages of a priority queue are delivered highest first
+
+	Headers       map[string]string // application properties of the message
+	ContentType   string            // media type of Value, like application/json
+	CorrelationID string            // ties a reply to the request it answers
+	ReplyTo       string            // queue the reply to this message goes to
+	MessageID     string            // unique id, assigned when the producer leaves it empty
+	DedupKey      string            // a Set, MSet or Push repeated with this key within the dedup window is not applied again
+	PartitionKey  string            // messages with the same key go to the same partition of a queue or a stream
 }
 
 func (msg *MqMsg) SetDefaults(m *MqMsg) {
@@ -36,6 +52,74 @@ func (msg *MqMsg) SetDefaults(m *MqMsg) {
 	if strings.TrimSpace(m.Permission) != "" {
 		msg.Permission = m.Permission
 	}
+
+	msg.Headers = CopyHeaders(m.Headers)
+	msg.ContentType = m.ContentType
+	msg.CorrelationID = m.CorrelationID
+	msg.ReplyTo = m.ReplyTo
+	msg.PartitionKey = m.PartitionKey
+	msg.MessageID = m.MessageID
+	if msg.MessageID == "" {
+		msg.MessageID = NewMessageID()
+	}
+}
+
+// NewMessageID returns a random id for a message.
+func NewMessageID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// CopyHeaders returns a copy of headers, nil when it is empty.
+func CopyHeaders(headers map[string]string) map[string]string {
+	if len(headers) == 0 {
+		return nil
+	}
+	c := make(map[string]string, len(headers))
+	for k, v := range headers {
+		c[k] = v
+	}
+	return c
+}
+
+// FormatHeaders renders headers as name=value pairs sorted by name.
+func FormatHeaders(headers map[string]string) string {
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	pairs := make([]string, len(names))
+	for i, k := range names {
+		pairs[i] = k + "=" + headers[k]
+	}
+	return strings.Join(pairs, ", ")
+}
+
+// ExpireAt returns the moment the message expires, measured from Created.
+// A zero time means the message never expires.
+func (msg *MqMsg) ExpireAt() time.Time {
+	if msg.Expiry <= 0 {
+		return time.Time{}
+	}
+	return msg.Created.Add(msg.Expiry)
+}
+
+// SetExpireAt makes the message expire at t. A zero t removes the expiry.
+func (msg *MqMsg) SetExpireAt(t time.Time) {
+	if t.IsZero() {
+		msg.Expiry = 0
+		msg.Duration = 0
+		return
+	}
+	msg.Expiry = t.Sub(msg.Created)
+	msg.Duration = int64(time.Until(t).Seconds())
+}
+
+func (msg *MqMsg) IsExpired() bool {
+	expireAt := msg.ExpireAt()
+	return !expireAt.IsZero() && !time.Now().Before(expireAt)
 }
 
 func (msg *MqMsg) BuildKey(owner string, table string, key string) string {
@@ -0,0 +1,149 @@
+package msg
+
+import (
+	"time"
+)
+
+// BlockingPopArgs names the queues a consumer waits on, in the order they are
+// tried, and how long it waits. A zero Timeout waits until a message arrives.
+type BlockingPopArgs struct {
+	Queues  []string
+	Timeout time.Duration
+}
+
+// LeaseArgs names a queue and, for Ack, Nack and ExtendLease, one lease on
+// it. Visibility is how long a message stays leased, counted from the call.
+// Receive with Group only leases messages of the partitions the group gives
+// to Consumer.
+type LeaseArgs struct {
+	Queue      string
+	LeaseID    string
+	Visibility time.Duration
+	Reason     string // why the message is rejected, used by Reject
+	Group      string
+	Consumer   string
+}
+
+// Delivery is a message leased to a consumer by Receive. It is given to
+// another consumer when LeaseID is neither acked nor extended before Until.
+type Delivery struct {
+	Queue     string
+	LeaseID   string
+	Until     time.Time
+	Partition int
+	Msg       MqMsg
+}
+
+// PollArgs reads up to Max messages of the subscription ID, waiting up to
+// Wait for one to be published.
+type PollArgs struct {
+	ID   string
+	Max  int
+	Wait time.Duration
+}
+
+// QueueConfig is the policy of a queue. A message nacked or whose lease ran
+// out after MaxDeliveries deliveries, or a rejected one, moves to the
+// DeadLetter queue; without DeadLetter it is dropped. Zero MaxDeliveries
+// redelivers messages for ever. A Priority queue delivers the message with the
+// highest MqMsg.Priority first, the oldest first among equal priorities.
+// A queue holding MaxLen messages, or MaxBytes bytes of values, is full and
+// a push to it follows Overflow; zero means no limit. Messages pushed with
+// the same MqMsg.PartitionKey go to the same one of Partitions.
+type QueueConfig struct {
+	Name          string
+	DeadLetter    string
+	MaxDeliveries int
+	Priority      bool
+	Partitions    int
+
+	MaxLen       int64
+	MaxBytes     int64
+	Overflow     string
+	BlockTimeout time.Duration // how long OverflowBlock waits, 10 seconds when zero
+}
+
+// Overflow policies of a full queue. OverflowReject fails the push with
+// ErrQueueFull. OverflowDropHead removes the oldest waiting messages to make
+// room, moving them to the dead-letter queue the policy requires, and fails
+// the push with ErrQueueFull when leased messages or a full dead-letter queue
+// leave no room.
+// OverflowBlock makes the producer wait for room up to BlockTimeout, then
+// fails the push with ErrQueueFull.
+const (
+	OverflowReject   string = "reject-publish"
+	OverflowDropHead string = "drop-head"
+	OverflowBlock    string = "block"
+)
+
+// IsOverflowPolicy tells whether policy is one of the overflow policies, an
+// empty one meaning OverflowReject.
+func IsOverflowPolicy(policy string) bool {
+	switch policy {
+	case "", OverflowReject, OverflowDropHead, OverflowBlock:
+		return true
+	}
+	return false
+}
+
+// QueueStatus describes one queue as returned by Queues.
+type QueueStatus struct {
+	QueueConfig
+	Len    int64
+	Leased int64
+	Size   int64
+}
+
+// DeadLetterArgs selects messages of the dead-letter queue Queue. Count limits
+// how many are listed, IDs which ones are requeued, all of them when empty.
+type DeadLetterArgs struct {
+	Queue string
+	Count int
+	IDs   []int64
+}
+
+// DeadLetter is one message of a dead-letter queue. Msg.Origin and Msg.Reason
+// tell where it comes from and why.
+type DeadLetter struct {
+	ID  int64
+	Msg MqMsg
+}
+
+// BrowseArgs lists the first Count messages of Queue in delivery order.
+type BrowseArgs struct {
+	Queue string
+	Count int
+}
+
+// QueuedMsg is a message waiting in a queue. Position 0 is the next one
+// delivered.
+type QueuedMsg struct {
+	Position int
+	ID       int64
+	Msg      MqMsg
+}
+
+// ScheduleArgs pushes Msg to the queue Msg.Key at At, or Delay from now when
+// At is zero.
+type ScheduleArgs struct {
+	Msg   MqMsg
+	Delay time.Duration
+	At    time.Time
+}
+
+// ScheduledMsg is a message waiting to be pushed to Queue at Due. Attempts
+// counts the pushes that failed so far.
+type ScheduledMsg struct {
+	ID       int64
+	Queue    string
+	Due      time.Time
+	Msg      MqMsg
+	Attempts int
+}
+
+// ScheduledArgs lists the first Count scheduled messages of Queue, of every
+// queue when Queue is empty.
+type ScheduledArgs struct {
+	Queue string
+	Count int
+}
@@ -0,0 +1,25 @@
+package msg
+
+import (
+	"strings"
+	"time"
+)
+
+// ReplyQueuePrefix starts the name of every temporary reply queue. A reply
+// queue belongs to the connection that declared it, only that connection
+// consumes it and it is deleted once the reply has been received or the
+// connection closes.
+const ReplyQueuePrefix string = "mq.reply."
+
+// IsReplyQueue tells whether name is a temporary reply queue.
+func IsReplyQueue(name string) bool {
+	return strings.HasPrefix(name, ReplyQueuePrefix)
+}
+
+// ReplyWait waits up to Timeout, forever when zero, for the reply with
+// CorrelationID on the reply queue Queue.
+type ReplyWait struct {
+	Queue         string
+	CorrelationID string
+	Timeout       time.Duration
+}
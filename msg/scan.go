@@ -0,0 +1,22 @@
+package msg
+
+// ScanArgs selects the keys returned by one Scan call. An empty Cursor starts
+// a new iteration; Match is a glob in the syntax of path.Match tested against
+// the whole key; Owner and Table keep only the keys of that owner or table.
+type ScanArgs struct {
+	Cursor     string
+	Match      string
+	Owner      string
+	Table      string
+	Count      int
+	WithValues bool
+}
+
+// ScanResult is one page of a Scan. Cursor is passed to the next call and is
+// empty once the iteration is complete. Items is only filled when WithValues
+// was asked for.
+type ScanResult struct {
+	Cursor string
+	Keys   []string
+	Items  []MqMsg
+}
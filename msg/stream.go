@@ -0,0 +1,80 @@
+package msg
+
+import (
+	"time"
+)
+
+// StreamConfig describes a stream. Entries appended with the same partition
+// key go to the same one of its Partitions, so they are read in the order
+// they were appended. Each partition keeps at most MaxLen entries, none older
+// than MaxAge; zero keeps them all.
+type StreamConfig struct {
+	Name       string
+	Partitions int
+	MaxLen     int64
+	MaxAge     time.Duration
+}
+
+// StreamStatus describes one stream as returned by Streams. Groups holds the
+// offset committed by every consumer group, one per partition.
+type StreamStatus struct {
+	StreamConfig
+	Len    int64
+	Size   int64
+	LastID int64
+	Groups map[string][]int64
+}
+
+// StreamEntry is one entry of a stream. IDs grow with every append to the
+// stream, whatever the partition.
+type StreamEntry struct {
+	ID        int64
+	Partition int
+	Msg       MqMsg
+}
+
+// AppendArgs appends Msg to Stream, in the partition of PartitionKey. Entries
+// without a partition key are spread over the partitions.
+type AppendArgs struct {
+	Stream       string
+	PartitionKey string
+	Msg          MqMsg
+}
+
+// StreamReadArgs reads the entries of Stream with an ID from From to To, at
+// most Count of them, from Partitions or from every partition when empty. A
+// zero To reads up to the last entry.
+type StreamReadArgs struct {
+	Stream     string
+	Partitions []int
+	From       int64
+	To         int64
+	Count      int
+}
+
+// GroupReadArgs reads up to Count entries of Stream after the offsets
+// committed by Group, from Partitions or from every partition when empty.
+// With Consumer only the partitions the group gives to it are read.
+type GroupReadArgs struct {
+	Stream     string
+	Group      string
+	Consumer   string
+	Partitions []int
+	Count      int
+}
+
+// CommitArgs stores the offset of Group in each partition of Offsets: the ID
+// of the last entry it has processed there.
+type CommitArgs struct {
+	Stream  string
+	Group   string
+	Offsets map[int]int64
+}
+
+// StreamTrimArgs removes the entries of Stream beyond MaxLen per partition or
+// older than MaxAge.
+type StreamTrimArgs struct {
+	Stream string
+	MaxLen int64
+	MaxAge time.Duration
+}
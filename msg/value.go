@@ -0,0 +1,132 @@
+package msg
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	bytesPreview int = 32
+)
+
+// Basic types, []byte and slices of basic types are known to gob already.
+// These are the other value types every client and server understands.
+func init() {
+	gob.Register(map[string]interface{}{})
+	gob.Register([]interface{}{})
+	gob.Register(map[string]string{})
+	gob.Register(map[string]int{})
+	gob.Register(map[string]int64{})
+	gob.Register(map[string]float64{})
+	gob.Register(time.Time{})
+	gob.Register(time.Duration(0))
+}
+
+// RegisterType makes values of the same type as value storable in MqMsg.Value.
+// It has to be called with the same type by the server and by every client.
+func RegisterType(value interface{}) {
+	gob.Register(value)
+}
+
+// ValueType returns a short name of the type of value.
+func ValueType(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "nil"
+	case []byte:
+		return "bytes"
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+// FormatValue renders value for people: strings and numbers as they are,
+// binary data as its size and a hex preview, everything else as JSON.
+func FormatValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case []byte:
+		if utf8.Valid(v) && bytes.IndexFunc(v, func(c rune) bool { return c < ' ' && c != '\n' && c != '\t' }) < 0 {
+			return string(v)
+		}
+		preview := v
+		if len(preview) > bytesPreview {
+			preview = preview[:bytesPreview]
+		}
+		s := fmt.Sprintf("(%d bytes) %s", len(v), hex.EncodeToString(preview))
+		if len(v) > bytesPreview {
+			s += "..."
+		}
+		return s
+	case int:
+		return strconv.Itoa(v)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case float32:
+		return strconv.FormatFloat(float64(v), 'f', -1, 32)
+	case bool:
+		return strconv.FormatBool(v)
+	case time.Time:
+		return v.Format(time.RFC3339)
+	case fmt.Stringer:
+		return v.String()
+	}
+
+	js, e := json.Marshal(value)
+	if e != nil {
+		return fmt.Sprintf("%v", value)
+	}
+	return string(js)
+}
+
+// DecodeValue stores value into the variable result points to. A []byte
+// value is gob decoded, as returned by the RPCs answering with Encode, unless
+// result is itself a *[]byte; any other value is assigned, converting between
+// numeric types where needed.
+func DecodeValue(value interface{}, result interface{}) error {
+	target := reflect.ValueOf(result)
+	if target.Kind() != reflect.Ptr || target.IsNil() {
+		return fmt.Errorf("Unable to decode into %T, a non nil pointer is needed", result)
+	}
+	target = target.Elem()
+	if value == nil {
+		target.Set(reflect.Zero(target.Type()))
+		return nil
+	}
+
+	if data, isBytes := value.([]byte); isBytes && target.Type() != reflect.TypeOf(data) {
+		return gob.NewDecoder(bytes.NewBuffer(data)).Decode(result)
+	}
+
+	source := reflect.ValueOf(value)
+	switch {
+	case source.Type().AssignableTo(target.Type()):
+		target.Set(source)
+	case isNumber(source.Kind()) && isNumber(target.Kind()):
+		target.Set(source.Convert(target.Type()))
+	default:
+		return fmt.Errorf("Unable to decode value of type %s into %s", ValueType(value), target.Type())
+	}
+	return nil
+}
+
+func isNumber(kind reflect.Kind) bool {
+	switch kind {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,464 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/eaciit/mq/helper"
+	. "github.com/eaciit/mq/msg"
+)
+
+const (
+	FsyncAlways   string = "always"
+	FsyncEverySec string = "everysec"
+	FsyncNo       string = "no"
+
+	aofTick           time.Duration = time.Second
+	aofRewriteMinSize int64         = 1024 * 1024
+)
+
+// aofEntry is one record of the append-only log. Only the fields needed by
+// Op are filled.
+type aofEntry struct {
+	Op   string
+	Key  string
+	Msg  MqMsg
+	Node int
+	Size int64
+	Time time.Time
+	User MqUser
+
+	Seq   int64
+	Seqs  []int64
+	Queue queueInfo
+	Items []QueueItem
+
+	Stream  streamInfo
+	Entries []StreamEntry
+
+	Exchange exchangeInfo
+
+	Dedup []DedupEntry
+}
+
+// appendLog is the append-only file of a server. Every record is written as
+// length, crc32 and the gob encoded entry, so a torn write at the end of the
+// file is detected on replay.
+type appendLog struct {
+	sync.Mutex
+	path  string
+	fsync string
+	file  *os.File
+	dirty bool
+
+	size        int64
+	rewriteSize int64
+	rewriting   bool
+	rewriteBuf  [][]byte
+}
+
+func isFsyncMode(mode string) bool {
+	switch mode {
+	case "", FsyncAlways, FsyncEverySec, FsyncNo:
+		return true
+	}
+	return false
+}
+
+func openAppendLog(dir string, port int, fsync string) (*appendLog, error) {
+	e := os.MkdirAll(dir, 0755)
+	if e != nil {
+		return nil, e
+	}
+
+	a := new(appendLog)
+	a.path = filepath.Join(dir, fmt.Sprintf("appendonly-%d.aof", port))
+	a.fsync = fsync
+	if a.fsync == "" {
+		a.fsync = FsyncEverySec
+	}
+	return a, nil
+}
+
+func encodeRecord(entry aofEntry) ([]byte, error) {
+	buf, e := Encode(entry)
+	if e != nil {
+		return nil, e
+	}
+	payload := buf.Bytes()
+
+	record := new(bytes.Buffer)
+	binary.Write(record, binary.BigEndian, uint32(len(payload)))
+	binary.Write(record, binary.BigEndian, crc32.ChecksumIEEE(payload))
+	record.Write(payload)
+	return record.Bytes(), nil
+}
+
+// readRecords calls fn for every valid record of the log and returns the
+// offset right after the last valid one.
+func readRecords(reader io.Reader, fn func(aofEntry)) (int64, error) {
+	in := bufio.NewReader(reader)
+	var offset int64
+	for {
+		var length, checksum uint32
+		if e := binary.Read(in, binary.BigEndian, &length); e != nil {
+			if e == io.EOF {
+				return offset, nil
+			}
+			return offset, e
+		}
+		if e := binary.Read(in, binary.BigEndian, &checksum); e != nil {
+			return offset, e
+		}
+		payload := make([]byte, length)
+		if _, e := io.ReadFull(in, payload); e != nil {
+			return offset, e
+		}
+		if crc32.ChecksumIEEE(payload) != checksum {
+			return offset, errors.New("checksum mismatch")
+		}
+
+		entry := aofEntry{}
+		if e := Decode(payload, &entry); e != nil {
+			return offset, e
+		}
+		fn(entry)
+		offset += int64(8 + len(payload))
+	}
+}
+
+// replay applies every record of the log to r, then opens the log for
+// appending. A damaged tail is cut off so new records follow the last valid one.
+func (a *appendLog) replay(r *MqRPC) error {
+	file, e := os.OpenFile(a.path, os.O_CREATE|os.O_RDWR, 0666)
+	if e != nil {
+		return e
+	}
+
+	count := 0
+	keys := []string{}
+	offset, e := readRecords(file, func(entry aofEntry) {
+		r.applyEntry(entry)
+		keys = append(keys, entry.Key)
+		count++
+	})
+	r.mu.Lock()
+	r.indexTables(keys...)
+	r.mu.Unlock()
+	if e != nil {
+		Logging(fmt.Sprintf("Append only file %s is damaged after %d record(s), truncating: %s", a.path, count, e.Error()), "WARNING")
+		if e = file.Truncate(offset); e != nil {
+			file.Close()
+			return e
+		}
+	}
+	if _, e = file.Seek(offset, io.SeekStart); e != nil {
+		file.Close()
+		return e
+	}
+
+	a.file = file
+	a.size = offset
+	a.rewriteSize = offset
+	if count > 0 {
+		Logging(fmt.Sprintf("Append only file %s has been replayed, %d record(s)", a.path, count), "INFO")
+	}
+	return nil
+}
+
+func (a *appendLog) append(entry aofEntry) error {
+	record, e := encodeRecord(entry)
+	if e != nil {
+		return e
+	}
+
+	a.Lock()
+	defer a.Unlock()
+	if a.file == nil {
+		return errors.New("Append only file is not open")
+	}
+	if _, e = a.file.Write(record); e != nil {
+		return e
+	}
+	a.size += int64(len(record))
+	if a.rewriting {
+		a.rewriteBuf = append(a.rewriteBuf, record)
+	}
+	if a.fsync == FsyncAlways {
+		return a.file.Sync()
+	}
+	a.dirty = true
+	return nil
+}
+
+func (a *appendLog) sync() {
+	a.Lock()
+	defer a.Unlock()
+	if a.dirty && a.file != nil {
+		a.file.Sync()
+		a.dirty = false
+	}
+}
+
+// rewrite replaces the log with entries, which describe the current state.
+// Records appended while the new file is written are copied over before the
+// files are swapped.
+func (a *appendLog) rewrite(entries []aofEntry) error {
+	tmpPath := a.path + ".rewrite"
+	file, e := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0666)
+	if e != nil {
+		return e
+	}
+
+	out := bufio.NewWriter(file)
+	var size int64
+	for _, entry := range entries {
+		record, e := encodeRecord(entry)
+		if e == nil {
+			_, e = out.Write(record)
+		}
+		if e != nil {
+			file.Close()
+			os.Remove(tmpPath)
+			return e
+		}
+		size += int64(len(record))
+	}
+
+	a.Lock()
+	defer a.Unlock()
+	for _, record := range a.rewriteBuf {
+		if _, e = out.Write(record); e != nil {
+			break
+		}
+		size += int64(len(record))
+	}
+	if e == nil {
+		e = out.Flush()
+	}
+	if e == nil {
+		e = file.Sync()
+	}
+	if e == nil {
+		e = os.Rename(tmpPath, a.path)
+	}
+	if e != nil {
+		file.Close()
+		os.Remove(tmpPath)
+		return e
+	}
+
+	a.file.Close()
+	a.file = file
+	a.size = size
+	a.rewriteSize = size
+	a.dirty = false
+	return nil
+}
+
+func (a *appendLog) needsRewrite() bool {
+	a.Lock()
+	defer a.Unlock()
+	return !a.rewriting && a.size > aofRewriteMinSize && a.size > 2*a.rewriteSize
+}
+
+func (r *MqRPC) logWrite(entry aofEntry) {
+	if r.aof == nil {
+		return
+	}
+	if e := r.aof.append(entry); e != nil {
+		Logging("Unable to write append only file: "+e.Error(), "ERROR")
+	}
+}
+
+// applyEntry replays one record of the append-only log against the local state.
+// Every operation is idempotent, so records already covered by the snapshot
+// can be applied again safely.
+func (r *MqRPC) applyEntry(entry aofEntry) {
+	switch entry.Op {
+	case "SetItem", "Inc":
+		r.items.Set(entry.Key, entry.Msg)
+		return
+	case "DeleteItem", "Delete":
+		r.items.Delete(entry.Key)
+		return
+	case "ExpireItem":
+		r.items.Update(entry.Key, func(item MqMsg, exist bool) (MqMsg, bool, error) {
+			item.SetExpireAt(entry.Time)
+			return item, exist, nil
+		})
+		return
+	case "QueuePush", "QueueRestore", "QueueRemove", "QueueTrim", "QueueState", "QueueLease", "QueueRequeue", "QueueExtend", "QueueDrop":
+		r.applyQueueEntry(entry)
+		return
+	case "Schedule", "Unschedule":
+		r.applyScheduleEntry(entry)
+		return
+	case "StreamAppend", "StreamTrim", "StreamState":
+		r.applyStreamEntry(entry)
+		return
+	case "Dedup":
+		r.loadDedup(entry.Dedup)
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch entry.Op {
+	case "Set":
+		r.recordSet(entry.Msg, entry.Node, entry.Size)
+	case "Forget":
+		r.forgetKey(entry.Key)
+	case "Expire":
+		r.setExpire(entry.Key, entry.Time)
+	case "QueueInfo":
+		r.setQueueInfo(entry.Key, entry.Queue)
+	case "QueueDelete":
+		r.forgetQueue(entry.Key)
+	case "StreamInfo":
+		r.setStreamInfo(entry.Key, entry.Stream)
+	case "ExchangeInfo":
+		r.setExchangeInfo(entry.Key, entry.Exchange)
+	case "ExchangeDelete":
+		delete(r.exchanges, entry.Key)
+	case "DedupAt":
+		if time.Now().Before(entry.Time) {
+			r.dedupAt[entry.Key] = dedupRef{Node: entry.Node, Expires: entry.Time}
+		}
+	case "AddUser":
+		if r.findUser(entry.User.UserName) < 0 {
+			r.users = append(r.users, entry.User)
+		}
+	case "ChangePassword":
+		if i := r.findUser(entry.Key); i >= 0 {
+			r.users[i] = entry.User
+		}
+	case "DeleteUser":
+		if i := r.findUser(entry.Key); i >= 0 {
+			r.users = append(r.users[:i], r.users[i+1:]...)
+		}
+	default:
+		Logging("Unknown append only file record "+entry.Op, "WARNING")
+	}
+}
+
+// stateEntries describes the current state as the shortest list of records
+// that rebuilds it.
+func (r *MqRPC) stateEntries() []aofEntry {
+	unlock := r.lockState()
+	defer unlock()
+	items := r.items.Copy()
+	queues := r.copyQueues()
+	streams := r.copyStreams()
+	scheduled := r.schedule.sorted()
+	dedup := r.copyDedup()
+
+	entries := []aofEntry{}
+	for _, u := range r.users {
+		entries = append(entries, aofEntry{Op: "AddUser", Key: u.UserName, User: u})
+	}
+	for key, item := range items {
+		entries = append(entries, aofEntry{Op: "SetItem", Key: key, Msg: item})
+	}
+	for name, q := range queues {
+		entries = append(entries, aofEntry{Op: "QueueState", Key: name, Items: q.Items, Seq: q.LastSeq})
+	}
+	for name, info := range r.queueMeta {
+		entries = append(entries, aofEntry{Op: "QueueInfo", Key: name, Queue: *info})
+	}
+	for name, s := range streams {
+		entries = append(entries, aofEntry{Op: "StreamState", Key: name, Entries: s.Entries, Seq: s.LastID})
+	}
+	for name, info := range r.streamMeta {
+		entries = append(entries, aofEntry{Op: "StreamInfo", Key: name, Stream: info.clone()})
+	}
+	for name, info := range r.exchanges {
+		entries = append(entries, aofEntry{Op: "ExchangeInfo", Key: name, Exchange: info.clone()})
+	}
+	for _, m := range scheduled {
+		entries = append(entries, aofEntry{Op: "Schedule", Key: m.Queue, Seq: m.ID, Time: m.Due, Msg: m.Msg})
+	}
+	if len(dedup) > 0 {
+		entries = append(entries, aofEntry{Op: "Dedup", Dedup: dedup})
+	}
+	for id, ref := range r.dedupAt {
+		entries = append(entries, aofEntry{Op: "DedupAt", Key: id, Node: ref.Node, Time: ref.Expires})
+	}
+	for key, idx := range r.dataMap {
+		msg := MqMsg{Key: key, Created: time.Now()}
+		if strings.Contains(key, "|") {
+			if table, exist := r.tables[GetTableByKey(key)]; exist {
+				msg.Value = table.Items[key]
+			}
+		}
+		msg.SetExpireAt(r.expires[key])
+
+		var size int64
+		if a, tracked := r.access[key]; tracked {
+			size = a.Size
+		}
+		entries = append(entries, aofEntry{Op: "Set", Key: key, Msg: msg, Node: idx, Size: size})
+	}
+	return entries
+}
+
+// runAppendLog flushes the log every second in everysec mode and starts a
+// rewrite once the log has doubled since the last one.
+func (r *MqRPC) runAppendLog() {
+	if r.aof == nil {
+		return
+	}
+
+	for !r.exiting() {
+		time.Sleep(aofTick)
+		if r.aof.fsync == FsyncEverySec {
+			r.aof.sync()
+		}
+		if r.aof.needsRewrite() {
+			r.BgRewriteAOF("", &MqMsg{})
+		}
+	}
+}
+
+// BgRewriteAOF compacts the append-only log down to the current state in the background.
+func (r *MqRPC) BgRewriteAOF(key string, result *MqMsg) error {
+	if r.aof == nil {
+		return errors.New("Append only file is not enabled")
+	}
+
+	r.aof.Lock()
+	if r.aof.rewriting {
+		r.aof.Unlock()
+		return errors.New("Append only file rewrite already in progress")
+	}
+	r.aof.rewriting = true
+	r.aof.rewriteBuf = nil
+	r.aof.Unlock()
+
+	entries := r.stateEntries()
+	go func() {
+		e := r.aof.rewrite(entries)
+		r.aof.Lock()
+		r.aof.rewriting = false
+		r.aof.rewriteBuf = nil
+		r.aof.Unlock()
+		if e != nil {
+			Logging("Unable to rewrite append only file: "+e.Error(), "ERROR")
+			return
+		}
+		Logging(fmt.Sprintf("Append only file has been rewritten, %d record(s)", len(entries)), "INFO")
+	}()
+
+	result.Value = "Background append only file rewriting started"
+	return nil
+}
@@ -0,0 +1,95 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/eaciit/mq/msg"
+)
+
+// countRecords returns the number of records of the append-only file path.
+func countRecords(t *testing.T, path string) int {
+	file, e := os.Open(path)
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer file.Close()
+	count := 0
+	if _, e = readRecords(file, func(aofEntry) { count++ }); e != nil {
+		t.Fatal(e)
+	}
+	return count
+}
+
+// TestAppendLogReplayAfterRewrite writes keys and queue messages to a server
+// logging every write, rewrites its log while it keeps writing, and replays
+// the log into a new server state. The state must be the one last written.
+func TestAppendLogReplayAfterRewrite(t *testing.T) {
+	dir := t.TempDir()
+	cfg, c := startConfigured(t, &ServerConfig{Memory: 64 << 20, DataDir: dir, AppendOnly: true, AppendFsync: FsyncAlways})
+	defer c.Close()
+
+	for _, value := range []string{"1", "2", "3"} {
+		if _, e := c.Call("Set", MqMsg{Key: "public|aof|kept", Value: value}); e != nil {
+			t.Fatal(e)
+		}
+	}
+	if _, e := c.Call("Set", MqMsg{Key: "public|aof|deleted", Value: "x"}); e != nil {
+		t.Fatal(e)
+	}
+	if _, e := c.Delete("public|aof|deleted"); e != nil {
+		t.Fatal(e)
+	}
+	for _, value := range []string{"a", "b"} {
+		if _, e := c.Push("aof", value); e != nil {
+			t.Fatal(e)
+		}
+	}
+	if _, e := c.Pop("aof"); e != nil {
+		t.Fatal(e)
+	}
+
+	path := filepath.Join(dir, fmt.Sprintf("appendonly-%d.aof", cfg.Port))
+	before := countRecords(t, path)
+	if _, e := c.Call("BgRewriteAOF", ""); e != nil {
+		t.Fatal(e)
+	}
+	for deadline := time.Now().Add(5 * time.Second); countRecords(t, path) >= before; {
+		if time.Now().After(deadline) {
+			t.Fatalf("Append only file still has %d record(s) after the rewrite", before)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if _, e := c.Call("Set", MqMsg{Key: "public|aof|after", Value: "4"}); e != nil {
+		t.Fatal(e)
+	}
+
+	r := NewRPC(&ServerConfig{Name: cfg.Name, Port: cfg.Port, Memory: cfg.Memory})
+	aof, e := openAppendLog(dir, cfg.Port, FsyncAlways)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if e = aof.replay(r); e != nil {
+		t.Fatal(e)
+	}
+	defer aof.file.Close()
+
+	for key, want := range map[string]interface{}{"public|aof|kept": "3", "public|aof|after": "4"} {
+		if item, found := r.items.Get(key); !found || item.Value != want {
+			t.Errorf("Replayed %s = %v, %v, want %v", key, item.Value, found, want)
+		}
+		if _, exist := r.dataMap[key]; !exist {
+			t.Errorf("Replayed %s is not mapped to a node", key)
+		}
+	}
+	if _, found := r.items.Get("public|aof|deleted"); found {
+		t.Errorf("Deleted key is back after the replay")
+	}
+	q := r.queues["aof"]
+	if q == nil || len(q.Items) != 1 || q.Items[0].Msg.Value != "b" {
+		t.Errorf("Replayed queue is %+v, want the message b only", q)
+	}
+}
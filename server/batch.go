@@ -0,0 +1,266 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+
+	. "github.com/eaciit/mq/helper"
+	. "github.com/eaciit/mq/msg"
+)
+
+// ItemOp stores Items on a node together with the deduplication entries of
+// the writes. An entry without a Result takes the item stored for its scope.
+type ItemOp struct {
+	Items []MqMsg
+	Dedup []DedupEntry
+}
+
+// SetItems stores every item of op on this node, like SetItem, then its
+// deduplication entries, and returns the items with their versions.
+func (r *MqRPC) SetItems(op ItemOp, result *[]MqMsg) error {
+	stored := make([]MqMsg, len(op.Items))
+	for i, item := range op.Items {
+		r.SetItem(item, &stored[i])
+	}
+	r.putDedup(fillDedup(op.Dedup, stored))
+	*result = stored
+	return nil
+}
+
+// fillDedup sets the Result of every entry of dedup still without one to the
+// item stored for its scope.
+func fillDedup(dedup []DedupEntry, stored []MqMsg) []DedupEntry {
+	filled := make([]DedupEntry, 0, len(dedup))
+	for _, entry := range dedup {
+		for _, item := range stored {
+			if entry.Result.Key == "" && item.Key == entry.Scope {
+				entry.Result = item
+			}
+		}
+		filled = append(filled, entry)
+	}
+	return filled
+}
+
+// GetItems returns the items of keys held by this node.
+func (r *MqRPC) GetItems(keys []string, result *[]KeyResult) error {
+	items := make([]KeyResult, len(keys))
+	for i, key := range keys {
+		items[i].Key = key
+		items[i].Msg, items[i].Found = r.items.GetLive(key)
+		if !items[i].Found {
+			items[i].Msg = MqMsg{}
+		}
+	}
+	*result = items
+	return nil
+}
+
+// DeleteItems removes keys from the items held by this node.
+func (r *MqRPC) DeleteItems(keys []string, result *[]bool) error {
+	deleted := make([]bool, len(keys))
+	for i, key := range keys {
+		item := MqMsg{}
+		r.DeleteItem(key, &item)
+		deleted[i] = item.Value.(bool)
+	}
+	*result = deleted
+	return nil
+}
+
+func encodeResults(results []KeyResult, result *MqMsg) error {
+	buf, e := Encode(results)
+	if e != nil {
+		return e
+	}
+	result.Value = buf.Bytes()
+	return nil
+}
+
+// MSet stores every value with one call per node and per mirror. The result
+// holds a KeyResult for each value, in the same order, with an Error for the
+// keys not written to their node, or ErrMirrorDegraded for the keys written
+// to their node but not to every mirror. A value repeating the DedupKey of an
+// earlier write of its key within the dedup window is not written again, its
+// result is the one of that write.
+func (r *MqRPC) MSet(values []MqMsg, result *MqMsg) error {
+	keys := make([]string, len(values))
+	for i, value := range values {
+		keys[i] = value.Key
+	}
+	unlock := r.lockKeys(keys)
+	defer unlock()
+
+	results := make([]KeyResult, len(values))
+	msgs := make([]MqMsg, len(values))
+	sizes := make([]int64, len(values))
+	dedup := make([][]DedupEntry, len(values))
+	byNode := make(map[int][]int)
+	pending := make(map[int]nodeLoad)
+	from := make([]int, len(values))
+	var old MqMsg
+	for i, value := range values {
+		from[i] = -1
+		results[i].Key = value.Key
+		if stored, found := r.findDedup(value.Key, value.DedupKey); found {
+			results[i].Found = true
+			results[i].Msg = stored
+			continue
+		}
+		msg, size := r.newItem(value)
+		idx, e := r.pickNode(value.Key, size, pending)
+		if e == nil {
+			from[i], old, e = r.relocation(value.Key, idx)
+		}
+		if e != nil {
+			results[i].Error = e.Error()
+			continue
+		}
+		if from[i] >= 0 {
+			moveItem(&msg, old)
+		}
+		msgs[i] = msg
+		sizes[i] = size
+		dedup[i] = r.newDedup(value.Key, value.DedupKey)
+		byNode[idx] = append(byNode[idx], i)
+	}
+
+	r.mu.RLock()
+	configs := make(map[int]*ServerConfig)
+	for idx := range byNode {
+		if idx < len(r.nodes) {
+			configs[idx] = r.nodes[idx].Config
+		}
+	}
+	mirrors := append([]Node{}, r.mirrors...)
+	r.mu.RUnlock()
+
+	count := 0
+	moved := make(map[int][]string)
+	for idx, positions := range byNode {
+		batch := ItemOp{Items: make([]MqMsg, len(positions))}
+		for j, i := range positions {
+			batch.Items[j] = msgs[i]
+			batch.Dedup = append(batch.Dedup, dedup[i]...)
+		}
+
+		stored := []MqMsg{}
+		e := errors.New("Selected node has been removed")
+		if cfg, exist := configs[idx]; exist {
+			e = r.callNode(cfg, "SetItems", batch, &stored)
+		}
+		if e == nil && len(stored) != len(batch.Items) {
+			e = errors.New("Node returned an incomplete batch")
+		}
+		if e != nil {
+			errorMsg := fmt.Sprintf("Unable to set data to node : %s", e.Error())
+			Logging(errorMsg, "ERROR")
+			for _, i := range positions {
+				results[i].Error = errorMsg
+			}
+			continue
+		}
+
+		// Like Set, keys held by their node are recorded even when a mirror
+		// missed them, their result then carries ErrMirrorDegraded
+		mirrorError := ""
+		replica := ItemOp{Items: stored, Dedup: fillDedup(batch.Dedup, stored)}
+		for _, mirror := range mirrors {
+			e = r.callNode(mirror.Config, "SetItems", replica, &[]MqMsg{})
+			if e != nil {
+				Logging(fmt.Sprintf("Unable to set data to mirror %s:%d : %s", mirror.Config.Name, mirror.Config.Port, e.Error()), "ERROR")
+				mirrorError = ErrMirrorDegraded.Error()
+			}
+		}
+
+		r.mu.Lock()
+		for j, i := range positions {
+			results[i].Found = true
+			results[i].Msg = stored[j]
+			results[i].Error = mirrorError
+			r.recordSet(stored[j], idx, sizes[i])
+		}
+		r.mu.Unlock()
+		for j, i := range positions {
+			r.logWrite(aofEntry{Op: "Set", Key: stored[j].Key, Msg: stored[j], Node: idx, Size: sizes[i]})
+			if from[i] >= 0 {
+				moved[from[i]] = append(moved[from[i]], values[i].Key)
+			}
+		}
+		r.noteDedup(batch.Dedup, idx)
+		count += len(positions)
+	}
+	for node, movedKeys := range moved {
+		r.dropMovedKeys(node, movedKeys)
+	}
+
+	r.mu.Lock()
+	r.indexTables(keys...)
+	r.mu.Unlock()
+	Logging(fmt.Sprintf("%d of %d key(s) have been set in one batch", count, len(values)), "INFO")
+	return encodeResults(results, result)
+}
+
+// MGet reads every key with one call per node. The result holds a KeyResult
+// for each key, in the same order; Found is false for missing keys.
+func (r *MqRPC) MGet(keys []string, result *MqMsg) error {
+	return encodeResults(r.getItems(keys), result)
+}
+
+func (r *MqRPC) getItems(keys []string) []KeyResult {
+	results := make([]KeyResult, len(keys))
+	byNode := make(map[int][]int)
+	configs := make(map[int]*ServerConfig)
+
+	r.mu.RLock()
+	for i, key := range keys {
+		results[i].Key = key
+		idx, exist := r.dataMap[key]
+		if !exist || idx < 0 || idx >= len(r.nodes) || r.isExpired(key) {
+			continue
+		}
+		byNode[idx] = append(byNode[idx], i)
+		configs[idx] = r.nodes[idx].Config
+	}
+	r.mu.RUnlock()
+
+	for idx, positions := range byNode {
+		nodeKeys := make([]string, len(positions))
+		for j, i := range positions {
+			nodeKeys[j] = keys[i]
+		}
+
+		items := []KeyResult{}
+		e := r.callNode(configs[idx], "GetItems", nodeKeys, &items)
+		if e == nil && len(items) != len(nodeKeys) {
+			e = errors.New("Node returned an incomplete batch")
+		}
+		if e != nil {
+			errorMsg := fmt.Sprintf("Unable to get data from node : %s", e.Error())
+			Logging(errorMsg, "ERROR")
+			for _, i := range positions {
+				results[i].Error = errorMsg
+			}
+			continue
+		}
+
+		for j, i := range positions {
+			results[i] = items[j]
+			if items[j].Found {
+				r.touchKey(keys[i])
+			}
+		}
+	}
+	return results
+}
+
+// MDelete removes every key from the cluster with one call per node and per
+// mirror. The result holds a KeyResult for each key telling whether it existed.
+func (r *MqRPC) MDelete(keys []string, result *MqMsg) error {
+	results := make([]KeyResult, len(keys))
+	for i, existed := range r.deleteKeys(keys) {
+		results[i].Key = keys[i]
+		results[i].Found = existed
+	}
+	return encodeResults(results, result)
+}
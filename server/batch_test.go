@@ -0,0 +1,77 @@
+package server
+
+import (
+	"fmt"
+	"testing"
+
+	. "github.com/eaciit/mq/msg"
+)
+
+// TestBatchAcrossNodes writes, reads and deletes keys spread over a master
+// and a slave node in one call each. Results come back in the order asked.
+func TestBatchAcrossNodes(t *testing.T) {
+	_, master := startServer(t)
+	defer master.Close()
+	_, slave := startServer(t)
+	defer slave.Close()
+
+	slaveConfig, e := slave.Call("GetConfig", "")
+	if e != nil {
+		t.Fatal(e)
+	}
+	if _, e = master.Call("AddNode", slaveConfig.Value.(ServerConfig)); e != nil {
+		t.Fatal(e)
+	}
+
+	items := []MqMsg{}
+	keys := []string{}
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("public|batch|k%d", i)
+		items = append(items, MqMsg{Key: key, Value: fmt.Sprintf("v%d", i)})
+		keys = append(keys, key)
+	}
+	stored, e := master.MSet(items...)
+	if e != nil {
+		t.Fatal(e)
+	}
+	for i, result := range stored {
+		if result.Key != keys[i] || !result.Found || result.Err() != nil {
+			t.Errorf("MSet result %d = %+v", i, result)
+		}
+	}
+
+	read, e := master.MGet(append(keys, "public|batch|missing")...)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if len(read) != len(keys)+1 {
+		t.Fatalf("MGet returned %d results for %d keys", len(read), len(keys)+1)
+	}
+	for i, key := range keys {
+		if read[i].Key != key || !read[i].Found || read[i].Msg.Value != items[i].Value {
+			t.Errorf("MGet %s = %+v, want %v", key, read[i], items[i].Value)
+		}
+	}
+	if read[len(keys)].Found {
+		t.Errorf("MGet of a missing key is found")
+	}
+
+	deleted, e := master.MDelete(keys[:5]...)
+	if e != nil {
+		t.Fatal(e)
+	}
+	for i, result := range deleted {
+		if !result.Found {
+			t.Errorf("MDelete %s did not find it", keys[i])
+		}
+	}
+	read, e = master.MGet(keys...)
+	if e != nil {
+		t.Fatal(e)
+	}
+	for i, result := range read {
+		if result.Found != (i >= 5) {
+			t.Errorf("MGet %s found %v after deleting the first 5 keys", keys[i], result.Found)
+		}
+	}
+}
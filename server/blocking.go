@@ -0,0 +1,228 @@
+package server
+
+import (
+	"sync"
+	"time"
+
+	. "github.com/eaciit/mq/msg"
+)
+
+const (
+	waiterWaiting int = iota
+	waiterClaimed
+	waiterDone
+)
+
+// popWaiter is a consumer parked in BlockingPop by the connection of session.
+// A pusher claims it, pops the message on its behalf and hands it over through
+// ready. A waiter whose connection closed is gone and takes nothing more.
+type popWaiter struct {
+	queues   []string
+	session  int64
+	ready    chan *MqMsg
+	state    int
+	timedOut bool
+	gone     bool
+}
+
+// waiterList keeps the consumers waiting on each queue in arrival order.
+type waiterList struct {
+	sync.Mutex
+	queues map[string][]*popWaiter
+}
+
+func newWaiterList() *waiterList {
+	return &waiterList{queues: make(map[string][]*popWaiter)}
+}
+
+func (l *waiterList) add(w *popWaiter) {
+	l.Lock()
+	defer l.Unlock()
+	for _, name := range w.queues {
+		l.queues[name] = append(l.queues[name], w)
+	}
+}
+
+// remove drops w from every queue it waits on. The caller holds l.
+func (l *waiterList) remove(w *popWaiter) {
+	w.state = waiterDone
+	for _, name := range w.queues {
+		waiters := l.queues[name]
+		for i := range waiters {
+			if waiters[i] == w {
+				waiters = append(waiters[:i], waiters[i+1:]...)
+				break
+			}
+		}
+		if len(waiters) == 0 {
+			delete(l.queues, name)
+		} else {
+			l.queues[name] = waiters
+		}
+	}
+}
+
+// claim returns the longest waiting consumer of queue name, or nil. A claimed
+// consumer keeps its place until it is served or released.
+func (l *waiterList) claim(name string) *popWaiter {
+	l.Lock()
+	defer l.Unlock()
+	for _, w := range l.queues[name] {
+		if w.state == waiterWaiting {
+			w.state = waiterClaimed
+			return w
+		}
+	}
+	return nil
+}
+
+// serve hands msg to a claimed consumer. A nil msg means nothing could be
+// popped for it: it waits again, unless its time ran out meanwhile. It reports
+// false when the consumer is gone, msg then has to go back to its queue.
+func (l *waiterList) serve(w *popWaiter, msg *MqMsg) bool {
+	l.Lock()
+	if msg == nil && !w.timedOut && !w.gone {
+		w.state = waiterWaiting
+		l.Unlock()
+		return true
+	}
+	l.remove(w)
+	l.Unlock()
+	if w.gone {
+		w.ready <- nil
+		return false
+	}
+	w.ready <- msg
+	return true
+}
+
+// drop wakes every consumer waiting on queue name with nothing, as the queue
+// is deleted. The caller holds the queue lock, so none of them is claimed.
+func (l *waiterList) drop(name string) {
+	l.Lock()
+	defer l.Unlock()
+	for _, w := range append([]*popWaiter{}, l.queues[name]...) {
+		if w.state == waiterWaiting {
+			l.remove(w)
+			w.ready <- nil
+		}
+	}
+}
+
+// cancelSession wakes with nothing the consumers of session, as its
+// connection closed. The claimed ones are served nothing once the pusher
+// hands over.
+func (l *waiterList) cancelSession(session int64) {
+	l.Lock()
+	defer l.Unlock()
+	waiters := []*popWaiter{}
+	for _, queued := range l.queues {
+		for _, w := range queued {
+			if w.session == session {
+				waiters = append(waiters, w)
+			}
+		}
+	}
+	for _, w := range waiters {
+		switch w.state {
+		case waiterWaiting:
+			l.remove(w)
+			w.ready <- nil
+		case waiterClaimed:
+			w.gone = true
+		}
+	}
+}
+
+// cancel is called when the time of w runs out. It reports false when a pusher
+// has claimed w, which then has to wait for the hand over.
+func (l *waiterList) cancel(w *popWaiter) bool {
+	l.Lock()
+	defer l.Unlock()
+	if w.state == waiterWaiting {
+		l.remove(w)
+		return true
+	}
+	w.timedOut = true
+	return false
+}
+
+// serveWaiter hands the message just pushed on queue name to the consumer
+// waiting longest for it. A message its consumer is gone for goes back to its
+// place and on to the next consumer. The caller holds the queue lock.
+func (r *MqRPC) serveWaiter(name string) {
+	w := r.waiters.claim(name)
+	if w == nil {
+		return
+	}
+
+	item, e := r.popItem(name)
+	if e != nil {
+		r.waiters.serve(w, nil)
+		return
+	}
+	if !r.waiters.serve(w, &item.Msg) {
+		r.restore(name, item)
+	}
+}
+
+// BlockingPop pops the first message of the first non empty queue of
+// args.Queues. When they are all empty the caller waits until a message is
+// pushed on one of them or args.Timeout expires, then ErrTimeout is returned.
+// Waiting consumers are served in the order they arrived and stop waiting
+// when their connection closes. The Key of the result is the name of the
+// queue the message comes from.
+func (s *MqSession) BlockingPop(args BlockingPopArgs, result *MqMsg) error {
+	if e := consumable(args.Queues...); e != nil {
+		return e
+	}
+	return s.r.blockingPop(args, s.id, result)
+}
+
+// blockingPop waits for a message as BlockingPop does for the connection of
+// session.
+func (r *MqRPC) blockingPop(args BlockingPopArgs, session int64, result *MqMsg) error {
+	if len(args.Queues) == 0 {
+		return ErrQueueEmpty
+	}
+
+	// Holding the locks of every queue while registering means no push can
+	// slip in between the last check and the wait
+	unlock := r.lockQueues(args.Queues...)
+	for _, name := range args.Queues {
+		e := r.pop(name, result)
+		if e == nil {
+			unlock()
+			return nil
+		}
+		if e != ErrQueueEmpty {
+			unlock()
+			return e
+		}
+	}
+	w := &popWaiter{queues: args.Queues, session: session, ready: make(chan *MqMsg, 1)}
+	r.waiters.add(w)
+	unlock()
+
+	var timeout <-chan time.Time
+	if args.Timeout > 0 {
+		timer := time.NewTimer(args.Timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	var msg *MqMsg
+	select {
+	case msg = <-w.ready:
+	case <-timeout:
+		if r.waiters.cancel(w) {
+			return ErrTimeout
+		}
+		msg = <-w.ready
+	}
+	if msg == nil {
+		return ErrTimeout
+	}
+	*result = *msg
+	return nil
+}
@@ -0,0 +1,78 @@
+package server
+
+import (
+	"fmt"
+
+	. "github.com/eaciit/mq/msg"
+)
+
+// keyExists reports whether the master knows a live copy of key.
+func (r *MqRPC) keyExists(key string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	idx, exist := r.dataMap[key]
+	return exist && idx >= 0 && idx < len(r.nodes) && !r.isExpired(key)
+}
+
+// currentVersion asks the node owning key for its version. A missing key has
+// version zero. The caller holds the key lock.
+func (r *MqRPC) currentVersion(key string) (int64, error) {
+	if !r.keyExists(key) {
+		return 0, nil
+	}
+
+	r.mu.RLock()
+	nodeConfig := r.nodes[r.dataMap[key]].Config
+	r.mu.RUnlock()
+
+	item := MqMsg{}
+	e := r.callNode(nodeConfig, "GetItem", key, &item)
+	if e != nil {
+		errorMsg := fmt.Sprintf("Unable to get data from node : %s", e.Error())
+		Logging(errorMsg, "ERROR")
+		return 0, e
+	}
+	return item.Version, nil
+}
+
+// CompareAndSet stores value only when the current version of value.Key is
+// value.Version, zero meaning the key must not exist yet. Otherwise
+// ErrVersionConflict is returned and nothing is written.
+func (r *MqRPC) CompareAndSet(value MqMsg, result *MqMsg) error {
+	unlock := r.lockKey(value.Key)
+	defer unlock()
+
+	version, e := r.currentVersion(value.Key)
+	if e != nil {
+		return e
+	}
+	if version != value.Version {
+		Logging(fmt.Sprintf("Key : '%s' is at version %d, expected %d", value.Key, version, value.Version), "INFO")
+		return ErrVersionConflict
+	}
+	return r.set(value, nil, result)
+}
+
+// SetIfNotExists stores value only when value.Key does not exist, otherwise
+// ErrKeyExists is returned.
+func (r *MqRPC) SetIfNotExists(value MqMsg, result *MqMsg) error {
+	unlock := r.lockKey(value.Key)
+	defer unlock()
+
+	if r.keyExists(value.Key) {
+		return ErrKeyExists
+	}
+	return r.set(value, nil, result)
+}
+
+// SetIfExists stores value only when value.Key already exists, otherwise
+// ErrKeyNotFound is returned.
+func (r *MqRPC) SetIfExists(value MqMsg, result *MqMsg) error {
+	unlock := r.lockKey(value.Key)
+	defer unlock()
+
+	if !r.keyExists(value.Key) {
+		return ErrKeyNotFound
+	}
+	return r.set(value, nil, result)
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/eaciit/mq/client"
+	. "github.com/eaciit/mq/msg"
+)
+
+// TestCompareAndSet checks the version a write is made against, and the
+// conditional sets on a key that exists or not.
+func TestCompareAndSet(t *testing.T) {
+	_, c := startServer(t)
+	defer c.Close()
+
+	const key = "public|cas|key"
+	if _, e := c.CompareAndSet(key, 0, "a"); e != nil {
+		t.Fatalf("CompareAndSet of a new key: %v", e)
+	}
+	if _, e := c.CompareAndSet(key, 0, "b"); e != ErrVersionConflict {
+		t.Errorf("CompareAndSet of an existing key at version 0 = %v, want %v", e, ErrVersionConflict)
+	}
+	current, e := c.Call("Get", key)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if _, e := c.CompareAndSet(key, current.Version, "c"); e != nil {
+		t.Fatalf("CompareAndSet at the current version: %v", e)
+	}
+	if _, e := c.CompareAndSet(key, current.Version, "d"); e != ErrVersionConflict {
+		t.Errorf("CompareAndSet at a stale version = %v, want %v", e, ErrVersionConflict)
+	}
+	if got, e := c.Call("Get", key); e != nil || got.Value != "c" {
+		t.Errorf("Get %s = %v, %v, want c", key, got.Value, e)
+	}
+
+	if _, e := c.SetIfNotExists(MqMsg{Key: key, Value: "e"}); e != ErrKeyExists {
+		t.Errorf("SetIfNotExists of an existing key = %v, want %v", e, ErrKeyExists)
+	}
+	if _, e := c.SetIfExists(MqMsg{Key: "public|cas|missing", Value: "f"}); e != ErrKeyNotFound {
+		t.Errorf("SetIfExists of a missing key = %v, want %v", e, ErrKeyNotFound)
+	}
+}
+
+// TestCompareAndSetCounter increments a counter from many clients with
+// read, then compare and set. No increment may be lost.
+func TestCompareAndSetCounter(t *testing.T) {
+	cfg, c := startServer(t)
+	defer c.Close()
+
+	const key = "public|cas|counter"
+	const writers, increments = 8, 10
+	if _, e := c.CompareAndSet(key, 0, 0); e != nil {
+		t.Fatal(e)
+	}
+
+	addr := fmt.Sprintf("127.0.0.1:%d", cfg.Port)
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			wc, e := NewMqClient(addr, 10*time.Second)
+			if e != nil {
+				t.Error(e)
+				return
+			}
+			defer wc.Close()
+			for done := 0; done < increments; {
+				current, e := wc.Call("Get", key)
+				if e != nil {
+					t.Error(e)
+					return
+				}
+				_, e = wc.CompareAndSet(key, current.Version, current.Value.(int)+1)
+				if e == ErrVersionConflict {
+					continue
+				}
+				if e != nil {
+					t.Error(e)
+					return
+				}
+				done++
+			}
+		}()
+	}
+	wg.Wait()
+
+	got, e := c.Call("Get", key)
+	if e != nil || got.Value != writers*increments {
+		t.Errorf("Counter is %v, %v after %d increments", got.Value, e, writers*increments)
+	}
+}
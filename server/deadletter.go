@@ -0,0 +1,305 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	. "github.com/eaciit/mq/helper"
+	. "github.com/eaciit/mq/msg"
+)
+
+const (
+	deadLettersListed int = 100
+)
+
+// DeclareQueue sets the dead-letter queue, the max deliveries and the priority
+// mode of queue config.Name, creating it when needed. The priority mode of a
+// queue holding messages cannot be changed. A drop-head queue needs a
+// dead-letter queue for the messages it drops, and that one cannot drop
+// messages itself.
+func (r *MqRPC) DeclareQueue(config QueueConfig, result *MqMsg) error {
+	if config.Name == "" {
+		return errors.New("Queue name is empty")
+	}
+	if e := consumable(config.Name, config.DeadLetter); e != nil {
+		return e
+	}
+	if config.DeadLetter == config.Name {
+		return errors.New("Queue " + config.Name + " cannot be its own dead-letter queue")
+	}
+	if config.MaxDeliveries < 0 {
+		return errors.New("Max deliveries cannot be negative")
+	}
+	if config.MaxLen < 0 || config.MaxBytes < 0 {
+		return errors.New("Max length and max bytes cannot be negative")
+	}
+	if !IsOverflowPolicy(config.Overflow) {
+		return errors.New("Unknown overflow policy " + config.Overflow + ", expected reject-publish, drop-head or block")
+	}
+	if config.Overflow == "" {
+		config.Overflow = OverflowReject
+	}
+	if config.Overflow == OverflowDropHead && config.DeadLetter == "" {
+		return errors.New("A drop-head queue needs a dead-letter queue for the messages it drops")
+	}
+	if config.Partitions <= 0 {
+		config.Partitions = 1
+	}
+	if config.Partitions > streamMaxParts {
+		return fmt.Errorf("A queue cannot have more than %d partitions", streamMaxParts)
+	}
+
+	// Declaring a queue locks its dead-letter queue too, so two declarations
+	// cannot make a pair of drop-head queues dead-letter into each other
+	unlock := r.lockQueues(config.Name, config.DeadLetter)
+	defer unlock()
+
+	r.mu.RLock()
+	info := queueInfo{Node: -1}
+	if current, exist := r.queueMeta[config.Name]; exist {
+		info = *current
+	}
+	e := dropHeadDeadLetter(r.queueMeta, config)
+	r.mu.RUnlock()
+	if e != nil {
+		return e
+	}
+
+	if info.Priority != config.Priority && info.Len+info.Leased > 0 {
+		return errors.New("Queue " + config.Name + " holds messages, its priority mode cannot be changed")
+	}
+	if info.Partitions != config.Partitions && info.Partitions > 1 && info.Len+info.Leased > 0 {
+		return errors.New("Queue " + config.Name + " holds messages, its partitions cannot be changed")
+	}
+	info.DeadLetter = config.DeadLetter
+	info.MaxDeliveries = config.MaxDeliveries
+	info.Priority = config.Priority
+	info.MaxLen = config.MaxLen
+	info.MaxBytes = config.MaxBytes
+	info.Overflow = config.Overflow
+	info.BlockTimeout = config.BlockTimeout
+	info.Partitions = config.Partitions
+	r.updateQueueInfo(config.Name, info)
+
+	Logging(fmt.Sprintf("Queue '%s' declared, dead-letter queue '%s', max deliveries %d, priority %v, max length %d, max bytes %d, overflow %s, %d partition(s)", config.Name, config.DeadLetter, config.MaxDeliveries, config.Priority, config.MaxLen, config.MaxBytes, config.Overflow, config.Partitions), "INFO")
+	result.Key = config.Name
+	return nil
+}
+
+// dropHeadDeadLetter refuses config when its dead-letter queue drops messages,
+// or when it makes a dead-letter queue of another queue drop messages. The
+// caller holds r.mu.
+func dropHeadDeadLetter(queueMeta map[string]*queueInfo, config QueueConfig) error {
+	if dlq, exist := queueMeta[config.DeadLetter]; exist && dlq.Overflow == OverflowDropHead {
+		return errors.New("Queue " + config.DeadLetter + " drops messages, it cannot be a dead-letter queue")
+	}
+	if config.Overflow != OverflowDropHead {
+		return nil
+	}
+	for name, info := range queueMeta {
+		if info.DeadLetter == config.Name {
+			return errors.New("Queue " + config.Name + " is the dead-letter queue of " + name + ", it cannot drop messages")
+		}
+	}
+	return nil
+}
+
+// Queues returns the status of every queue, sorted by name.
+func (r *MqRPC) Queues(key string, result *MqMsg) error {
+	r.mu.RLock()
+	queues := []QueueStatus{}
+	for name, info := range r.queueMeta {
+		status := QueueStatus{Len: info.Len, Leased: info.Leased, Size: info.Size}
+		status.Name = name
+		status.DeadLetter = info.DeadLetter
+		status.MaxDeliveries = info.MaxDeliveries
+		status.Priority = info.Priority
+		status.MaxLen = info.MaxLen
+		status.MaxBytes = info.MaxBytes
+		status.Overflow = info.Overflow
+		status.BlockTimeout = info.BlockTimeout
+		status.Partitions = info.Partitions
+		queues = append(queues, status)
+	}
+	r.mu.RUnlock()
+	sort.Slice(queues, func(i, j int) bool { return queues[i].Name < queues[j].Name })
+
+	buf, e := Encode(queues)
+	if e != nil {
+		return e
+	}
+	result.Value = buf.Bytes()
+	return nil
+}
+
+// deadLetter pushes items taken from queue name to the dead-letter queue dlq
+// with reason, or drops them when there is no dead-letter queue. An item dlq
+// refuses is put back in queue name, to be delivered and dead-lettered again.
+// The caller holds the locks of name and dlq.
+func (r *MqRPC) deadLetter(name string, dlq string, items []QueueItem, reason string) {
+	for _, item := range items {
+		if dlq == "" {
+			Logging(fmt.Sprintf("Message %d of queue '%s' dropped, %s, no dead-letter queue", item.Seq, name, reason), "WARNING")
+			continue
+		}
+
+		e := r.toDeadLetter(name, dlq, item, reason)
+		if e == nil {
+			continue
+		}
+		if back := r.putBack(name, item); back != nil {
+			Logging(fmt.Sprintf("Message %d of queue '%s' lost, unable to move it to dead-letter queue '%s' : %s, nor to put it back : %s", item.Seq, name, dlq, e.Error(), back.Error()), "ERROR")
+			continue
+		}
+		Logging(fmt.Sprintf("Message %d kept in queue '%s', unable to move it to dead-letter queue '%s' : %s", item.Seq, name, dlq, e.Error()), "WARNING")
+	}
+}
+
+// toDeadLetter pushes a copy of item, a message of queue name, to dead-letter
+// queue dlq with reason. The caller holds the locks of name and dlq.
+func (r *MqRPC) toDeadLetter(name string, dlq string, item QueueItem, reason string) error {
+	msg := item.Msg
+	msg.Origin = name
+	msg.Reason = reason
+	msg.LastAccess = time.Now()
+	if e := r.push(dlq, msg); e != nil {
+		return e
+	}
+	Logging(fmt.Sprintf("Message %d of queue '%s' moved to dead-letter queue '%s', %s", item.Seq, name, dlq, reason), "INFO")
+	return nil
+}
+
+// peekAll returns the waiting messages of queue name, at most count of them
+// when count is positive.
+func (r *MqRPC) peekAll(name string, count int) ([]QueueItem, queueInfo, error) {
+	nodeConfig, info, e := r.queueNode(name, 0, false)
+	if e == ErrQueueEmpty {
+		return []QueueItem{}, info, nil
+	}
+	if e != nil {
+		return nil, info, e
+	}
+
+	peek := int(info.Len)
+	if count > 0 && count < peek {
+		peek = count
+	}
+	if peek <= 0 {
+		return []QueueItem{}, info, nil
+	}
+
+	peeked := QueueOpResult{}
+	e = r.callNode(nodeConfig, "QueueApply", QueueOp{Queue: name, Peek: peek}, &peeked)
+	if e != nil {
+		errorMsg := fmt.Sprintf("Unable to read queue from node : %s", e.Error())
+		Logging(errorMsg, "ERROR")
+		return nil, info, errors.New(errorMsg)
+	}
+	return peeked.Items, info, nil
+}
+
+// DeadLetters lists the first args.Count messages of the dead-letter queue
+// args.Queue, 100 by default.
+func (r *MqRPC) DeadLetters(args DeadLetterArgs, result *MqMsg) error {
+	count := args.Count
+	if count <= 0 {
+		count = deadLettersListed
+	}
+
+	items, _, e := r.peekAll(args.Queue, count)
+	if e != nil {
+		return e
+	}
+	letters := []DeadLetter{}
+	for _, item := range items {
+		letters = append(letters, DeadLetter{ID: item.Seq, Msg: item.Msg})
+	}
+
+	buf, e := Encode(letters)
+	if e != nil {
+		return e
+	}
+	result.Key = args.Queue
+	result.Value = buf.Bytes()
+	return nil
+}
+
+// RequeueDeadLetters moves the messages args.IDs of the dead-letter queue
+// args.Queue, or all of them, back to the queue they come from with their
+// delivery count reset. It returns how many were moved.
+func (r *MqRPC) RequeueDeadLetters(args DeadLetterArgs, result *MqMsg) error {
+	result.Key = args.Queue
+	result.Value = int64(0)
+
+	// The queues messages go back to are only known once read, read them
+	// first so every lock can be taken in order
+	items, _, e := r.peekAll(args.Queue, 0)
+	if e != nil {
+		return e
+	}
+	wanted := make(map[int64]bool)
+	for _, id := range args.IDs {
+		wanted[id] = true
+	}
+	origins := []string{}
+	seen := make(map[string]bool)
+	for _, item := range items {
+		if item.Msg.Origin != "" && !seen[item.Msg.Origin] {
+			seen[item.Msg.Origin] = true
+			origins = append(origins, item.Msg.Origin)
+		}
+	}
+
+	unlock := r.lockQueues(append(origins, args.Queue)...)
+	defer unlock()
+
+	items, info, e := r.peekAll(args.Queue, 0)
+	if e != nil {
+		return e
+	}
+	moved := []QueueItem{}
+	for _, item := range items {
+		if len(wanted) > 0 && !wanted[item.Seq] {
+			continue
+		}
+		if !seen[item.Msg.Origin] {
+			continue
+		}
+
+		msg := item.Msg
+		msg.Origin = ""
+		msg.Reason = ""
+		msg.Attempts = 0
+		if e = r.push(item.Msg.Origin, msg); e != nil {
+			break
+		}
+		moved = append(moved, item)
+	}
+
+	if len(moved) > 0 {
+		nodeConfig, _, err := r.queueNode(args.Queue, 0, false)
+		if err != nil {
+			return err
+		}
+		op := QueueOp{Queue: args.Queue}
+		for _, item := range moved {
+			op.Remove = append(op.Remove, item.Seq)
+		}
+		if _, err = r.applyQueueOp(nodeConfig, op, func(QueueOpResult) QueueOp { return op }); err != nil {
+			return err
+		}
+
+		info.Len -= int64(len(moved))
+		info.Size -= itemsSize(moved)
+		if info.Len < 0 {
+			info.Len = 0
+		}
+		r.updateQueueInfo(args.Queue, info)
+		Logging(fmt.Sprintf("%d message(s) of dead-letter queue '%s' requeued", len(moved), args.Queue), "INFO")
+	}
+
+	result.Value = int64(len(moved))
+	return e
+}
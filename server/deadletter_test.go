@@ -0,0 +1,72 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/eaciit/mq/msg"
+)
+
+// TestDeadLetterQueue dead-letters a message nacked too many times and a
+// rejected one, keeps a message in its queue while the dead-letter queue is
+// full, and requeues the dead letters.
+func TestDeadLetterQueue(t *testing.T) {
+	_, c := startServer(t)
+	defer c.Close()
+
+	if e := c.DeclareQueue(QueueConfig{Name: "jobs.dead", MaxLen: 2}); e != nil {
+		t.Fatal(e)
+	}
+	if e := c.DeclareQueue(QueueConfig{Name: "jobs", DeadLetter: "jobs.dead", MaxDeliveries: 2}); e != nil {
+		t.Fatal(e)
+	}
+	for _, value := range []string{"nacked", "rejected", "kept"} {
+		if _, e := c.Push("jobs", value); e != nil {
+			t.Fatal(e)
+		}
+	}
+	receive := func(want string) *Delivery {
+		d, e := c.Receive("jobs", time.Minute)
+		if e != nil || d.Msg.Value != want {
+			t.Fatalf("Receive = %+v, %v, want %s", d, e, want)
+		}
+		return d
+	}
+
+	for i := 0; i < 2; i++ {
+		if e := c.Nack("jobs", receive("nacked").LeaseID); e != nil {
+			t.Fatal(e)
+		}
+	}
+	if e := c.Reject("jobs", receive("rejected").LeaseID, "bad"); e != nil {
+		t.Fatal(e)
+	}
+	if e := c.Reject("jobs", receive("kept").LeaseID, "bad"); e != nil {
+		t.Fatal(e)
+	}
+
+	letters, e := c.DeadLetters("jobs.dead", 0)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if len(letters) != 2 {
+		t.Fatalf("Dead-letter queue holds %d messages, want 2", len(letters))
+	}
+	for i, want := range []string{"nacked", "rejected"} {
+		if msg := letters[i].Msg; msg.Value != want || msg.Origin != "jobs" || msg.Reason == "" {
+			t.Errorf("Dead letter %d = %v from '%s' for '%s', want %s from jobs with a reason", i, msg.Value, msg.Origin, msg.Reason, want)
+		}
+	}
+	if letters[1].Msg.Reason != "rejected: bad" {
+		t.Errorf("Rejected message has reason '%s'", letters[1].Msg.Reason)
+	}
+	receive("kept")
+
+	if n, e := c.RequeueDeadLetters("jobs.dead"); e != nil || n != 2 {
+		t.Fatalf("RequeueDeadLetters = %d, %v, want 2", n, e)
+	}
+	if n, e := c.Len("jobs.dead"); e != nil || n != 0 {
+		t.Errorf("Dead-letter queue has %d messages, %v after requeueing them", n, e)
+	}
+	receive("nacked")
+}
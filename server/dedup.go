@@ -0,0 +1,244 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	. "github.com/eaciit/mq/msg"
+)
+
+// DedupEntry is the result of a write made with a deduplication key. It is
+// stored with the data written, by the node holding it and by every mirror,
+// until Expires. Scope is the key written or the lock name of the queue
+// pushed to.
+type DedupEntry struct {
+	Scope   string
+	Key     string
+	Result  MqMsg
+	Expires time.Time
+}
+
+func (d DedupEntry) id() string {
+	return d.Scope + "\x00" + d.Key
+}
+
+// dedupRef tells the master which node holds a deduplication entry. Like the
+// dataMap entry of a key it outlives neither the entry nor the node, but it
+// stays when the data written is deleted or moves to another node.
+type dedupRef struct {
+	Node    int
+	Expires time.Time
+}
+
+// DedupOp is applied to the deduplication entries of a node. Parts are
+// applied in field order.
+type DedupOp struct {
+	Put  []DedupEntry
+	Find []DedupEntry // looks up the entries of the same scope and key
+}
+
+// DedupOpResult holds the entries found by a DedupOp.
+type DedupOpResult struct {
+	Entries []DedupEntry
+}
+
+// DedupApply applies op to the deduplication entries held by this node.
+func (r *MqRPC) DedupApply(op DedupOp, result *DedupOpResult) error {
+	r.putDedup(op.Put)
+	now := time.Now()
+	r.dmu.Lock()
+	defer r.dmu.Unlock()
+	for _, find := range op.Find {
+		if entry, exist := r.dedup[find.id()]; exist && now.Before(entry.Expires) {
+			result.Entries = append(result.Entries, entry)
+		}
+	}
+	return nil
+}
+
+// putDedup stores entries on this node, along with the data they belong to.
+func (r *MqRPC) putDedup(entries []DedupEntry) {
+	if len(entries) == 0 {
+		return
+	}
+	r.dmu.Lock()
+	for _, entry := range entries {
+		r.dedup[entry.id()] = entry
+	}
+	r.dmu.Unlock()
+	r.markDirty()
+	r.logWrite(aofEntry{Op: "Dedup", Dedup: entries})
+}
+
+// newDedup returns the entry to store with a write of scope made with
+// deduplication key key, none when there is no key or no dedup window. Its
+// Result is filled once the write is applied.
+func (r *MqRPC) newDedup(scope string, key string) []DedupEntry {
+	if key == "" || r.Config.DedupWindow <= 0 {
+		return nil
+	}
+	return []DedupEntry{DedupEntry{Scope: scope, Key: key, Expires: time.Now().Add(r.Config.DedupWindow)}}
+}
+
+// findDedup returns the result of the earlier write of key in scope, asking
+// the node holding its entry, or the first mirror when that node is down.
+// The caller holds the lock of scope.
+func (r *MqRPC) findDedup(scope string, key string) (MqMsg, bool) {
+	if key == "" || r.Config.DedupWindow <= 0 {
+		return MqMsg{}, false
+	}
+	find := DedupEntry{Scope: scope, Key: key}
+	r.mu.RLock()
+	ref, exist := r.dedupAt[find.id()]
+	var nodeConfig *ServerConfig
+	if exist && ref.Node >= 0 && ref.Node < len(r.nodes) {
+		nodeConfig = r.nodes[ref.Node].Config
+	} else if exist && len(r.mirrors) > 0 {
+		nodeConfig = r.mirrors[0].Config
+	}
+	r.mu.RUnlock()
+	if nodeConfig == nil || !time.Now().Before(ref.Expires) {
+		return MqMsg{}, false
+	}
+
+	found := DedupOpResult{}
+	e := r.callNode(nodeConfig, "DedupApply", DedupOp{Find: []DedupEntry{find}}, &found)
+	if e != nil {
+		Logging(fmt.Sprintf("Unable to look up deduplication key '%s' on node : %s", key, e.Error()), "ERROR")
+		return MqMsg{}, false
+	}
+	if len(found.Entries) == 0 {
+		return MqMsg{}, false
+	}
+	return found.Entries[0].Result, true
+}
+
+// noteDedup records that node idx, and every mirror, now hold entries.
+func (r *MqRPC) noteDedup(entries []DedupEntry, idx int) {
+	if len(entries) == 0 {
+		return
+	}
+	r.mu.Lock()
+	for _, entry := range entries {
+		r.dedupAt[entry.id()] = dedupRef{Node: idx, Expires: entry.Expires}
+	}
+	r.mu.Unlock()
+	r.markDirty()
+	for _, entry := range entries {
+		r.logWrite(aofEntry{Op: "DedupAt", Key: entry.id(), Node: idx, Time: entry.Expires})
+	}
+}
+
+// remapDedup moves the deduplication entries of node from onto node to, like
+// the dataMap entries of keys when a node dies. The caller holds r.mu.
+func (r *MqRPC) remapDedup(from int, to int) {
+	for id, ref := range r.dedupAt {
+		if ref.Node == from {
+			ref.Node = to
+			r.dedupAt[id] = ref
+		}
+	}
+}
+
+// dedupOn returns the ids of the deduplication entries held by node idx. The
+// caller holds r.mu.
+func (r *MqRPC) dedupOn(idx int) []string {
+	ids := []string{}
+	for id, ref := range r.dedupAt {
+		if ref.Node == idx {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// copyDedupFromMirror restores the deduplication entries ids, lost with the
+// data of a node, onto node idx from the first mirror, and points them at it.
+func (r *MqRPC) copyDedupFromMirror(idx int, ids []string) {
+	r.mu.RLock()
+	mirrors := append([]Node{}, r.mirrors...)
+	var nodeConfig *ServerConfig
+	if idx < len(r.nodes) {
+		nodeConfig = r.nodes[idx].Config
+	}
+	find := []DedupEntry{}
+	for _, id := range ids {
+		if ref, exist := r.dedupAt[id]; exist && time.Now().Before(ref.Expires) {
+			scope, key := splitDedupID(id)
+			find = append(find, DedupEntry{Scope: scope, Key: key})
+		}
+	}
+	r.mu.RUnlock()
+	if nodeConfig == nil || len(mirrors) == 0 || len(find) == 0 {
+		return
+	}
+
+	state := DedupOpResult{}
+	e := r.callNode(mirrors[0].Config, "DedupApply", DedupOp{Find: find}, &state)
+	if e != nil {
+		Logging("Unable to read deduplication keys from mirror : "+e.Error(), "ERROR")
+		return
+	}
+	if len(state.Entries) > 0 {
+		e = r.callNode(nodeConfig, "DedupApply", DedupOp{Put: state.Entries}, &DedupOpResult{})
+		if e != nil {
+			Logging("Unable to copy deduplication keys to node : "+e.Error(), "ERROR")
+			return
+		}
+	}
+	r.noteDedup(state.Entries, idx)
+}
+
+// splitDedupID returns the scope and the key of entry id.
+func splitDedupID(id string) (string, string) {
+	scope, key, _ := strings.Cut(id, "\x00")
+	return scope, key
+}
+
+// reapDedup drops the deduplication entries past their window, and the
+// master references to them.
+func (r *MqRPC) reapDedup() {
+	now := time.Now()
+	r.dmu.Lock()
+	for id, entry := range r.dedup {
+		if !now.Before(entry.Expires) {
+			delete(r.dedup, id)
+		}
+	}
+	r.dmu.Unlock()
+
+	r.mu.Lock()
+	for id, ref := range r.dedupAt {
+		if !now.Before(ref.Expires) {
+			delete(r.dedupAt, id)
+		}
+	}
+	r.mu.Unlock()
+}
+
+// copyDedup returns every deduplication entry held by this node. The caller
+// holds r.dmu.
+func (r *MqRPC) copyDedup() []DedupEntry {
+	now := time.Now()
+	entries := make([]DedupEntry, 0, len(r.dedup))
+	for _, entry := range r.dedup {
+		if now.Before(entry.Expires) {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// loadDedup stores entries, read from the append-only log or a snapshot,
+// dropping the ones past their window.
+func (r *MqRPC) loadDedup(entries []DedupEntry) {
+	now := time.Now()
+	r.dmu.Lock()
+	defer r.dmu.Unlock()
+	for _, entry := range entries {
+		if now.Before(entry.Expires) {
+			r.dedup[entry.id()] = entry
+		}
+	}
+}
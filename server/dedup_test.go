@@ -0,0 +1,54 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/eaciit/mq/msg"
+)
+
+// TestDedupWindow repeats writes and pushes with the same deduplication key.
+// Within the window the repeat returns the first result and is not applied,
+// once the window has passed it is applied again.
+func TestDedupWindow(t *testing.T) {
+	_, c := startConfigured(t, &ServerConfig{Memory: 64 << 20, DedupWindow: 500 * time.Millisecond})
+	defer c.Close()
+
+	const key = "public|dedup|key"
+	if _, e := c.Call("Set", MqMsg{Key: key, Value: "first", DedupKey: "w1"}); e != nil {
+		t.Fatal(e)
+	}
+	repeat, e := c.Call("Set", MqMsg{Key: key, Value: "second", DedupKey: "w1"})
+	if e != nil || repeat.Value != "first" {
+		t.Errorf("Repeated Set = %v, %v, want the result of the first", repeat.Value, e)
+	}
+	if _, e = c.Call("Set", MqMsg{Key: key, Value: "third", DedupKey: "w2"}); e != nil {
+		t.Fatal(e)
+	}
+	if got, e := c.Call("Get", key); e != nil || got.Value != "third" {
+		t.Errorf("Get %s = %v, %v, want third", key, got.Value, e)
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, e = c.PushMsg("dedup", MqMsg{Value: "job", DedupKey: "p1"}); e != nil {
+			t.Fatal(e)
+		}
+	}
+	if n, e := c.Len("dedup"); e != nil || n != 1 {
+		t.Errorf("Len = %d, %v after pushing the same message 3 times, want 1", n, e)
+	}
+
+	time.Sleep(600 * time.Millisecond)
+	if _, e = c.Call("Set", MqMsg{Key: key, Value: "fourth", DedupKey: "w1"}); e != nil {
+		t.Fatal(e)
+	}
+	if got, e := c.Call("Get", key); e != nil || got.Value != "fourth" {
+		t.Errorf("Get %s = %v, %v after the window, want fourth", key, got.Value, e)
+	}
+	if _, e = c.PushMsg("dedup", MqMsg{Value: "job", DedupKey: "p1"}); e != nil {
+		t.Fatal(e)
+	}
+	if n, e := c.Len("dedup"); e != nil || n != 2 {
+		t.Errorf("Len = %d, %v after pushing again past the window, want 2", n, e)
+	}
+}
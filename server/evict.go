@@ -0,0 +1,322 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	. "github.com/eaciit/mq/msg"
+)
+
+const (
+	NoEviction     string = "noeviction"
+	AllKeysLRU     string = "allkeys-lru"
+	AllKeysLFU     string = "allkeys-lfu"
+	VolatileTTL    string = "volatile-ttl"
+	evictionSample int    = 16
+)
+
+// nodeLoad is the data a batch has placed on a node but not stored yet.
+type nodeLoad struct {
+	Count int64
+	Size  int64
+}
+
+// keyAccess is the per key bookkeeping the master uses to pick eviction victims.
+type keyAccess struct {
+	Size       int64
+	LastAccess time.Time
+	Hits       int64
+}
+
+func isEvictionPolicy(policy string) bool {
+	switch policy {
+	case "", NoEviction, AllKeysLRU, AllKeysLFU, VolatileTTL:
+		return true
+	}
+	return false
+}
+
+func (r *MqRPC) evictionPolicy() string {
+	if r.Config.EvictionPolicy == "" {
+		return NoEviction
+	}
+	return r.Config.EvictionPolicy
+}
+
+func releaseNode(n *Node, size int64) {
+	if n.DataCount > 0 {
+		n.DataCount -= 1
+	}
+	n.DataSize -= size
+	if n.DataSize < 0 {
+		n.DataSize = 0
+	}
+}
+
+// trackSet updates the node counters and access statistics after key has been
+// stored with the given size on node idx. The caller holds r.mu.
+func (r *MqRPC) trackSet(key string, idx int, size int64) {
+	a, tracked := r.access[key]
+	if !tracked {
+		a = &keyAccess{}
+		r.access[key] = a
+	}
+
+	if oldIdx, exist := r.dataMap[key]; exist && tracked {
+		// Mirrors hold every key, only the node may change
+		if oldIdx == idx {
+			r.nodes[idx].DataSize += size - a.Size
+		} else {
+			if oldIdx >= 0 && oldIdx < len(r.nodes) {
+				releaseNode(&r.nodes[oldIdx], a.Size)
+			}
+			r.nodes[idx].DataCount += 1
+			r.nodes[idx].DataSize += size
+		}
+		for i := range r.mirrors {
+			r.mirrors[i].DataSize += size - a.Size
+		}
+	} else {
+		r.nodes[idx].DataCount += 1
+		r.nodes[idx].DataSize += size
+		for i := range r.mirrors {
+			r.mirrors[i].DataCount += 1
+			r.mirrors[i].DataSize += size
+		}
+	}
+
+	a.Size = size
+	a.LastAccess = time.Now()
+	a.Hits += 1
+}
+
+func (r *MqRPC) touchKey(key string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if a, tracked := r.access[key]; tracked {
+		a.LastAccess = time.Now()
+		a.Hits += 1
+	}
+}
+
+// pickNode returns the index of the node that should store key, the node
+// already holding it when it still fits there. When every node is full, keys
+// are evicted according to the eviction policy until one of them has room, or
+// ErrOutOfMemory is returned. Key itself is never evicted, it is moved by the
+// caller once stored on the new node, see relocation. pending, which may be
+// nil, holds what the current batch has already placed and is updated. The
+// caller holds the lock of key, and maybe of other keys, so a victim whose
+// lock is taken is passed over rather than waited for.
+func (r *MqRPC) pickNode(key string, size int64, pending map[int]nodeLoad) (int, error) {
+	r.mu.RLock()
+	cur, exist := r.dataMap[key]
+	if !exist || cur >= len(r.nodes) {
+		cur = -1
+	}
+	var oldSize int64
+	if a, tracked := r.access[key]; tracked && cur >= 0 {
+		oldSize = a.Size
+	}
+	r.mu.RUnlock()
+
+	busy := map[string]bool{key: true}
+	for {
+		r.mu.RLock()
+		idx := -1
+		if cur >= 0 && r.nodes[cur].DataSize+pending[cur].Size-oldSize+size < r.nodes[cur].AllocatedSize {
+			idx = cur
+		} else {
+			for i := range r.nodes {
+				if r.nodes[i].DataSize+pending[i].Size+size >= r.nodes[i].AllocatedSize {
+					continue
+				}
+				// Pick min node
+				if idx < 0 || r.nodes[i].DataCount+pending[i].Count < r.nodes[idx].DataCount+pending[idx].Count {
+					idx = i
+				}
+			}
+		}
+		if idx >= 0 {
+			r.mu.RUnlock()
+			if pending != nil && idx == cur {
+				pending[idx] = nodeLoad{pending[idx].Count, pending[idx].Size + size - oldSize}
+			} else if pending != nil {
+				pending[idx] = nodeLoad{pending[idx].Count + 1, pending[idx].Size + size}
+			}
+			return idx, nil
+		}
+
+		victim := r.evictionCandidate(busy)
+		r.mu.RUnlock()
+		if victim == "" {
+			return -1, ErrOutOfMemory
+		}
+		unlock, locked := r.tryLockKey(victim)
+		if !locked {
+			busy[victim] = true
+			continue
+		}
+		r.removeKey(victim)
+		unlock()
+		Logging(fmt.Sprintf("Key : '%s' has been evicted by %s policy", victim, r.evictionPolicy()), "INFO")
+	}
+}
+
+// relocation tells whether key, about to be stored on node idx, is held by
+// another node. It then returns that node and the item it holds, whose
+// version and creation time the new item carries on. Otherwise the node is
+// -1. The caller holds the key lock.
+func (r *MqRPC) relocation(key string, idx int) (int, MqMsg, error) {
+	r.mu.RLock()
+	from, exist := r.dataMap[key]
+	if !exist || from == idx || from < 0 || from >= len(r.nodes) || r.isExpired(key) {
+		r.mu.RUnlock()
+		return -1, MqMsg{}, nil
+	}
+	nodeConfig := r.nodes[from].Config
+	r.mu.RUnlock()
+
+	item := MqMsg{}
+	e := r.callNode(nodeConfig, "GetItem", key, &item)
+	if e != nil {
+		errorMsg := fmt.Sprintf("Unable to get data from node : %s", e.Error())
+		Logging(errorMsg, "ERROR")
+		return -1, item, errors.New(errorMsg)
+	}
+	return from, item, nil
+}
+
+// moveItem carries msg on from old, the item key had on the node it is
+// moving away from.
+func moveItem(msg *MqMsg, old MqMsg) {
+	msg.Version = old.Version + 1
+	msg.Created = old.Created
+	startExpiry(msg)
+}
+
+// dropMovedKeys deletes keys from node from once they are stored on another
+// node. Mirrors hold every key and already have the new copy.
+func (r *MqRPC) dropMovedKeys(from int, keys []string) {
+	r.mu.RLock()
+	var nodeConfig *ServerConfig
+	if from >= 0 && from < len(r.nodes) {
+		nodeConfig = r.nodes[from].Config
+	}
+	r.mu.RUnlock()
+	if nodeConfig == nil {
+		return
+	}
+
+	e := r.callNode(nodeConfig, "DeleteItems", keys, &[]bool{})
+	if e != nil {
+		Logging(fmt.Sprintf("Unable to delete moved data from node %s:%d : %s", nodeConfig.Name, nodeConfig.Port, e.Error()), "ERROR")
+	}
+}
+
+// evictionCandidate samples a few keys and returns the best one to evict
+// under the current policy, or an empty string if nothing may be evicted.
+// Keys in skip are left out. The caller holds r.mu.
+func (r *MqRPC) evictionCandidate(skip map[string]bool) string {
+	policy := r.evictionPolicy()
+	candidate := ""
+	sampled := 0
+
+	switch policy {
+	case AllKeysLRU, AllKeysLFU:
+		var best *keyAccess
+		for key, a := range r.access {
+			if skip[key] {
+				continue
+			}
+			if best == nil ||
+				(policy == AllKeysLRU && a.LastAccess.Before(best.LastAccess)) ||
+				(policy == AllKeysLFU && a.Hits < best.Hits) {
+				best = a
+				candidate = key
+			}
+			sampled++
+			if sampled >= evictionSample {
+				break
+			}
+		}
+	case VolatileTTL:
+		var best time.Time
+		for key, expireAt := range r.expires {
+			if skip[key] {
+				continue
+			}
+			if candidate == "" || expireAt.Before(best) {
+				best = expireAt
+				candidate = key
+			}
+			sampled++
+			if sampled >= evictionSample {
+				break
+			}
+		}
+	}
+
+	return candidate
+}
+
+// removeKey deletes key from the node owning it and from every mirror, then
+// drops its master metadata.
+func (r *MqRPC) removeKey(key string) bool {
+	return r.removeKeys([]string{key})[0]
+}
+
+// removeKeys deletes keys with one call per node and per mirror, then drops
+// their master metadata. It returns for every key whether the master knew it.
+func (r *MqRPC) removeKeys(keys []string) []bool {
+	known := make([]bool, len(keys))
+	byNode := make(map[int][]string)
+	configs := make(map[int]*ServerConfig)
+	all := []string{}
+
+	r.mu.RLock()
+	for i, key := range keys {
+		idx, exist := r.dataMap[key]
+		if !exist {
+			continue
+		}
+		known[i] = true
+		all = append(all, key)
+		if idx >= 0 && idx < len(r.nodes) {
+			byNode[idx] = append(byNode[idx], key)
+			configs[idx] = r.nodes[idx].Config
+		}
+	}
+	mirrors := append([]Node{}, r.mirrors...)
+	r.mu.RUnlock()
+
+	if len(all) == 0 {
+		return known
+	}
+
+	for idx, nodeKeys := range byNode {
+		e := r.callNode(configs[idx], "DeleteItems", nodeKeys, &[]bool{})
+		if e != nil {
+			errorMsg := fmt.Sprintf("Unable to delete data from node : %s", e.Error())
+			Logging(errorMsg, "ERROR")
+		}
+	}
+	for _, mirror := range mirrors {
+		e := r.callNode(mirror.Config, "DeleteItems", all, &[]bool{})
+		if e != nil {
+			errorMsg := fmt.Sprintf("Unable to delete data from mirror %s:%d : %s", mirror.Config.Name, mirror.Config.Port, e.Error())
+			Logging(errorMsg, "ERROR")
+		}
+	}
+
+	r.mu.Lock()
+	for _, key := range all {
+		r.forgetKey(key)
+	}
+	r.indexTables(all...)
+	r.mu.Unlock()
+	for _, key := range all {
+		r.logWrite(aofEntry{Op: "Forget", Key: key})
+	}
+	return known
+}
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/eaciit/mq/msg"
+)
+
+// evictionValue is a value about 300 bytes long once encoded.
+var evictionValue = strings.Repeat("v", 300)
+
+// TestEvictLeastRecentlyUsed fills a small master under allkeys-lru. The key
+// read last must survive and the ones left untouched must be evicted.
+func TestEvictLeastRecentlyUsed(t *testing.T) {
+	_, c := startConfigured(t, &ServerConfig{Memory: 1500, EvictionPolicy: AllKeysLRU})
+	defer c.Close()
+
+	set := func(key string) {
+		if _, e := c.Call("Set", MqMsg{Key: key, Value: evictionValue}); e != nil {
+			t.Fatalf("Set %s: %v", key, e)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for i := 0; i < 3; i++ {
+		set(fmt.Sprintf("public|lru|k%d", i))
+	}
+	if _, e := c.Call("Get", "public|lru|k0"); e != nil {
+		t.Fatal(e)
+	}
+	time.Sleep(10 * time.Millisecond)
+	for i := 3; i < 6; i++ {
+		set(fmt.Sprintf("public|lru|k%d", i))
+	}
+
+	if _, e := c.Call("Get", "public|lru|k0"); e != nil {
+		t.Errorf("Key read last has been evicted: %v", e)
+	}
+	if _, e := c.Call("Get", "public|lru|k1"); e == nil {
+		t.Errorf("Least recently used key has not been evicted")
+	}
+	if _, e := c.Call("Get", "public|lru|k5"); e != nil {
+		t.Errorf("Key stored last is missing: %v", e)
+	}
+}
+
+// TestNoEvictionKeepsOldValue fills a small master under noeviction. A write
+// that does not fit must fail with ErrOutOfMemory and leave the key as it was.
+func TestNoEvictionKeepsOldValue(t *testing.T) {
+	_, c := startConfigured(t, &ServerConfig{Memory: 1000, EvictionPolicy: NoEviction})
+	defer c.Close()
+
+	const key = "public|noevict|key"
+	if _, e := c.Call("Set", MqMsg{Key: key, Value: "old"}); e != nil {
+		t.Fatal(e)
+	}
+	var e error
+	for i := 0; e == nil && i < 10; i++ {
+		_, e = c.Call("Set", MqMsg{Key: fmt.Sprintf("public|noevict|k%d", i), Value: evictionValue})
+	}
+	if e != ErrOutOfMemory {
+		t.Fatalf("Set on a full master = %v, want %v", e, ErrOutOfMemory)
+	}
+
+	if _, e := c.Call("Set", MqMsg{Key: key, Value: evictionValue}); e != ErrOutOfMemory {
+		t.Fatalf("Overwrite on a full master = %v, want %v", e, ErrOutOfMemory)
+	}
+	got, e := c.Call("Get", key)
+	if e != nil || got.Value != "old" {
+		t.Errorf("Get %s = %v, %v after a failed overwrite, want old", key, got.Value, e)
+	}
+}
@@ -0,0 +1,296 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	. "github.com/eaciit/mq/helper"
+	. "github.com/eaciit/mq/msg"
+)
+
+// exchangeLockPrefix keeps the lock of an exchange apart from a key of the same name.
+const exchangeLockPrefix string = "\x00exchange|"
+
+// exchangeInfo is the master metadata of an exchange.
+type exchangeInfo struct {
+	Type     string
+	Bindings []Binding
+}
+
+func (x exchangeInfo) clone() exchangeInfo {
+	c := exchangeInfo{Type: x.Type, Bindings: make([]Binding, len(x.Bindings))}
+	for i, b := range x.Bindings {
+		b.Headers = CopyHeaders(b.Headers)
+		c.Bindings[i] = b
+	}
+	return c
+}
+
+// routes returns the queues a message published with routingKey and headers
+// goes to, each of them once.
+func (x *exchangeInfo) routes(routingKey string, headers map[string]string) []string {
+	queues := []string{}
+	seen := make(map[string]bool)
+	topic := strings.Split(routingKey, ".")
+	for _, b := range x.Bindings {
+		if seen[b.Queue] {
+			continue
+		}
+		matched := false
+		switch x.Type {
+		case ExchangeDirect:
+			matched = b.RoutingKey == routingKey
+		case ExchangeFanout:
+			matched = true
+		case ExchangeTopic:
+			pattern, e := parsePattern(b.RoutingKey)
+			matched = e == nil && topicMatches(pattern, topic)
+		case ExchangeHeaders:
+			matched = headersMatch(b, headers)
+		}
+		if matched {
+			seen[b.Queue] = true
+			queues = append(queues, b.Queue)
+		}
+	}
+	return queues
+}
+
+// headersMatch tells whether headers hold every header of b or, with
+// b.MatchAny, at least one of them, with the same value.
+func headersMatch(b Binding, headers map[string]string) bool {
+	if len(b.Headers) == 0 {
+		return true
+	}
+	for k, v := range b.Headers {
+		value, exist := headers[k]
+		found := exist && value == v
+		if found && b.MatchAny {
+			return true
+		}
+		if !found && !b.MatchAny {
+			return false
+		}
+	}
+	return !b.MatchAny
+}
+
+func sameBinding(a Binding, b Binding) bool {
+	if a.Queue != b.Queue || a.RoutingKey != b.RoutingKey || a.MatchAny != b.MatchAny || len(a.Headers) != len(b.Headers) {
+		return false
+	}
+	for k, v := range a.Headers {
+		if value, exist := b.Headers[k]; !exist || value != v {
+			return false
+		}
+	}
+	return true
+}
+
+// setExchangeInfo stores the metadata of an exchange. The caller holds r.mu.
+func (r *MqRPC) setExchangeInfo(name string, info exchangeInfo) {
+	stored := info.clone()
+	r.exchanges[name] = &stored
+}
+
+func (r *MqRPC) updateExchangeInfo(name string, info exchangeInfo) {
+	r.mu.Lock()
+	r.setExchangeInfo(name, info)
+	r.mu.Unlock()
+	r.markDirty()
+	r.logWrite(aofEntry{Op: "ExchangeInfo", Key: name, Exchange: info})
+}
+
+// exchangeInfoOf returns a copy of the metadata of exchange name.
+func (r *MqRPC) exchangeInfoOf(name string) (exchangeInfo, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	info, exist := r.exchanges[name]
+	if !exist {
+		return exchangeInfo{}, false
+	}
+	return info.clone(), true
+}
+
+func (r *MqRPC) lockExchange(name string) func() {
+	return r.lockKeys([]string{exchangeLockPrefix + name})
+}
+
+// DeclareExchange creates exchange config.Name, a direct exchange when
+// config.Type is empty. Declaring an existing exchange again with the same
+// type does nothing.
+func (r *MqRPC) DeclareExchange(config ExchangeConfig, result *MqMsg) error {
+	if config.Name == "" {
+		return errors.New("Exchange name is empty")
+	}
+	if config.Type == "" {
+		config.Type = ExchangeDirect
+	}
+	if !IsExchangeType(config.Type) {
+		return errors.New("Unknown exchange type " + config.Type + ", expected direct, fanout, topic or headers")
+	}
+
+	unlock := r.lockExchange(config.Name)
+	defer unlock()
+
+	info, exist := r.exchangeInfoOf(config.Name)
+	if exist {
+		if info.Type != config.Type {
+			return fmt.Errorf("Exchange %s already exists with type %s", config.Name, info.Type)
+		}
+		result.Key = config.Name
+		return nil
+	}
+	r.updateExchangeInfo(config.Name, exchangeInfo{Type: config.Type})
+
+	Logging(fmt.Sprintf("Exchange '%s' declared, type %s", config.Name, config.Type), "INFO")
+	result.Key = config.Name
+	return nil
+}
+
+// DeleteExchange removes exchange name and its bindings. The bound queues
+// and their messages are kept.
+func (r *MqRPC) DeleteExchange(name string, result *MqMsg) error {
+	unlock := r.lockExchange(name)
+	defer unlock()
+
+	r.mu.Lock()
+	_, exist := r.exchanges[name]
+	delete(r.exchanges, name)
+	r.mu.Unlock()
+	if !exist {
+		return ErrExchangeNotFound
+	}
+	r.markDirty()
+	r.logWrite(aofEntry{Op: "ExchangeDelete", Key: name})
+
+	Logging(fmt.Sprintf("Exchange '%s' has been deleted", name), "INFO")
+	result.Key = name
+	return nil
+}
+
+// Bind routes the messages of binding.Exchange matching binding into
+// binding.Queue. The queue is created by the first message routed to it.
+func (r *MqRPC) Bind(binding Binding, result *MqMsg) error {
+	if binding.Queue == "" {
+		return errors.New("Queue name is empty")
+	}
+
+	unlock := r.lockExchange(binding.Exchange)
+	defer unlock()
+
+	info, exist := r.exchangeInfoOf(binding.Exchange)
+	if !exist {
+		return ErrExchangeNotFound
+	}
+	if info.Type == ExchangeTopic {
+		if _, e := parsePattern(binding.RoutingKey); e != nil {
+			return e
+		}
+	}
+	for _, b := range info.Bindings {
+		if sameBinding(b, binding) {
+			result.Value = false
+			return nil
+		}
+	}
+	binding.Headers = CopyHeaders(binding.Headers)
+	info.Bindings = append(info.Bindings, binding)
+	r.updateExchangeInfo(binding.Exchange, info)
+
+	Logging(fmt.Sprintf("Queue '%s' bound to exchange '%s' with key '%s'", binding.Queue, binding.Exchange, binding.RoutingKey), "INFO")
+	result.Value = true
+	return nil
+}
+
+// Unbind removes a binding made by Bind with the same queue, routing key and
+// headers. The result tells whether there was one.
+func (r *MqRPC) Unbind(binding Binding, result *MqMsg) error {
+	unlock := r.lockExchange(binding.Exchange)
+	defer unlock()
+
+	info, exist := r.exchangeInfoOf(binding.Exchange)
+	if !exist {
+		return ErrExchangeNotFound
+	}
+	kept := []Binding{}
+	for _, b := range info.Bindings {
+		if !sameBinding(b, binding) {
+			kept = append(kept, b)
+		}
+	}
+	removed := len(kept) < len(info.Bindings)
+	if removed {
+		info.Bindings = kept
+		r.updateExchangeInfo(binding.Exchange, info)
+		Logging(fmt.Sprintf("Queue '%s' unbound from exchange '%s'", binding.Queue, binding.Exchange), "INFO")
+	}
+	result.Value = removed
+	return nil
+}
+
+// Exchanges returns every exchange with its bindings, sorted by name.
+func (r *MqRPC) Exchanges(key string, result *MqMsg) error {
+	r.mu.RLock()
+	exchanges := []ExchangeStatus{}
+	for name, info := range r.exchanges {
+		status := ExchangeStatus{Bindings: info.clone().Bindings}
+		status.Name = name
+		status.Type = info.Type
+		exchanges = append(exchanges, status)
+	}
+	r.mu.RUnlock()
+	sort.Slice(exchanges, func(i, j int) bool { return exchanges[i].Name < exchanges[j].Name })
+
+	buf, e := Encode(exchanges)
+	if e != nil {
+		return e
+	}
+	result.Value = buf.Bytes()
+	return nil
+}
+
+// Route pushes a copy of args.Msg into every queue bound to args.Exchange
+// that matches args.RoutingKey or the headers of the message, wherever the
+// queue lives. The result holds a KeyResult for each matching queue, Found
+// when the message went to it or with an Error when the push failed. A
+// message matching no binding is dropped. A full queue that blocks its
+// producers fails at once, routing does not wait. A deduplication key is
+// refused, push to each queue with it instead.
+func (r *MqRPC) Route(args RouteArgs, result *MqMsg) error {
+	if args.Msg.DedupKey != "" {
+		return errors.New("Route does not take a deduplication key, push to each queue with it instead")
+	}
+	r.mu.RLock()
+	info, exist := r.exchanges[args.Exchange]
+	queues := []string{}
+	if exist {
+		queues = info.routes(args.RoutingKey, args.Msg.Headers)
+	}
+	r.mu.RUnlock()
+	if !exist {
+		return ErrExchangeNotFound
+	}
+
+	unlock, dlqs := r.lockWithDeadLetters(queues)
+	defer unlock()
+
+	msg := MqMsg{Value: args.Msg.Value, Created: time.Now(), LastAccess: time.Now()}
+	msg.SetDefaults(&args.Msg)
+	msg.Priority = args.Msg.Priority
+
+	results := make([]KeyResult, len(queues))
+	for i, name := range queues {
+		results[i].Key = name
+		if e := r.pushOrDrop(name, msg, dlqs[name], nil); e != nil {
+			Logging(fmt.Sprintf("Message of exchange '%s' not routed to queue '%s' : %s", args.Exchange, name, e.Error()), "ERROR")
+			results[i].Error = e.Error()
+			continue
+		}
+		results[i].Found = true
+	}
+	return encodeResults(results, result)
+}
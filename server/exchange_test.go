@@ -0,0 +1,87 @@
+package server
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	. "github.com/eaciit/mq/msg"
+)
+
+// TestRouteTypes routes messages through an exchange of each type and checks
+// the queues they reach. A queue refusing the message fails alone.
+func TestRouteTypes(t *testing.T) {
+	_, c := startServer(t)
+	defer c.Close()
+
+	declare := func(name string, kind string, bindings ...Binding) {
+		if e := c.DeclareExchange(name, kind); e != nil {
+			t.Fatal(e)
+		}
+		for _, b := range bindings {
+			b.Exchange = name
+			if e := c.Bind(b); e != nil {
+				t.Fatal(e)
+			}
+		}
+	}
+	declare("d", ExchangeDirect, Binding{Queue: "d.red", RoutingKey: "red"}, Binding{Queue: "d.blue", RoutingKey: "blue"})
+	declare("f", ExchangeFanout, Binding{Queue: "f.1"}, Binding{Queue: "f.2"})
+	declare("t", ExchangeTopic, Binding{Queue: "t.orders", RoutingKey: "orders.#"}, Binding{Queue: "t.eu", RoutingKey: "*.eu"})
+	declare("h", ExchangeHeaders,
+		Binding{Queue: "h.all", Headers: map[string]string{"a": "1", "b": "2"}},
+		Binding{Queue: "h.any", Headers: map[string]string{"a": "1", "c": "3"}, MatchAny: true})
+
+	tests := []struct {
+		exchange string
+		key      string
+		headers  map[string]string
+		want     []string
+	}{
+		{"d", "red", nil, []string{"d.red"}},
+		{"d", "green", nil, []string{}},
+		{"f", "anything", nil, []string{"f.1", "f.2"}},
+		{"t", "orders.eu", nil, []string{"t.eu", "t.orders"}},
+		{"t", "orders.us.west", nil, []string{"t.orders"}},
+		{"t", "users.us", nil, []string{}},
+		{"h", "", map[string]string{"a": "1"}, []string{"h.any"}},
+		{"h", "", map[string]string{"a": "1", "b": "2"}, []string{"h.all", "h.any"}},
+	}
+	for _, test := range tests {
+		results, e := c.Route(test.exchange, test.key, MqMsg{Value: "m", Headers: test.headers})
+		if e != nil {
+			t.Errorf("Route %s %s: %v", test.exchange, test.key, e)
+			continue
+		}
+		got := []string{}
+		for _, result := range results {
+			if !result.Found || result.Err() != nil {
+				t.Errorf("Route %s %s to %s = %+v", test.exchange, test.key, result.Key, result)
+			}
+			got = append(got, result.Key)
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("Route %s %s %v reached %v, want %v", test.exchange, test.key, test.headers, got, test.want)
+		}
+	}
+	if got, e := c.Pop("d.red"); e != nil || got.Value != "m" {
+		t.Errorf("Pop d.red = %v, %v, want the routed message", got, e)
+	}
+	if _, e := c.Route("missing", "", MqMsg{Value: "m"}); e != ErrExchangeNotFound {
+		t.Errorf("Route to a missing exchange = %v, want %v", e, ErrExchangeNotFound)
+	}
+
+	if e := c.DeclareQueue(QueueConfig{Name: "f.1", MaxLen: 1}); e != nil {
+		t.Fatal(e)
+	}
+	results, e := c.Route("f", "", MqMsg{Value: "m"})
+	if e != nil {
+		t.Fatalf("Route with a full queue: %v", e)
+	}
+	for _, result := range results {
+		if full := result.Key == "f.1"; result.Found == full || (result.Err() == ErrQueueFull) != full {
+			t.Errorf("Route to %s with f.1 full = %+v", result.Key, result)
+		}
+	}
+}
@@ -0,0 +1,249 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	. "github.com/eaciit/mq/msg"
+)
+
+const (
+	reaperInterval time.Duration = time.Second
+)
+
+// runReaper removes expired keys every interval, both from the items held by
+// this process and from the master metadata (dataMap, tables and node counters),
+// gives messages whose lease ended back to their queue, drops idle
+// subscriptions and trims streams with a max age.
+func (r *MqRPC) runReaper(interval time.Duration) {
+	for !r.exiting() {
+		time.Sleep(interval)
+		r.reapExpired()
+		r.reapLeases()
+		r.reapSubscriptions()
+		r.trimAgedStreams()
+		r.reapDedup()
+	}
+}
+
+func (r *MqRPC) reapExpired() {
+	removed := r.items.DeleteIf(func(key string, item MqMsg) bool {
+		return item.IsExpired()
+	})
+	for i := 0; i < removed; i++ {
+		r.markDirty()
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	expired := []string{}
+	for key, expireAt := range r.expires {
+		if !now.Before(expireAt) {
+			r.forgetKey(key)
+			expired = append(expired, key)
+			Logging("Key : '"+key+"' has expired", "INFO")
+		}
+	}
+	r.indexTables(expired...)
+}
+
+func (r *MqRPC) setExpire(key string, expireAt time.Time) {
+	if expireAt.IsZero() {
+		delete(r.expires, key)
+	} else {
+		r.expires[key] = expireAt
+	}
+}
+
+// startExpiry makes msg expire msg.Duration seconds from now, none when it has
+// no duration. Expiry counts from msg.Created, so it must be set.
+func startExpiry(msg *MqMsg) {
+	msg.Expiry = 0
+	if msg.Duration > 0 {
+		msg.Expiry = time.Now().Add(time.Duration(msg.Duration) * time.Second).Sub(msg.Created)
+	}
+}
+
+func (r *MqRPC) isExpired(key string) bool {
+	expireAt, exist := r.expires[key]
+	return exist && !time.Now().Before(expireAt)
+}
+
+// forgetKey drops every piece of master metadata kept for key. The data itself
+// is removed by the nodes holding it. The caller holds r.mu and rebuilds the
+// table indexes with indexTables.
+func (r *MqRPC) forgetKey(key string) {
+	idx, exist := r.dataMap[key]
+	if !exist {
+		return
+	}
+
+	var size int64
+	if a, tracked := r.access[key]; tracked {
+		size = a.Size
+	}
+	if idx >= 0 && idx < len(r.nodes) {
+		releaseNode(&r.nodes[idx], size)
+	}
+	for i := range r.mirrors {
+		releaseNode(&r.mirrors[i], size)
+	}
+
+	delete(r.dataMap, key)
+	r.keys.remove(key)
+	delete(r.expires, key)
+	delete(r.access, key)
+	r.removeTableItem(key)
+	r.markDirty()
+}
+
+func (r *MqRPC) removeTableItem(key string) {
+	if len(strings.Split(key, "|")) < 2 {
+		return
+	}
+
+	tableName := GetTableByKey(key)
+	table, exist := r.tables[tableName]
+	if !exist {
+		return
+	}
+
+	delete(table.Items, key)
+	if len(table.Items) == 0 {
+		delete(r.tables, tableName)
+	}
+}
+
+// indexTables rebuilds the indexes of the tables holding keys, once per table.
+// The caller holds r.mu.
+func (r *MqRPC) indexTables(keys ...string) {
+	indexed := make(map[string]bool)
+	for _, key := range keys {
+		if !strings.Contains(key, "|") {
+			continue
+		}
+		tableName := GetTableByKey(key)
+		if indexed[tableName] {
+			continue
+		}
+		indexed[tableName] = true
+		if table, exist := r.tables[tableName]; exist {
+			setIndex(&table)
+		}
+	}
+}
+
+// updateExpire sends the new expiry of key to the node owning it and to every mirror.
+func (r *MqRPC) updateExpire(key string, expireAt time.Time) error {
+	unlock := r.lockKey(key)
+	defer unlock()
+
+	r.mu.RLock()
+	idx, exist := r.dataMap[key]
+	if !exist || idx < 0 || idx >= len(r.nodes) || r.isExpired(key) {
+		r.mu.RUnlock()
+		return errors.New("Data for key " + key + " is not exist")
+	}
+	nodeConfig := r.nodes[idx].Config
+	mirrors := append([]Node{}, r.mirrors...)
+	r.mu.RUnlock()
+
+	msg := MqMsg{Key: key, Created: time.Now()}
+	if !expireAt.IsZero() {
+		msg.Expiry = expireAt.Sub(msg.Created)
+	}
+
+	result := MqMsg{}
+	e := r.callNode(nodeConfig, "ExpireItem", msg, &result)
+	if e != nil {
+		errorMsg := fmt.Sprintf("Unable to set expiry to node : %s", e.Error())
+		return errors.New(errorMsg)
+	}
+
+	for _, mirror := range mirrors {
+		e = r.callNode(mirror.Config, "ExpireItem", msg, &result)
+		if e != nil {
+			errorMsg := fmt.Sprintf("Unable to set expiry to mirror %s:%d : %s", mirror.Config.Name, mirror.Config.Port, e.Error())
+			Logging(errorMsg, "ERROR")
+		}
+	}
+
+	r.mu.Lock()
+	r.setExpire(key, expireAt)
+	r.mu.Unlock()
+	r.markDirty()
+	r.logWrite(aofEntry{Op: "Expire", Key: key, Time: expireAt})
+	return nil
+}
+
+// Expire sets a time to live of value.Duration seconds on value.Key.
+func (r *MqRPC) Expire(value MqMsg, result *MqMsg) error {
+	if value.Duration <= 0 {
+		return errors.New("Duration for key " + value.Key + " must be greater than zero")
+	}
+
+	expireAt := time.Now().Add(time.Duration(value.Duration) * time.Second)
+	e := r.updateExpire(value.Key, expireAt)
+	if e != nil {
+		return e
+	}
+
+	result.Key = value.Key
+	result.Value = value.Duration
+	Logging(fmt.Sprintf("Key : '%s' will expire in %d second(s)", value.Key, value.Duration), "INFO")
+	return nil
+}
+
+// Persist removes the time to live of key.
+func (r *MqRPC) Persist(key string, result *MqMsg) error {
+	e := r.updateExpire(key, time.Time{})
+	if e != nil {
+		return e
+	}
+
+	result.Key = key
+	Logging("Key : '"+key+"' has been persisted", "INFO")
+	return nil
+}
+
+// TTL returns the remaining time to live of key in seconds, -1 when the key
+// has no expiry and -2 when the key does not exist.
+func (r *MqRPC) TTL(key string, result *MqMsg) error {
+	result.Key = key
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if _, exist := r.dataMap[key]; !exist || r.isExpired(key) {
+		result.Value = int64(-2)
+		return nil
+	}
+
+	expireAt, exist := r.expires[key]
+	if !exist {
+		result.Value = int64(-1)
+		return nil
+	}
+
+	result.Value = int64(time.Until(expireAt).Seconds())
+	return nil
+}
+
+// ExpireItem applies the expiry computed by the master to an item held by this node.
+func (r *MqRPC) ExpireItem(value MqMsg, result *MqMsg) error {
+	item, e := r.items.Update(value.Key, func(item MqMsg, exist bool) (MqMsg, bool, error) {
+		if !exist {
+			return item, false, errors.New("Data for key " + value.Key + " is not exist")
+		}
+		item.SetExpireAt(value.ExpireAt())
+		return item, true, nil
+	})
+	if e != nil {
+		return e
+	}
+	r.markDirty()
+	r.logWrite(aofEntry{Op: "ExpireItem", Key: value.Key, Time: item.ExpireAt()})
+	*result = item
+	return nil
+}
@@ -0,0 +1,315 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	. "github.com/eaciit/mq/helper"
+	. "github.com/eaciit/mq/msg"
+)
+
+// consumerTimeout is how long a consumer stays in its group without reading
+// or joining again.
+const consumerTimeout time.Duration = 30 * time.Second
+
+// consumerGroup spreads the partitions of a queue or a stream over the
+// consumers reading them as one group. targets is the consumer each partition
+// is given to, owners the one holding it: a partition only moves to its
+// target once its owner has nothing of it in flight, so at most one consumer
+// holds messages of a partition at a time. delivered is the last stream entry
+// read from each partition.
+type consumerGroup struct {
+	status    ConsumerGroupStatus
+	members   map[string]time.Time
+	targets   []string
+	owners    []string
+	delivered []int64
+}
+
+// groupList keeps the consumer groups of queues and streams. Membership only
+// lives in memory, consumers join again by reading after a restart.
+type groupList struct {
+	sync.Mutex
+	groups map[string]*consumerGroup
+}
+
+func newGroupList() *groupList {
+	return &groupList{groups: make(map[string]*consumerGroup)}
+}
+
+func groupID(args GroupArgs) string {
+	return args.Queue + "\x00" + args.Stream + "\x00" + args.Group
+}
+
+// rebalance drops the members whose time ran out and gives the partitions in
+// turn to the members left, in name order, when the members changed. The
+// caller holds l.
+func (g *consumerGroup) rebalance(now time.Time, partitions int, changed bool) {
+	for name, expires := range g.members {
+		if !now.Before(expires) {
+			delete(g.members, name)
+			changed = true
+		}
+	}
+	if len(g.targets) != partitions {
+		g.targets = make([]string, partitions)
+		g.owners = make([]string, partitions)
+		g.delivered = make([]int64, partitions)
+		changed = true
+	}
+	if !changed {
+		return
+	}
+
+	members := []string{}
+	for name := range g.members {
+		members = append(members, name)
+	}
+	sort.Strings(members)
+	for p := range g.targets {
+		g.targets[p] = ""
+		if len(members) > 0 {
+			g.targets[p] = members[p%len(members)]
+		}
+	}
+}
+
+// join adds args.Consumer to its group, or keeps it there for another
+// consumerTimeout, and returns the group. The caller holds l.
+func (l *groupList) join(args GroupArgs, partitions int) *consumerGroup {
+	id := groupID(args)
+	g, exist := l.groups[id]
+	if !exist {
+		g = &consumerGroup{members: make(map[string]time.Time)}
+		g.status = ConsumerGroupStatus{Queue: args.Queue, Stream: args.Stream, Group: args.Group}
+		l.groups[id] = g
+	}
+	now := time.Now()
+	_, member := g.members[args.Consumer]
+	g.members[args.Consumer] = now.Add(consumerTimeout)
+	g.rebalance(now, partitions, !member)
+	return g
+}
+
+// assign joins args.Consumer to its group and returns the partitions it holds
+// and the ones given to it still held by another consumer.
+func (l *groupList) assign(args GroupArgs, partitions int) ([]int, []int) {
+	l.Lock()
+	defer l.Unlock()
+	g := l.join(args, partitions)
+	ready := []int{}
+	pending := []int{}
+	for p, target := range g.targets {
+		if target != args.Consumer {
+			continue
+		}
+		if g.owners[p] == args.Consumer {
+			ready = append(ready, p)
+		} else {
+			pending = append(pending, p)
+		}
+	}
+	return ready, pending
+}
+
+// handover makes args.Consumer the owner of partitions still given to it.
+func (l *groupList) handover(args GroupArgs, partitions []int) {
+	l.Lock()
+	defer l.Unlock()
+	g, exist := l.groups[groupID(args)]
+	if !exist {
+		return
+	}
+	for _, p := range partitions {
+		if p < len(g.targets) && g.targets[p] == args.Consumer {
+			g.owners[p] = args.Consumer
+		}
+	}
+}
+
+// takeStream joins args.Consumer to its group of a stream, hands it the
+// partitions given to it whose owner is gone or committed every entry it
+// read, offsets being the committed ones, and returns the partitions it
+// holds.
+func (l *groupList) takeStream(args GroupArgs, offsets []int64) []int {
+	l.Lock()
+	defer l.Unlock()
+	g := l.join(args, len(offsets))
+	ready := []int{}
+	for p, target := range g.targets {
+		if target != args.Consumer {
+			continue
+		}
+		owner := g.owners[p]
+		if _, member := g.members[owner]; owner != args.Consumer && (!member || offsets[p] >= g.delivered[p]) {
+			g.owners[p] = args.Consumer
+			g.delivered[p] = offsets[p]
+		}
+		if g.owners[p] == args.Consumer {
+			ready = append(ready, p)
+		}
+	}
+	return ready
+}
+
+// deliver records entries as read by the group of args.
+func (l *groupList) deliver(args GroupArgs, entries []StreamEntry) {
+	l.Lock()
+	defer l.Unlock()
+	g, exist := l.groups[groupID(args)]
+	if !exist {
+		return
+	}
+	for _, entry := range entries {
+		if entry.Partition < len(g.delivered) && entry.ID > g.delivered[entry.Partition] {
+			g.delivered[entry.Partition] = entry.ID
+		}
+	}
+}
+
+// leave removes args.Consumer from its group, the partitions it holds move
+// on once settled. A group without members is forgotten.
+func (l *groupList) leave(args GroupArgs) bool {
+	l.Lock()
+	defer l.Unlock()
+	id := groupID(args)
+	g, exist := l.groups[id]
+	if !exist {
+		return false
+	}
+	if _, member := g.members[args.Consumer]; !member {
+		return false
+	}
+	delete(g.members, args.Consumer)
+	g.rebalance(time.Now(), len(g.targets), true)
+	if len(g.members) == 0 {
+		delete(l.groups, id)
+	}
+	return true
+}
+
+// statuses returns every group with members, sorted by queue, stream and name.
+func (l *groupList) statuses() []ConsumerGroupStatus {
+	l.Lock()
+	defer l.Unlock()
+	now := time.Now()
+	groups := []ConsumerGroupStatus{}
+	for id, g := range l.groups {
+		g.rebalance(now, len(g.targets), false)
+		if len(g.members) == 0 {
+			delete(l.groups, id)
+			continue
+		}
+		groups = append(groups, g.statusOf())
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		a, b := groups[i], groups[j]
+		if a.Queue != b.Queue {
+			return a.Queue < b.Queue
+		}
+		if a.Stream != b.Stream {
+			return a.Stream < b.Stream
+		}
+		return a.Group < b.Group
+	})
+	return groups
+}
+
+// statusOf describes g. The caller holds l.
+func (g *consumerGroup) statusOf() ConsumerGroupStatus {
+	status := g.status
+	for name := range g.members {
+		status.Members = append(status.Members, name)
+	}
+	sort.Strings(status.Members)
+	status.Targets = append([]string{}, g.targets...)
+	status.Owners = append([]string{}, g.owners...)
+	return status
+}
+
+// queuePartitions returns the number of partitions of queue name.
+func (r *MqRPC) queuePartitions(name string) int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if info, exist := r.queueMeta[name]; exist && info.Partitions > 1 {
+		return info.Partitions
+	}
+	return 1
+}
+
+// lockGroup checks args and takes the lock of its queue or stream.
+func (r *MqRPC) lockGroup(args GroupArgs) (func(), error) {
+	if args.Group == "" || args.Consumer == "" {
+		return nil, errors.New("Consumer group and consumer names are needed")
+	}
+	if (args.Queue == "") == (args.Stream == "") {
+		return nil, errors.New("A consumer group reads either a queue or a stream")
+	}
+	if args.Queue != "" {
+		return r.lockQueues(args.Queue), nil
+	}
+	return r.lockStream(args.Stream), nil
+}
+
+// JoinGroup adds args.Consumer to its group, or keeps it there, without
+// reading. It returns the encoded ConsumerGroupStatus of the group.
+// Consumers reading less often than every 30 seconds join again meanwhile,
+// otherwise they leave the group and their partitions move.
+func (r *MqRPC) JoinGroup(args GroupArgs, result *MqMsg) error {
+	unlock, e := r.lockGroup(args)
+	if e != nil {
+		return e
+	}
+	defer unlock()
+
+	partitions := 1
+	if args.Queue != "" {
+		partitions = r.queuePartitions(args.Queue)
+	} else {
+		info, exist := r.streamInfoOf(args.Stream)
+		if !exist {
+			return fmt.Errorf("Stream %s does not exist", args.Stream)
+		}
+		partitions = len(info.Partitions)
+	}
+
+	r.groups.Lock()
+	status := r.groups.join(args, partitions).statusOf()
+	r.groups.Unlock()
+
+	buf, e := Encode(status)
+	if e != nil {
+		return e
+	}
+	result.Key = args.Group
+	result.Value = buf.Bytes()
+	return nil
+}
+
+// LeaveGroup removes args.Consumer from its group at once, and tells whether
+// it was there. Its partitions move to the other consumers once the messages
+// it holds are settled.
+func (r *MqRPC) LeaveGroup(args GroupArgs, result *MqMsg) error {
+	unlock, e := r.lockGroup(args)
+	if e != nil {
+		return e
+	}
+	defer unlock()
+
+	result.Key = args.Group
+	result.Value = r.groups.leave(args)
+	return nil
+}
+
+// ConsumerGroups returns every consumer group with members.
+func (r *MqRPC) ConsumerGroups(key string, result *MqMsg) error {
+	buf, e := Encode(r.groups.statuses())
+	if e != nil {
+		return e
+	}
+	result.Value = buf.Bytes()
+	return nil
+}
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	. "github.com/eaciit/mq/msg"
+)
+
+// TestPartitionHandover gives a partition to a second consumer of a group
+// while the first one still holds a message of it. The second consumer only
+// gets the partition once that message is acked.
+func TestPartitionHandover(t *testing.T) {
+	_, c := startServer(t)
+	defer c.Close()
+
+	const queue = "parts"
+	if e := c.DeclareQueue(QueueConfig{Name: queue, Partitions: 2}); e != nil {
+		t.Fatal(e)
+	}
+	for i := 0; i < 8; i++ {
+		if _, e := c.PushMsg(queue, MqMsg{Value: i, PartitionKey: fmt.Sprintf("k%d", i)}); e != nil {
+			t.Fatal(e)
+		}
+	}
+
+	first := GroupArgs{Queue: queue, Group: "g", Consumer: "c1"}
+	if status, e := c.JoinGroup(first); e != nil || status.Targets[0] != "c1" || status.Targets[1] != "c1" {
+		t.Fatalf("JoinGroup of the only consumer = %+v, %v, want every partition", status, e)
+	}
+	held := make(map[int][]*Delivery)
+	for i := 0; i < 8 && (len(held[0]) == 0 || len(held[1]) == 0); i++ {
+		d, e := c.ReceiveGroup(queue, "g", "c1", time.Minute)
+		if e != nil {
+			t.Fatal(e)
+		}
+		held[d.Partition] = append(held[d.Partition], d)
+	}
+	if len(held[0]) == 0 || len(held[1]) == 0 {
+		t.Fatalf("First consumer holds messages of partitions %v, want both", held)
+	}
+
+	status, e := c.JoinGroup(GroupArgs{Queue: queue, Group: "g", Consumer: "c2"})
+	if e != nil {
+		t.Fatal(e)
+	}
+	moved := -1
+	for p, target := range status.Targets {
+		if target == "c2" {
+			moved = p
+		}
+	}
+	if moved < 0 {
+		t.Fatalf("No partition given to the second consumer: %+v", status)
+	}
+	if d, e := c.ReceiveGroup(queue, "g", "c2", time.Minute); e != ErrQueueEmpty {
+		t.Fatalf("Second consumer received %+v, %v while the first still holds its partition", d, e)
+	}
+
+	for _, d := range held[moved] {
+		if e = c.Ack(queue, d.LeaseID); e != nil {
+			t.Fatal(e)
+		}
+	}
+	d, e := c.ReceiveGroup(queue, "g", "c2", time.Minute)
+	if e != nil || d.Partition != moved {
+		t.Fatalf("Second consumer received %+v, %v once the partition was settled, want partition %d", d, e, moved)
+	}
+	status, e = c.JoinGroup(GroupArgs{Queue: queue, Group: "g", Consumer: "c2"})
+	if e != nil || status.Owners[moved] != "c2" {
+		t.Errorf("Owners = %v, %v after the handover, want c2 for partition %d", status.Owners, e, moved)
+	}
+}
@@ -0,0 +1,215 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	. "github.com/eaciit/mq/helper"
+	. "github.com/eaciit/mq/msg"
+)
+
+// intValue reads a stored value as an integer. Values set from the CLI are
+// strings, values set through the API may already be numbers.
+func intValue(value interface{}) (int64, error) {
+	switch v := value.(type) {
+	case string:
+		n, e := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+		if e != nil {
+			return 0, ErrNotInteger
+		}
+		return n, nil
+	case int:
+		return int64(v), nil
+	case int32:
+		return int64(v), nil
+	case int64:
+		return v, nil
+	}
+	return 0, ErrNotInteger
+}
+
+func floatValue(value interface{}) (float64, error) {
+	switch v := value.(type) {
+	case string:
+		n, e := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if e != nil || math.IsNaN(n) || math.IsInf(n, 0) {
+			return 0, ErrNotFloat
+		}
+		return n, nil
+	case float32:
+		return float64(v), nil
+	case float64:
+		return v, nil
+	case int, int32, int64:
+		n, _ := intValue(v)
+		return float64(n), nil
+	}
+	return 0, ErrNotFloat
+}
+
+// applyIncr adds delta, an int64 or a float64, to item and returns the updated
+// item. A missing item starts at zero. The result is stored as a string like
+// every other value written by the CLI.
+func applyIncr(item MqMsg, exist bool, key string, delta interface{}) (MqMsg, error) {
+	if !exist || item.IsExpired() {
+		item = MqMsg{Key: key, Created: time.Now(), Value: "0"}
+		item.SetDefaults(&item)
+	}
+
+	switch d := delta.(type) {
+	case int64:
+		n, e := intValue(item.Value)
+		if e != nil {
+			return item, e
+		}
+		if (d > 0 && n > math.MaxInt64-d) || (d < 0 && n < math.MinInt64-d) {
+			return item, ErrIncrOverflow
+		}
+		item.Value = strconv.FormatInt(n+d, 10)
+	case float64:
+		n, e := floatValue(item.Value)
+		if e != nil {
+			return item, e
+		}
+		n += d
+		if math.IsNaN(n) || math.IsInf(n, 0) {
+			return item, ErrNotFloat
+		}
+		item.Value = strconv.FormatFloat(n, 'f', -1, 64)
+	default:
+		return item, fmt.Errorf("Increment for key %s must be an int64 or a float64", key)
+	}
+
+	item.LastAccess = time.Now()
+	item.Version += 1
+	return item, nil
+}
+
+// IncrItem applies an increment to an item held by this node under the shard
+// lock, so concurrent increments of the same key are never lost.
+func (r *MqRPC) IncrItem(value MqMsg, result *MqMsg) error {
+	item, e := r.items.Update(value.Key, func(item MqMsg, exist bool) (MqMsg, bool, error) {
+		item, e := applyIncr(item, exist, value.Key, value.Value)
+		return item, e == nil, e
+	})
+	if e != nil {
+		return e
+	}
+
+	r.markDirty()
+	r.logWrite(aofEntry{Op: "SetItem", Key: value.Key, Msg: item})
+	*result = item
+	return nil
+}
+
+// incr runs an increment on the node owning key, placing the key first when it
+// does not exist yet, then copies the new item to every mirror.
+func (r *MqRPC) incr(key string, delta interface{}) (MqMsg, error) {
+	unlock := r.lockKey(key)
+	defer unlock()
+
+	r.mu.Lock()
+	if r.isExpired(key) {
+		r.forgetKey(key)
+	}
+	idx, exist := r.dataMap[key]
+	r.mu.Unlock()
+
+	if !exist || idx < 0 {
+		buf, _ := Encode(fmt.Sprint(delta))
+		var e error
+		idx, e = r.pickNode(key, int64(buf.Len()), nil)
+		if e != nil {
+			Logging("Key : '"+key+"' cannot be created, because of memory Allocation all node reach max limit", "INFO")
+			return MqMsg{}, e
+		}
+	}
+
+	r.mu.RLock()
+	if idx >= len(r.nodes) {
+		r.mu.RUnlock()
+		return MqMsg{}, errors.New("Data for key " + key + " is not exist")
+	}
+	nodeConfig := r.nodes[idx].Config
+	mirrors := append([]Node{}, r.mirrors...)
+	r.mu.RUnlock()
+
+	item := MqMsg{}
+	e := r.callNode(nodeConfig, "IncrItem", MqMsg{Key: key, Value: delta}, &item)
+	if e != nil {
+		return item, e
+	}
+
+	for _, mirror := range mirrors {
+		e = r.callNode(mirror.Config, "SetItem", item, &MqMsg{})
+		if e != nil {
+			errorMsg := fmt.Sprintf("Unable to set data to mirror %s:%d : %s", mirror.Config.Name, mirror.Config.Port, e.Error())
+			Logging(errorMsg, "ERROR")
+		}
+	}
+
+	buf, _ := Encode(item.Value)
+	size := int64(buf.Len())
+	r.mu.Lock()
+	r.recordSet(item, idx, size)
+	r.indexTables(key)
+	r.mu.Unlock()
+	r.logWrite(aofEntry{Op: "Set", Key: key, Msg: item, Node: idx, Size: size})
+	Logging(fmt.Sprintf("Key : '%s' has been increased to %v", key, item.Value), "INFO")
+	return item, nil
+}
+
+// IncrBy adds value.Value to the integer stored at value.Key and returns the new value.
+func (r *MqRPC) IncrBy(value MqMsg, result *MqMsg) error {
+	delta, e := intValue(value.Value)
+	if e != nil {
+		return e
+	}
+
+	item, e := r.incr(value.Key, delta)
+	if e != nil {
+		return e
+	}
+	result.Key = value.Key
+	result.Value, _ = intValue(item.Value)
+	return nil
+}
+
+// DecrBy subtracts value.Value from the integer stored at value.Key and returns the new value.
+func (r *MqRPC) DecrBy(value MqMsg, result *MqMsg) error {
+	delta, e := intValue(value.Value)
+	if e != nil {
+		return e
+	}
+	if delta == math.MinInt64 {
+		return ErrIncrOverflow
+	}
+
+	item, e := r.incr(value.Key, -delta)
+	if e != nil {
+		return e
+	}
+	result.Key = value.Key
+	result.Value, _ = intValue(item.Value)
+	return nil
+}
+
+// IncrByFloat adds value.Value to the number stored at value.Key and returns the new value.
+func (r *MqRPC) IncrByFloat(value MqMsg, result *MqMsg) error {
+	delta, e := floatValue(value.Value)
+	if e != nil {
+		return e
+	}
+
+	item, e := r.incr(value.Key, delta)
+	if e != nil {
+		return e
+	}
+	result.Key = value.Key
+	result.Value, _ = floatValue(item.Value)
+	return nil
+}
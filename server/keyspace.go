@@ -0,0 +1,170 @@
+package server
+
+import (
+	"hash/fnv"
+	"sync"
+
+	. "github.com/eaciit/mq/msg"
+)
+
+const (
+	keyspaceShards int = 64
+)
+
+type keyspaceShard struct {
+	sync.RWMutex
+	items map[string]MqMsg
+}
+
+// keyspace holds the items of a node. Keys are spread over shards that each
+// have their own lock, so clients working on different keys do not wait on
+// each other.
+type keyspace struct {
+	shards []*keyspaceShard
+}
+
+func newKeyspace() *keyspace {
+	k := new(keyspace)
+	k.shards = make([]*keyspaceShard, keyspaceShards)
+	for i := range k.shards {
+		k.shards[i] = &keyspaceShard{items: make(map[string]MqMsg)}
+	}
+	return k
+}
+
+func shardIndex(key string, shards int) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(shards))
+}
+
+func (k *keyspace) shard(key string) *keyspaceShard {
+	return k.shards[shardIndex(key, len(k.shards))]
+}
+
+func (k *keyspace) Get(key string) (MqMsg, bool) {
+	s := k.shard(key)
+	s.RLock()
+	defer s.RUnlock()
+	v, exist := s.items[key]
+	return v, exist
+}
+
+func (k *keyspace) Set(key string, value MqMsg) {
+	s := k.shard(key)
+	s.Lock()
+	defer s.Unlock()
+	s.items[key] = value
+}
+
+func (k *keyspace) Delete(key string) bool {
+	s := k.shard(key)
+	s.Lock()
+	defer s.Unlock()
+	_, exist := s.items[key]
+	delete(s.items, key)
+	return exist
+}
+
+// Update runs fn on the current value of key while holding the shard lock, so
+// read-modify-write sequences are atomic. fn returns the new value and whether
+// it should be stored; a returned error leaves the key untouched.
+func (k *keyspace) Update(key string, fn func(value MqMsg, exist bool) (MqMsg, bool, error)) (MqMsg, error) {
+	s := k.shard(key)
+	s.Lock()
+	defer s.Unlock()
+	v, exist := s.items[key]
+	newValue, store, e := fn(v, exist)
+	if e != nil {
+		return v, e
+	}
+	if store {
+		s.items[key] = newValue
+	}
+	return newValue, nil
+}
+
+// GetLive returns key unless it has expired, in which case it is removed.
+func (k *keyspace) GetLive(key string) (MqMsg, bool) {
+	s := k.shard(key)
+	s.Lock()
+	defer s.Unlock()
+	v, exist := s.items[key]
+	if exist && v.IsExpired() {
+		delete(s.items, key)
+		return v, false
+	}
+	return v, exist
+}
+
+// DeleteIf removes every item fn returns true for and returns how many were removed.
+func (k *keyspace) DeleteIf(fn func(key string, value MqMsg) bool) int {
+	count := 0
+	for _, s := range k.shards {
+		s.Lock()
+		for key, v := range s.items {
+			if fn(key, v) {
+				delete(s.items, key)
+				count++
+			}
+		}
+		s.Unlock()
+	}
+	return count
+}
+
+// Range calls fn for every item, one shard at a time, until fn returns false.
+func (k *keyspace) Range(fn func(key string, value MqMsg) bool) {
+	for _, s := range k.shards {
+		s.RLock()
+		for key, v := range s.items {
+			if !fn(key, v) {
+				s.RUnlock()
+				return
+			}
+		}
+		s.RUnlock()
+	}
+}
+
+func (k *keyspace) Len() int {
+	count := 0
+	for _, s := range k.shards {
+		s.RLock()
+		count += len(s.items)
+		s.RUnlock()
+	}
+	return count
+}
+
+// Copy returns every item as a plain map. All shards are locked together so
+// the copy is a consistent point in time.
+func (k *keyspace) Copy() map[string]MqMsg {
+	for _, s := range k.shards {
+		s.RLock()
+	}
+	items := make(map[string]MqMsg)
+	for _, s := range k.shards {
+		for key, v := range s.items {
+			items[key] = v
+		}
+	}
+	for _, s := range k.shards {
+		s.RUnlock()
+	}
+	return items
+}
+
+// Load replaces every item with items.
+func (k *keyspace) Load(items map[string]MqMsg) {
+	for _, s := range k.shards {
+		s.Lock()
+		s.items = make(map[string]MqMsg)
+	}
+	for key, v := range items {
+		k.shards[shardIndex(key, len(k.shards))].items[key] = v
+	}
+	for _, s := range k.shards {
+		s.Unlock()
+	}
+}
@@ -0,0 +1,448 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	. "github.com/eaciit/mq/helper"
+	. "github.com/eaciit/mq/msg"
+)
+
+const (
+	defaultVisibility time.Duration = 30 * time.Second
+)
+
+// LeaseRef points at one lease of a queue message. A lease is only found
+// while the message is still leased for the same delivery attempt, so a
+// consumer whose lease ran out cannot ack the next delivery of the message.
+type LeaseRef struct {
+	Seq      int64
+	Attempts int
+	Until    time.Time // new end of the lease, used by Extend
+}
+
+func leaseID(item QueueItem) string {
+	return fmt.Sprintf("%d.%d", item.Seq, item.Msg.Attempts)
+}
+
+func parseLeaseID(id string) (LeaseRef, error) {
+	parts := strings.Split(id, ".")
+	if len(parts) != 2 {
+		return LeaseRef{}, ErrLeaseNotFound
+	}
+	seq, e1 := strconv.ParseInt(parts[0], 10, 64)
+	attempts, e2 := strconv.Atoi(parts[1])
+	if e1 != nil || e2 != nil {
+		return LeaseRef{}, ErrLeaseNotFound
+	}
+	return LeaseRef{Seq: seq, Attempts: attempts}, nil
+}
+
+// lease moves item, as leased by the node holding the queue, to Leased.
+func (q *nodeQueue) lease(item QueueItem) {
+	if _, leased := q.Leased[item.Seq]; !leased {
+		if _, found := q.remove(item.Seq); !found {
+			return
+		}
+	}
+	q.Leased[item.Seq] = item
+}
+
+func (q *nodeQueue) leasedItem(ref LeaseRef) (QueueItem, bool) {
+	item, leased := q.Leased[ref.Seq]
+	return item, leased && item.Msg.Attempts == ref.Attempts
+}
+
+// leasedIn tells whether a message of partition p is leased.
+func (q *nodeQueue) leasedIn(p int) bool {
+	for _, item := range q.Leased {
+		if item.Partition == p {
+			return true
+		}
+	}
+	return false
+}
+
+// requeue puts a leased message back in the queue at its place.
+func (q *nodeQueue) requeue(seq int64) (QueueItem, bool) {
+	item, leased := q.Leased[seq]
+	if !leased {
+		return item, false
+	}
+	delete(q.Leased, seq)
+	item.LeaseUntil = time.Time{}
+	q.insert(item)
+	return item, true
+}
+
+func (q *nodeQueue) extend(ref LeaseRef) (QueueItem, bool) {
+	item, found := q.leasedItem(ref)
+	if !found {
+		return item, false
+	}
+	item.LeaseUntil = ref.Until
+	q.Leased[ref.Seq] = item
+	return item, true
+}
+
+// applyLeases applies the lease parts of op and returns entries with the
+// records to log. The caller holds r.qmu.
+func (q *nodeQueue) applyLeases(op QueueOp, result *QueueOpResult, entries []aofEntry) []aofEntry {
+	allowed := make(map[int]bool)
+	for _, p := range op.Partitions {
+		allowed[p] = true
+	}
+	for _, p := range op.Handover {
+		if !q.leasedIn(p) {
+			allowed[p] = true
+			result.Idle = append(result.Idle, p)
+		}
+	}
+
+	leased := []QueueItem{}
+	for i := 0; len(leased) < op.Lease && i < len(q.Items); {
+		item := q.Items[i]
+		if op.Group && !allowed[item.Partition] {
+			i++
+			continue
+		}
+		item.Msg.Attempts += 1
+		item.LeaseUntil = op.LeaseUntil
+		q.lease(item)
+		leased = append(leased, item)
+		result.Items = append(result.Items, item)
+	}
+	for _, item := range op.Leased {
+		q.lease(item)
+		leased = append(leased, item)
+	}
+	if len(leased) > 0 {
+		entries = append(entries, aofEntry{Op: "QueueLease", Key: op.Queue, Items: leased})
+	}
+
+	removed := []int64{}
+	for _, ref := range op.Ack {
+		if item, found := q.leasedItem(ref); found {
+			q.remove(ref.Seq)
+			removed = append(removed, ref.Seq)
+			result.Items = append(result.Items, item)
+		}
+	}
+	if len(removed) > 0 {
+		entries = append(entries, aofEntry{Op: "QueueRemove", Key: op.Queue, Seqs: removed})
+	}
+
+	requeue := []int64{}
+	for _, ref := range op.Nack {
+		if _, found := q.leasedItem(ref); found {
+			requeue = append(requeue, ref.Seq)
+		}
+	}
+	if !op.Expire.IsZero() {
+		expired := []int64{}
+		for seq, item := range q.Leased {
+			if item.LeaseUntil.Before(op.Expire) {
+				expired = append(expired, seq)
+			}
+		}
+		sort.Slice(expired, func(i, j int) bool { return expired[i] < expired[j] })
+		requeue = append(requeue, expired...)
+	}
+
+	requeued := []int64{}
+	dead := []int64{}
+	for _, seq := range requeue {
+		if op.MaxDeliveries > 0 && q.Leased[seq].Msg.Attempts >= op.MaxDeliveries {
+			item, _ := q.remove(seq)
+			dead = append(dead, seq)
+			result.Dead = append(result.Dead, item)
+			continue
+		}
+		item, _ := q.requeue(seq)
+		requeued = append(requeued, seq)
+		result.Items = append(result.Items, item)
+	}
+	if len(requeued) > 0 {
+		entries = append(entries, aofEntry{Op: "QueueRequeue", Key: op.Queue, Seqs: requeued})
+	}
+	if len(dead) > 0 {
+		entries = append(entries, aofEntry{Op: "QueueRemove", Key: op.Queue, Seqs: dead})
+	}
+
+	extended := []QueueItem{}
+	for _, ref := range op.Extend {
+		if item, found := q.extend(ref); found {
+			extended = append(extended, item)
+			result.Items = append(result.Items, item)
+		}
+	}
+	if len(extended) > 0 {
+		entries = append(entries, aofEntry{Op: "QueueExtend", Key: op.Queue, Items: extended})
+	}
+	return entries
+}
+
+// Receive leases the first message of queue args.Queue for args.Visibility,
+// 30 seconds by default. The message comes back to the queue unless it is
+// acked before the lease ends. The result holds an encoded Delivery.
+// With args.Group the consumer joins the group and only gets messages of the
+// partitions the group gives to it, ErrQueueEmpty when none is waiting.
+func (r *MqRPC) Receive(args LeaseArgs, result *MqMsg) error {
+	name := args.Queue
+	if e := consumable(name); e != nil {
+		return e
+	}
+	visibility := args.Visibility
+	if visibility <= 0 {
+		visibility = defaultVisibility
+	}
+	group := GroupArgs{Queue: name, Group: args.Group, Consumer: args.Consumer}
+	if args.Group != "" && args.Consumer == "" {
+		return errors.New("Consumer name is needed to receive as a group")
+	}
+
+	unlock := r.lockQueues(name)
+	defer unlock()
+
+	op := QueueOp{Queue: name, Lease: 1, LeaseUntil: time.Now().Add(visibility)}
+	if args.Group != "" {
+		op.Group = true
+		op.Partitions, op.Handover = r.groups.assign(group, r.queuePartitions(name))
+		if len(op.Partitions) == 0 && len(op.Handover) == 0 {
+			return ErrQueueEmpty
+		}
+	}
+
+	nodeConfig, info, e := r.queueNode(name, 0, false)
+	if e != nil {
+		return e
+	}
+	if info.Len <= 0 {
+		return ErrQueueEmpty
+	}
+
+	leased, e := r.applyQueueOp(nodeConfig, op, func(res QueueOpResult) QueueOp {
+		return QueueOp{Queue: name, Leased: res.Items}
+	})
+	if e != nil {
+		return e
+	}
+	r.groups.handover(group, leased.Idle)
+	if len(leased.Items) == 0 {
+		// Messages of the other partitions of a group may still wait
+		if !op.Group {
+			info.Len = 0
+			r.updateQueueInfo(name, info)
+		}
+		return ErrQueueEmpty
+	}
+
+	info.Len -= 1
+	info.Leased += 1
+	r.updateQueueInfo(name, info)
+
+	item := leased.Items[0]
+	delivery := Delivery{Queue: name, LeaseID: leaseID(item), Until: item.LeaseUntil, Partition: item.Partition, Msg: item.Msg}
+	buf, e := Encode(delivery)
+	if e != nil {
+		return e
+	}
+	result.Key = name
+	result.Value = buf.Bytes()
+	return nil
+}
+
+// lockWithDeadLetter takes the locks of queue name and of its dead-letter
+// queue, and returns the unlock function and the dead-letter queue to use.
+func (r *MqRPC) lockWithDeadLetter(name string) (func(), string) {
+	r.mu.RLock()
+	dlq := ""
+	if info, exist := r.queueMeta[name]; exist {
+		dlq = info.DeadLetter
+	}
+	r.mu.RUnlock()
+	if dlq == "" {
+		return r.lockQueues(name), ""
+	}
+	return r.lockQueues(name, dlq), dlq
+}
+
+// settleLease runs an Ack, Nack or Extend op for the lease of args on the node
+// and the mirrors. The caller holds the queue lock.
+func (r *MqRPC) settleLease(args LeaseArgs, op QueueOp) (QueueOpResult, queueInfo, error) {
+	nodeConfig, info, e := r.queueNode(args.Queue, 0, false)
+	if e == ErrQueueEmpty {
+		return QueueOpResult{}, info, ErrLeaseNotFound
+	}
+	if e != nil {
+		return QueueOpResult{}, info, e
+	}
+
+	op.MaxDeliveries = info.MaxDeliveries
+	settled, e := r.applyQueueOp(nodeConfig, op, func(QueueOpResult) QueueOp { return op })
+	if e != nil {
+		return settled, info, e
+	}
+	if len(settled.Items) == 0 && len(settled.Dead) == 0 {
+		return settled, info, ErrLeaseNotFound
+	}
+	return settled, info, nil
+}
+
+// finishRequeue accounts for leased messages of queue name given back to it
+// or dead-lettered after too many deliveries. The caller holds the locks of
+// name and dlq.
+func (r *MqRPC) finishRequeue(name string, dlq string, info queueInfo, requeued QueueOpResult) {
+	info.Leased -= int64(len(requeued.Items) + len(requeued.Dead))
+	if info.Leased < 0 {
+		info.Leased = 0
+	}
+	info.Len += int64(len(requeued.Items))
+	info.Size -= itemsSize(requeued.Dead)
+	r.updateQueueInfo(name, info)
+
+	if len(requeued.Dead) > 0 {
+		reason := fmt.Sprintf("delivered %d times without ack", info.MaxDeliveries)
+		r.deadLetter(name, dlq, requeued.Dead, reason)
+	}
+	for range requeued.Items {
+		r.serveWaiter(name)
+	}
+}
+
+// Ack removes the message leased under args.LeaseID for good.
+func (r *MqRPC) Ack(args LeaseArgs, result *MqMsg) error {
+	ref, e := parseLeaseID(args.LeaseID)
+	if e != nil {
+		return e
+	}
+	unlock := r.lockQueues(args.Queue)
+	defer unlock()
+
+	acked, info, e := r.settleLease(args, QueueOp{Queue: args.Queue, Ack: []LeaseRef{ref}})
+	if e != nil {
+		return e
+	}
+	info.Leased -= 1
+	info.Size -= itemsSize(acked.Items)
+	r.updateQueueInfo(args.Queue, info)
+
+	result.Key = args.Queue
+	result.Value = args.LeaseID
+	return nil
+}
+
+// Nack ends the lease args.LeaseID at once, so the message is delivered again,
+// or dead-lettered when it reached the max deliveries of the queue.
+func (r *MqRPC) Nack(args LeaseArgs, result *MqMsg) error {
+	ref, e := parseLeaseID(args.LeaseID)
+	if e != nil {
+		return e
+	}
+	unlock, dlq := r.lockWithDeadLetter(args.Queue)
+	defer unlock()
+
+	nacked, info, e := r.settleLease(args, QueueOp{Queue: args.Queue, Nack: []LeaseRef{ref}})
+	if e != nil {
+		return e
+	}
+	r.finishRequeue(args.Queue, dlq, info, nacked)
+
+	result.Key = args.Queue
+	result.Value = args.LeaseID
+	return nil
+}
+
+// Reject removes the message leased under args.LeaseID from its queue and
+// moves it to the dead-letter queue with args.Reason. A message the
+// dead-letter queue refuses is put back in its queue.
+func (r *MqRPC) Reject(args LeaseArgs, result *MqMsg) error {
+	ref, e := parseLeaseID(args.LeaseID)
+	if e != nil {
+		return e
+	}
+	unlock, dlq := r.lockWithDeadLetter(args.Queue)
+	defer unlock()
+
+	rejected, info, e := r.settleLease(args, QueueOp{Queue: args.Queue, Ack: []LeaseRef{ref}})
+	if e != nil {
+		return e
+	}
+	info.Leased -= 1
+	info.Size -= itemsSize(rejected.Items)
+	r.updateQueueInfo(args.Queue, info)
+
+	reason := "rejected"
+	if args.Reason != "" {
+		reason += ": " + args.Reason
+	}
+	r.deadLetter(args.Queue, dlq, rejected.Items, reason)
+
+	result.Key = args.Queue
+	result.Value = args.LeaseID
+	return nil
+}
+
+// ExtendLease makes the lease args.LeaseID end args.Visibility from now and
+// returns the new end of the lease.
+func (r *MqRPC) ExtendLease(args LeaseArgs, result *MqMsg) error {
+	ref, e := parseLeaseID(args.LeaseID)
+	if e != nil {
+		return e
+	}
+	visibility := args.Visibility
+	if visibility <= 0 {
+		visibility = defaultVisibility
+	}
+	ref.Until = time.Now().Add(visibility)
+
+	unlock := r.lockQueues(args.Queue)
+	defer unlock()
+
+	extended, _, e := r.settleLease(args, QueueOp{Queue: args.Queue, Extend: []LeaseRef{ref}})
+	if e != nil {
+		return e
+	}
+	result.Key = args.Queue
+	result.Value = extended.Items[0].LeaseUntil
+	return nil
+}
+
+// reapLeases puts every message whose lease ended back in its queue.
+func (r *MqRPC) reapLeases() {
+	r.mu.RLock()
+	names := []string{}
+	for name, info := range r.queueMeta {
+		if info.Leased > 0 && info.Node >= 0 {
+			names = append(names, name)
+		}
+	}
+	r.mu.RUnlock()
+
+	for _, name := range names {
+		r.expireLeases(name, time.Now())
+	}
+}
+
+func (r *MqRPC) expireLeases(name string, now time.Time) {
+	unlock, dlq := r.lockWithDeadLetter(name)
+	defer unlock()
+
+	nodeConfig, info, e := r.queueNode(name, 0, false)
+	if e != nil || info.Leased <= 0 {
+		return
+	}
+
+	op := QueueOp{Queue: name, Expire: now, MaxDeliveries: info.MaxDeliveries}
+	expired, e := r.applyQueueOp(nodeConfig, op, func(QueueOpResult) QueueOp { return op })
+	if e != nil || len(expired.Items)+len(expired.Dead) == 0 {
+		return
+	}
+
+	Logging(fmt.Sprintf("%d lease(s) of queue '%s' expired, %d message(s) will be delivered again", len(expired.Items)+len(expired.Dead), name, len(expired.Items)), "INFO")
+	r.finishRequeue(name, dlq, info, expired)
+}
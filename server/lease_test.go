@@ -0,0 +1,61 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/eaciit/mq/msg"
+)
+
+// TestLeaseExpiryRedelivers lets the lease of a message end without ack. The
+// message must be delivered again, and only its new lease can ack it.
+func TestLeaseExpiryRedelivers(t *testing.T) {
+	_, c := startServer(t)
+	defer c.Close()
+
+	const queue = "lease"
+	for _, value := range []string{"a", "b"} {
+		if _, e := c.Push(queue, value); e != nil {
+			t.Fatal(e)
+		}
+	}
+	first, e := c.Receive(queue, 300*time.Millisecond)
+	if e != nil || first.Msg.Value != "a" || first.Msg.Attempts != 1 {
+		t.Fatalf("Receive = %+v, %v, want a at its first attempt", first, e)
+	}
+	second, e := c.Receive(queue, time.Minute)
+	if e != nil || second.Msg.Value != "b" {
+		t.Fatalf("Receive = %+v, %v, want b", second, e)
+	}
+	if e = c.Ack(queue, second.LeaseID); e != nil {
+		t.Fatal(e)
+	}
+	if _, e = c.Receive(queue, time.Minute); e != ErrQueueEmpty {
+		t.Fatalf("Receive with every message leased = %v, want %v", e, ErrQueueEmpty)
+	}
+
+	var again *Delivery
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		again, e = c.Receive(queue, time.Minute)
+		if e == nil {
+			break
+		}
+		if e != ErrQueueEmpty || time.Now().After(deadline) {
+			t.Fatalf("Message is not delivered again after its lease ended: %v", e)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if again.Msg.Value != "a" || again.Msg.Attempts != 2 {
+		t.Errorf("Delivered again %v at attempt %d, want a at attempt 2", again.Msg.Value, again.Msg.Attempts)
+	}
+
+	if e = c.Ack(queue, first.LeaseID); e != ErrLeaseNotFound {
+		t.Errorf("Ack of the ended lease = %v, want %v", e, ErrLeaseNotFound)
+	}
+	if e = c.Ack(queue, again.LeaseID); e != nil {
+		t.Errorf("Ack of the new lease: %v", e)
+	}
+	if n, e := c.Len(queue); e != nil || n != 0 {
+		t.Errorf("Len = %d, %v after acking every message", n, e)
+	}
+}
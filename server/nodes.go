@@ -0,0 +1,103 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/rpc"
+	"sort"
+	"sync"
+	"time"
+
+	. "github.com/eaciit/mq/client"
+)
+
+// nodeClients keeps one connection per node so the master does not dial for
+// every call. An rpc client can be used by many goroutines at once.
+type nodeClients struct {
+	sync.Mutex
+	clients map[string]*MqClient
+}
+
+func newNodeClients() *nodeClients {
+	return &nodeClients{clients: make(map[string]*MqClient)}
+}
+
+func (n *nodeClients) get(address string) (*MqClient, error) {
+	n.Lock()
+	defer n.Unlock()
+	if client, exist := n.clients[address]; exist {
+		return client, nil
+	}
+	client, e := NewMqClient(address, 10*time.Second)
+	if e != nil {
+		return nil, e
+	}
+	n.clients[address] = client
+	return client, nil
+}
+
+// drop closes client and forgets it, unless it has been replaced already.
+func (n *nodeClients) drop(address string, client *MqClient) {
+	n.Lock()
+	defer n.Unlock()
+	if n.clients[address] == client {
+		delete(n.clients, address)
+	}
+	client.Close()
+}
+
+// readOps are the node calls that change nothing, so they can be sent again
+// when the connection breaks before their reply arrives.
+var readOps = map[string]bool{"GetItem": true, "GetItems": true}
+
+// callNode calls op on the given server over its cached connection. A broken
+// connection, such as one to a node that restarted, is dialed again once. A
+// call that changes data is only sent again when it never left, since the
+// node may have applied it before the connection broke.
+func (r *MqRPC) callNode(cfg *ServerConfig, op string, args interface{}, result interface{}) error {
+	address := fmt.Sprintf("%s:%d", cfg.Name, cfg.Port)
+	var e error
+	for attempt := 0; attempt < 2; attempt++ {
+		client, dialErr := r.clients.get(address)
+		if dialErr != nil {
+			errorMsg := fmt.Sprintf("Unable connect to node %s:%d\n", cfg.Name, cfg.Port)
+			Logging(errorMsg, "ERROR")
+			return errors.New(errorMsg)
+		}
+
+		e = client.CallDirect(op, args, result)
+		if e == nil || !IsConnectionError(e) {
+			return e
+		}
+		r.clients.drop(address, client)
+		// rpc.ErrShutdown means the connection was known closed before sending
+		if e != rpc.ErrShutdown && !readOps[op] {
+			return e
+		}
+	}
+	return e
+}
+
+// lockKeys takes the key locks of every key, always in the same order so two
+// batches never wait on each other, and returns the unlock function.
+func (r *MqRPC) lockKeys(keys []string) func() {
+	stripes := []int{}
+	seen := make(map[int]bool)
+	for _, key := range keys {
+		i := shardIndex(key, len(r.keyLocks))
+		if !seen[i] {
+			seen[i] = true
+			stripes = append(stripes, i)
+		}
+	}
+	sort.Ints(stripes)
+
+	for _, i := range stripes {
+		r.keyLocks[i].Lock()
+	}
+	return func() {
+		for _, i := range stripes {
+			r.keyLocks[i].Unlock()
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	. "github.com/eaciit/mq/msg"
+)
+
+// queueBlockTimeout is how long a producer waits for room in a full block
+// queue without a BlockTimeout of its own.
+const queueBlockTimeout time.Duration = 10 * time.Second
+
+// roomList hands the producers blocked on a full queue a channel, closed
+// once the queue may have room again.
+type roomList struct {
+	sync.Mutex
+	queues map[string]chan struct{}
+}
+
+func newRoomList() *roomList {
+	return &roomList{queues: make(map[string]chan struct{})}
+}
+
+func (l *roomList) wait(name string) <-chan struct{} {
+	l.Lock()
+	defer l.Unlock()
+	room, exist := l.queues[name]
+	if !exist {
+		room = make(chan struct{})
+		l.queues[name] = room
+	}
+	return room
+}
+
+// signal wakes every producer waiting on queue name.
+func (l *roomList) signal(name string) {
+	l.Lock()
+	defer l.Unlock()
+	if room, exist := l.queues[name]; exist {
+		close(room)
+		delete(l.queues, name)
+	}
+}
+
+// full tells whether a message of size bytes does not fit in the queue.
+func (info *queueInfo) full(size int64) bool {
+	return (info.MaxLen > 0 && info.Len+info.Leased >= info.MaxLen) ||
+		(info.MaxBytes > 0 && info.Size+size > info.MaxBytes)
+}
+
+// limited tells whether the queue has a max length or a max size.
+func (info *queueInfo) limited() bool {
+	return info.MaxLen > 0 || info.MaxBytes > 0
+}
+
+// dropHead makes room for a message of size bytes in full queue name by
+// moving its oldest waiting messages to dead-letter queue dlq, removing each
+// only once dlq holds it. When leased messages leave too little room, or dlq
+// has no room for them, nothing is moved and ErrQueueFull is returned. The
+// caller holds the locks of name and dlq.
+func (r *MqRPC) dropHead(nodeConfig *ServerConfig, name string, info *queueInfo, size int64, dlq string) error {
+	waiting := QueueOpResult{}
+	if e := r.callNode(nodeConfig, "QueueApply", QueueOp{Queue: name, Peek: int(info.Len)}, &waiting); e != nil {
+		Logging("Unable to read queue from node : "+e.Error(), "ERROR")
+		return e
+	}
+	left := *info
+	dropped := []QueueItem{}
+	for _, item := range waiting.Items {
+		if !left.full(size) {
+			break
+		}
+		dropped = append(dropped, item)
+		left.Len--
+		left.Size -= itemsSize([]QueueItem{item})
+	}
+	if left.full(size) {
+		Logging(fmt.Sprintf("Message for queue '%s' rejected, the queue is full of leased messages : %s", name, queueDepth(info)), "INFO")
+		return ErrQueueFull
+	}
+
+	target := queueInfo{}
+	r.mu.RLock()
+	if dlqInfo, exist := r.queueMeta[dlq]; exist {
+		target = *dlqInfo
+	}
+	r.mu.RUnlock()
+	for _, item := range dropped {
+		itemSize := itemsSize([]QueueItem{item})
+		if target.full(itemSize) {
+			Logging(fmt.Sprintf("Message for queue '%s' rejected, dead-letter queue '%s' has no room for the messages to drop : %s", name, dlq, queueDepth(&target)), "INFO")
+			return ErrQueueFull
+		}
+		target.Len++
+		target.Size += itemSize
+	}
+
+	moved := 0
+	var e error
+	for _, item := range dropped {
+		if e = r.toDeadLetter(name, dlq, item, "dropped from the head of the full queue"); e != nil {
+			Logging(fmt.Sprintf("Message for queue '%s' rejected, unable to move message %d to dead-letter queue '%s' : %s", name, item.Seq, dlq, e.Error()), "INFO")
+			break
+		}
+		moved++
+	}
+	if moved > 0 {
+		op := QueueOp{Queue: name}
+		for _, item := range dropped[:moved] {
+			op.Remove = append(op.Remove, item.Seq)
+		}
+		if _, e := r.applyQueueOp(nodeConfig, op, func(QueueOpResult) QueueOp { return op }); e != nil {
+			return e
+		}
+		info.Len -= int64(moved)
+		info.Size -= itemsSize(dropped[:moved])
+		r.updateQueueInfo(name, *info)
+	}
+	if e != nil {
+		return ErrQueueFull
+	}
+	return nil
+}
+
+// roomWaiter returns the channel to wait on for room in queue name after a
+// push failed with e, or nil when the producer does not wait: the queue does
+// not block or deadline, set by the first call, has passed.
+func (r *MqRPC) roomWaiter(name string, e error, deadline *time.Time) <-chan struct{} {
+	if e != ErrQueueFull {
+		return nil
+	}
+	r.mu.RLock()
+	info, exist := r.queueMeta[name]
+	block := exist && info.Overflow == OverflowBlock
+	timeout := queueBlockTimeout
+	if exist && info.BlockTimeout > 0 {
+		timeout = info.BlockTimeout
+	}
+	r.mu.RUnlock()
+	if !block {
+		return nil
+	}
+
+	if deadline.IsZero() {
+		*deadline = time.Now().Add(timeout)
+	}
+	if !time.Now().Before(*deadline) {
+		return nil
+	}
+	return r.room.wait(name)
+}
+
+// lockWithDeadLetters takes the locks of the named queues and of their
+// dead-letter queues, and returns the unlock function and the dead-letter
+// queue of each.
+func (r *MqRPC) lockWithDeadLetters(names []string) (func(), map[string]string) {
+	dlqs := make(map[string]string)
+	locked := append([]string{}, names...)
+	r.mu.RLock()
+	for _, name := range names {
+		if info, exist := r.queueMeta[name]; exist && info.DeadLetter != "" {
+			dlqs[name] = info.DeadLetter
+			locked = append(locked, info.DeadLetter)
+		}
+	}
+	r.mu.RUnlock()
+	return r.lockQueues(locked...), dlqs
+}
+
+// queueDepth renders the length and size of a bounded queue against its limits.
+func queueDepth(info *queueInfo) string {
+	depth := fmt.Sprintf("%d", info.Len+info.Leased)
+	if info.MaxLen > 0 {
+		depth += fmt.Sprintf(" / %d", info.MaxLen)
+	}
+	size := fmt.Sprintf("%d", info.Size)
+	if info.MaxBytes > 0 {
+		size += fmt.Sprintf(" / %d", info.MaxBytes)
+	}
+	return depth + " messages, " + size + " bytes"
+}
@@ -0,0 +1,123 @@
+package server
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	. "github.com/eaciit/mq/client"
+	. "github.com/eaciit/mq/msg"
+)
+
+// queueValues pops every message of queue and returns their values.
+func queueValues(t *testing.T, c *MqClient, queue string) []interface{} {
+	values := []interface{}{}
+	for {
+		msg, e := c.Pop(queue)
+		if e == ErrQueueEmpty {
+			return values
+		}
+		if e != nil {
+			t.Fatal(e)
+		}
+		values = append(values, msg.Value)
+	}
+}
+
+// TestOverflowRejectAndBlock fills a reject-publish queue and a block queue.
+// The first refuses the push at once, the second waits for room up to its
+// block timeout.
+func TestOverflowRejectAndBlock(t *testing.T) {
+	_, c := startServer(t)
+	defer c.Close()
+
+	if e := c.DeclareQueue(QueueConfig{Name: "reject", MaxLen: 2}); e != nil {
+		t.Fatal(e)
+	}
+	for i := 0; i < 2; i++ {
+		if _, e := c.Push("reject", i); e != nil {
+			t.Fatal(e)
+		}
+	}
+	if _, e := c.Push("reject", 2); e != ErrQueueFull {
+		t.Errorf("Push to a full reject-publish queue = %v, want %v", e, ErrQueueFull)
+	}
+	if e := c.DeclareQueue(QueueConfig{Name: "small", MaxBytes: 16}); e != nil {
+		t.Fatal(e)
+	}
+	if _, e := c.Push("small", "a value longer than the queue can hold"); e != ErrTooLarge {
+		t.Errorf("Push of a message larger than the queue = %v, want %v", e, ErrTooLarge)
+	}
+
+	if e := c.DeclareQueue(QueueConfig{Name: "block", MaxLen: 1, Overflow: OverflowBlock, BlockTimeout: 300 * time.Millisecond}); e != nil {
+		t.Fatal(e)
+	}
+	if _, e := c.Push("block", "first"); e != nil {
+		t.Fatal(e)
+	}
+	start := time.Now()
+	if _, e := c.Push("block", "timed out"); e != ErrQueueFull {
+		t.Errorf("Push to a full block queue = %v, want %v", e, ErrQueueFull)
+	}
+	if waited := time.Since(start); waited < 300*time.Millisecond {
+		t.Errorf("Push to a full block queue failed after %s, before its block timeout", waited)
+	}
+
+	pushed := make(chan error, 1)
+	go func() {
+		_, e := c.Push("block", "second")
+		pushed <- e
+	}()
+	time.Sleep(100 * time.Millisecond)
+	if _, e := c.Pop("block"); e != nil {
+		t.Fatal(e)
+	}
+	if e := <-pushed; e != nil {
+		t.Errorf("Blocked push once room is made = %v", e)
+	}
+	if got := queueValues(t, c, "block"); !reflect.DeepEqual(got, []interface{}{"second"}) {
+		t.Errorf("Block queue holds %v, want [second]", got)
+	}
+}
+
+// TestOverflowDropHead fills a drop-head queue. Its oldest messages move to
+// the dead-letter queue, and nothing is dropped when the dead-letter queue
+// is full or the queue only holds leased messages.
+func TestOverflowDropHead(t *testing.T) {
+	_, c := startServer(t)
+	defer c.Close()
+
+	if e := c.DeclareQueue(QueueConfig{Name: "head.dead", MaxLen: 2}); e != nil {
+		t.Fatal(e)
+	}
+	if e := c.DeclareQueue(QueueConfig{Name: "head", MaxLen: 2, Overflow: OverflowDropHead, DeadLetter: "head.dead"}); e != nil {
+		t.Fatal(e)
+	}
+	for i := 0; i < 4; i++ {
+		if _, e := c.Push("head", i); e != nil {
+			t.Fatalf("Push %d: %v", i, e)
+		}
+	}
+	if _, e := c.Push("head", 4); e != ErrQueueFull {
+		t.Errorf("Push with the dead-letter queue full = %v, want %v", e, ErrQueueFull)
+	}
+	letters, e := c.DeadLetters("head.dead", 0)
+	if e != nil || len(letters) != 2 || letters[0].Msg.Value != 0 || letters[1].Msg.Value != 1 {
+		t.Fatalf("DeadLetters = %+v, %v, want 0 and 1", letters, e)
+	}
+	if _, e = c.PurgeDeadLetters("head.dead"); e != nil {
+		t.Fatal(e)
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, e = c.Receive("head", time.Minute); e != nil {
+			t.Fatal(e)
+		}
+	}
+	if _, e = c.Push("head", 5); e != ErrQueueFull {
+		t.Errorf("Push with every message leased = %v, want %v", e, ErrQueueFull)
+	}
+	if n, e := c.Len("head.dead"); e != nil || n != 0 {
+		t.Errorf("Dead-letter queue has %d messages, %v, leased messages have been dropped", n, e)
+	}
+}
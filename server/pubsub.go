@@ -0,0 +1,250 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/eaciit/mq/helper"
+	. "github.com/eaciit/mq/msg"
+)
+
+const (
+	subscriptionBuffer int           = 10000
+	subscriptionIdle   time.Duration = 2 * time.Minute
+	pollMaxWait        time.Duration = time.Minute
+	pollMaxMessages    int           = 100
+)
+
+// subscription buffers the messages published on topics matching pattern
+// until its consumer polls them.
+type subscription struct {
+	id       string
+	pattern  []string
+	pending  []MqMsg
+	notify   chan struct{}
+	lastSeen time.Time
+	polling  int
+	dropped  int64
+}
+
+// pubsubHub holds the subscriptions of this server. Subscriptions only live
+// in memory: a message published while nobody listens is gone.
+type pubsubHub struct {
+	sync.Mutex
+	subs map[string]*subscription
+	next int64
+}
+
+func newPubsubHub() *pubsubHub {
+	return &pubsubHub{subs: make(map[string]*subscription)}
+}
+
+// parsePattern splits a topic pattern into its dot separated words. A word
+// "*" matches exactly one word of a topic, "#" zero or more words.
+func parsePattern(pattern string) ([]string, error) {
+	if strings.TrimSpace(pattern) == "" {
+		return nil, errors.New("Topic pattern is empty")
+	}
+	words := strings.Split(pattern, ".")
+	for _, word := range words {
+		if word == "" || (word != "*" && word != "#" && strings.ContainsAny(word, "*#")) {
+			return nil, errors.New("Invalid topic pattern " + pattern + ", wildcards * and # must be whole words")
+		}
+	}
+	return words, nil
+}
+
+func topicMatches(pattern []string, topic []string) bool {
+	if len(pattern) == 0 {
+		return len(topic) == 0
+	}
+	if pattern[0] == "#" {
+		for i := 0; i <= len(topic); i++ {
+			if topicMatches(pattern[1:], topic[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(topic) == 0 || (pattern[0] != "*" && pattern[0] != topic[0]) {
+		return false
+	}
+	return topicMatches(pattern[1:], topic[1:])
+}
+
+// take removes up to max pending messages of s. The caller holds the hub lock.
+func (s *subscription) take(max int) []MqMsg {
+	n := len(s.pending)
+	if n > max {
+		n = max
+	}
+	taken := append([]MqMsg{}, s.pending[:n]...)
+	s.pending = append([]MqMsg{}, s.pending[n:]...)
+	return taken
+}
+
+// Subscribe starts a subscription to every topic matching pattern and returns
+// its id in result.Value. Messages are read with Poll; a subscription not
+// polled for two minutes is dropped.
+func (r *MqRPC) Subscribe(pattern string, result *MqMsg) error {
+	words, e := parsePattern(pattern)
+	if e != nil {
+		return e
+	}
+
+	h := r.pubsub
+	h.Lock()
+	h.next += 1
+	s := &subscription{
+		id:       fmt.Sprintf("%d-%d", time.Now().UnixNano(), h.next),
+		pattern:  words,
+		notify:   make(chan struct{}, 1),
+		lastSeen: time.Now(),
+	}
+	h.subs[s.id] = s
+	h.Unlock()
+
+	Logging("Subscription "+s.id+" to '"+pattern+"' started", "INFO")
+	result.Key = pattern
+	result.Value = s.id
+	return nil
+}
+
+// Unsubscribe ends the subscription id.
+func (r *MqRPC) Unsubscribe(id string, result *MqMsg) error {
+	h := r.pubsub
+	h.Lock()
+	s, exist := h.subs[id]
+	delete(h.subs, id)
+	h.Unlock()
+
+	if !exist {
+		return ErrSubscriptionNotFound
+	}
+	// Wake up a poll still waiting on it
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+	Logging("Subscription "+id+" ended", "INFO")
+	result.Value = id
+	return nil
+}
+
+// Publish delivers value to every subscription whose pattern matches the
+// topic value.Key and returns how many subscriptions got it.
+func (r *MqRPC) Publish(value MqMsg, result *MqMsg) error {
+	topic, e := parsePattern(value.Key)
+	if e == nil && strings.ContainsAny(value.Key, "*#") {
+		e = errors.New("Topic " + value.Key + " cannot contain wildcards")
+	}
+	if e != nil {
+		return e
+	}
+
+	msg := MqMsg{Key: value.Key, Value: value.Value, Created: time.Now(), LastAccess: time.Now()}
+	msg.SetDefaults(&value)
+
+	var delivered int64
+	h := r.pubsub
+	h.Lock()
+	for _, s := range h.subs {
+		if !topicMatches(s.pattern, topic) {
+			continue
+		}
+		if len(s.pending) >= subscriptionBuffer {
+			// A consumer that does not keep up loses its oldest messages
+			s.pending = s.pending[1:]
+			s.dropped += 1
+			if s.dropped%1000 == 1 {
+				Logging(fmt.Sprintf("Subscription %s is full, %d message(s) dropped so far", s.id, s.dropped), "WARNING")
+			}
+		}
+		s.pending = append(s.pending, msg)
+		select {
+		case s.notify <- struct{}{}:
+		default:
+		}
+		delivered += 1
+	}
+	h.Unlock()
+
+	result.Key = value.Key
+	result.Value = delivered
+	return nil
+}
+
+// Poll returns up to args.Max messages of subscription args.ID, waiting up to
+// args.Wait, at most a minute, for one to be published when there is none.
+// The result holds the encoded []MqMsg, empty when the wait ran out.
+func (r *MqRPC) Poll(args PollArgs, result *MqMsg) error {
+	max := args.Max
+	if max <= 0 || max > pollMaxMessages {
+		max = pollMaxMessages
+	}
+	wait := args.Wait
+	if wait > pollMaxWait {
+		wait = pollMaxWait
+	}
+
+	h := r.pubsub
+	h.Lock()
+	s, exist := h.subs[args.ID]
+	if !exist {
+		h.Unlock()
+		return ErrSubscriptionNotFound
+	}
+	s.polling += 1
+	s.lastSeen = time.Now()
+	msgs := s.take(max)
+	h.Unlock()
+
+	if len(msgs) == 0 && wait > 0 {
+		timer := time.NewTimer(wait)
+		select {
+		case <-s.notify:
+		case <-timer.C:
+		}
+		timer.Stop()
+
+		h.Lock()
+		msgs = s.take(max)
+		h.Unlock()
+	}
+
+	h.Lock()
+	s.polling -= 1
+	s.lastSeen = time.Now()
+	if len(s.pending) > 0 {
+		// Another poll of the same subscription may be waiting
+		select {
+		case s.notify <- struct{}{}:
+		default:
+		}
+	}
+	h.Unlock()
+
+	buf, e := Encode(msgs)
+	if e != nil {
+		return e
+	}
+	result.Key = args.ID
+	result.Value = buf.Bytes()
+	return nil
+}
+
+// reapSubscriptions drops the subscriptions nobody polled for a while.
+func (r *MqRPC) reapSubscriptions() {
+	h := r.pubsub
+	h.Lock()
+	defer h.Unlock()
+	for id, s := range h.subs {
+		if s.polling == 0 && time.Since(s.lastSeen) > subscriptionIdle {
+			delete(h.subs, id)
+			Logging("Subscription "+id+" dropped, not polled since "+s.lastSeen.Format(time.RFC3339), "INFO")
+		}
+	}
+}
@@ -0,0 +1,888 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	. "github.com/eaciit/mq/helper"
+	. "github.com/eaciit/mq/msg"
+)
+
+const (
+	// queueLockPrefix keeps the lock of a queue apart from a key of the same name.
+	queueLockPrefix string = "\x00queue|"
+
+	queueBrowsed int = 100
+)
+
+// QueueItem is one message of a queue. Seq is given by the master when the
+// message is pushed and identifies it on the node and on every mirror. A
+// message leased to a consumer has LeaseUntil set. Priority is the priority
+// of the message in a priority queue, zero in any other queue. Partition is
+// the partition of its partition key, zero in a queue without partitions.
+type QueueItem struct {
+	Seq        int64
+	Msg        MqMsg
+	LeaseUntil time.Time
+	Priority   int64
+	Partition  int
+}
+
+// QueueOp is applied to a queue by the node holding it and, with the same
+// result, by every mirror. Parts are applied in field order.
+type QueueOp struct {
+	Queue   string
+	Push    []QueueItem
+	Replace bool  // Push replaces the whole queue and LastSeq becomes Seq
+	Seq     int64 // used with Replace
+	Remove  []int64
+
+	Lease      int       // leases up to Lease messages until LeaseUntil
+	LeaseUntil time.Time // used with Lease
+
+	// With Group, Lease only takes messages of Partitions, and of the
+	// Handover partitions with no message leased, returned in Idle
+	Group      bool
+	Partitions []int
+	Handover   []int
+
+	Leased []QueueItem
+	Ack    []LeaseRef
+	Nack   []LeaseRef
+	Extend []LeaseRef
+	Expire time.Time // requeues every lease ending before Expire
+
+	// With MaxDeliveries a message nacked or expired after that many
+	// deliveries is removed and returned in Dead instead of requeued
+	MaxDeliveries int
+
+	Restore []QueueItem // puts popped messages back at their place
+
+	Dedup []DedupEntry // stored with the messages pushed
+
+	Pop   int
+	Purge bool
+	Peek  int  // a negative Peek returns every message, leased ones included
+	Drop  bool // deletes the queue, applied alone
+}
+
+// QueueOpResult holds the messages popped, leased, purged or peeked by a
+// QueueOp, and the ones to dead-letter.
+type QueueOpResult struct {
+	Items []QueueItem
+	Dead  []QueueItem
+	Idle  []int
+}
+
+// nodeQueue is the part of a queue stored by a node. Items are kept in
+// delivery order, see queueOrder, messages leased to a consumer are kept apart
+// in Leased. LastSeq only grows, so a push replayed from the append-only log
+// is recognised and skipped.
+type nodeQueue struct {
+	Items   []QueueItem
+	Leased  map[int64]QueueItem
+	LastSeq int64
+}
+
+func newNodeQueue() *nodeQueue {
+	return &nodeQueue{Leased: make(map[int64]QueueItem)}
+}
+
+// queueOrder tells whether a is delivered before b: higher priority first,
+// then oldest first. Only items of a priority queue have a priority, so every
+// other queue is in plain Seq order.
+func queueOrder(a, b QueueItem) bool {
+	if a.Priority != b.Priority {
+		return a.Priority > b.Priority
+	}
+	return a.Seq < b.Seq
+}
+
+// insert puts item at its place in Items.
+func (q *nodeQueue) insert(item QueueItem) {
+	i := sort.Search(len(q.Items), func(i int) bool { return queueOrder(item, q.Items[i]) })
+	q.Items = append(q.Items, QueueItem{})
+	copy(q.Items[i+1:], q.Items[i:])
+	q.Items[i] = item
+}
+
+// index returns the position of message seq in Items, or -1.
+func (q *nodeQueue) index(seq int64) int {
+	// Without priorities Items is in Seq order and a binary search finds it
+	i := sort.Search(len(q.Items), func(i int) bool { return q.Items[i].Seq >= seq })
+	if i < len(q.Items) && q.Items[i].Seq == seq {
+		return i
+	}
+	for i := range q.Items {
+		if q.Items[i].Seq == seq {
+			return i
+		}
+	}
+	return -1
+}
+
+// setItems replaces the queue by items, leased ones going to Leased.
+func (q *nodeQueue) setItems(items []QueueItem, lastSeq int64) {
+	q.Items = []QueueItem{}
+	q.Leased = make(map[int64]QueueItem)
+	for _, item := range items {
+		if item.LeaseUntil.IsZero() {
+			q.Items = append(q.Items, item)
+		} else {
+			q.Leased[item.Seq] = item
+		}
+	}
+	sort.Slice(q.Items, func(i, j int) bool { return queueOrder(q.Items[i], q.Items[j]) })
+	q.LastSeq = lastSeq
+}
+
+// allItems returns the waiting messages followed by the leased ones.
+func (q *nodeQueue) allItems() []QueueItem {
+	items := append([]QueueItem{}, q.Items...)
+	for _, item := range q.Leased {
+		items = append(items, item)
+	}
+	return items
+}
+
+func (q *nodeQueue) add(item QueueItem) {
+	if item.Seq <= q.LastSeq {
+		return
+	}
+	q.insert(item)
+	q.LastSeq = item.Seq
+}
+
+// restore puts back item, popped from the queue, at its place. It reports
+// false when the queue holds it already.
+func (q *nodeQueue) restore(item QueueItem) bool {
+	if _, leased := q.Leased[item.Seq]; leased || q.index(item.Seq) >= 0 {
+		return false
+	}
+	q.insert(item)
+	return true
+}
+
+func (q *nodeQueue) remove(seq int64) (QueueItem, bool) {
+	if item, leased := q.Leased[seq]; leased {
+		delete(q.Leased, seq)
+		return item, true
+	}
+	i := q.index(seq)
+	if i < 0 {
+		return QueueItem{}, false
+	}
+	item := q.Items[i]
+	q.Items = append(q.Items[:i], q.Items[i+1:]...)
+	return item, true
+}
+
+// trim removes every message up to seq.
+func (q *nodeQueue) trim(seq int64) []QueueItem {
+	removed := []QueueItem{}
+	kept := []QueueItem{}
+	for _, item := range q.Items {
+		if item.Seq <= seq {
+			removed = append(removed, item)
+		} else {
+			kept = append(kept, item)
+		}
+	}
+	q.Items = kept
+	for leasedSeq, item := range q.Leased {
+		if leasedSeq <= seq {
+			removed = append(removed, item)
+			delete(q.Leased, leasedSeq)
+		}
+	}
+	if seq > q.LastSeq {
+		q.LastSeq = seq
+	}
+	return removed
+}
+
+// queueInfo is what the master knows of a queue. Len counts the messages
+// waiting, Leased the ones leased to a consumer, Size covers both.
+// DeadLetter, MaxDeliveries and Priority are set by DeclareQueue.
+type queueInfo struct {
+	Node       int
+	Len        int64
+	Leased     int64
+	Size       int64
+	LastSeq    int64
+	Partitions int
+
+	DeadLetter    string
+	MaxDeliveries int
+	Priority      bool
+
+	MaxLen       int64
+	MaxBytes     int64
+	Overflow     string
+	BlockTimeout time.Duration
+}
+
+func itemsSize(items []QueueItem) int64 {
+	var size int64
+	for _, item := range items {
+		buf, _ := Encode(item.Msg.Value)
+		size += int64(buf.Len())
+	}
+	return size
+}
+
+// QueueApply applies op to a queue held by this node.
+func (r *MqRPC) QueueApply(op QueueOp, result *QueueOpResult) error {
+	entries := []aofEntry{}
+
+	r.qmu.Lock()
+	if op.Drop {
+		delete(r.queues, op.Queue)
+		r.qmu.Unlock()
+		r.markDirty()
+		r.logWrite(aofEntry{Op: "QueueDrop", Key: op.Queue})
+		return nil
+	}
+	q, exist := r.queues[op.Queue]
+	if !exist {
+		q = newNodeQueue()
+		r.queues[op.Queue] = q
+	}
+
+	if op.Replace {
+		q.setItems(op.Push, op.Seq)
+		entries = append(entries, aofEntry{Op: "QueueState", Key: op.Queue, Items: q.allItems(), Seq: q.LastSeq})
+	} else {
+		for _, item := range op.Push {
+			q.add(item)
+			entries = append(entries, aofEntry{Op: "QueuePush", Key: op.Queue, Items: []QueueItem{item}})
+		}
+	}
+
+	restored := []QueueItem{}
+	for _, item := range op.Restore {
+		if q.restore(item) {
+			restored = append(restored, item)
+		}
+	}
+	if len(restored) > 0 {
+		entries = append(entries, aofEntry{Op: "QueueRestore", Key: op.Queue, Items: restored})
+	}
+
+	removed := []int64{}
+	for _, seq := range op.Remove {
+		if _, found := q.remove(seq); found {
+			removed = append(removed, seq)
+		}
+	}
+	entries = q.applyLeases(op, result, entries)
+
+	for i := 0; i < op.Pop && len(q.Items) > 0; i++ {
+		item, _ := q.remove(q.Items[0].Seq)
+		result.Items = append(result.Items, item)
+		removed = append(removed, item.Seq)
+	}
+	if len(removed) > 0 {
+		entries = append(entries, aofEntry{Op: "QueueRemove", Key: op.Queue, Seqs: removed})
+	}
+
+	if op.Purge {
+		result.Items = append(result.Items, q.trim(q.LastSeq)...)
+		entries = append(entries, aofEntry{Op: "QueueTrim", Key: op.Queue, Seq: q.LastSeq})
+	}
+
+	if op.Peek < 0 {
+		result.Items = append(result.Items, q.allItems()...)
+	} else if op.Peek > 0 {
+		n := op.Peek
+		if n > len(q.Items) {
+			n = len(q.Items)
+		}
+		result.Items = append(result.Items, q.Items[:n]...)
+	}
+	r.qmu.Unlock()
+
+	if len(entries) > 0 {
+		r.markDirty()
+	}
+	for _, entry := range entries {
+		r.logWrite(entry)
+	}
+	r.putDedup(op.Dedup)
+	return nil
+}
+
+// setQueueInfo stores the metadata of a queue and moves the difference in
+// size and length onto the node holding it and onto every mirror. The caller
+// holds r.mu.
+func (r *MqRPC) setQueueInfo(name string, info queueInfo) {
+	old := queueInfo{Node: info.Node}
+	if current, exist := r.queueMeta[name]; exist {
+		old = *current
+	}
+
+	if old.Node >= 0 && old.Node < len(r.nodes) {
+		r.nodes[old.Node].DataCount -= old.Len + old.Leased
+		r.nodes[old.Node].DataSize -= old.Size
+	}
+	if info.Node >= 0 && info.Node < len(r.nodes) {
+		r.nodes[info.Node].DataCount += info.Len + info.Leased
+		r.nodes[info.Node].DataSize += info.Size
+	}
+	for i := range r.mirrors {
+		r.mirrors[i].DataCount += info.Len + info.Leased - old.Len - old.Leased
+		r.mirrors[i].DataSize += info.Size - old.Size
+	}
+
+	r.queueMeta[name] = &info
+	r.markDirty()
+}
+
+// forgetQueue removes the metadata of queue name. The caller holds r.mu.
+func (r *MqRPC) forgetQueue(name string) {
+	if info, exist := r.queueMeta[name]; exist {
+		r.setQueueInfo(name, queueInfo{Node: info.Node})
+		delete(r.queueMeta, name)
+	}
+}
+
+// dropQueue deletes queue name and its messages, and wakes the consumers
+// waiting on it. The caller holds the queue lock.
+func (r *MqRPC) dropQueue(name string) {
+	r.mu.Lock()
+	info, exist := r.queueMeta[name]
+	var nodeConfig *ServerConfig
+	if exist && info.Node >= 0 && info.Node < len(r.nodes) {
+		nodeConfig = r.nodes[info.Node].Config
+	}
+	r.forgetQueue(name)
+	r.mu.Unlock()
+	r.waiters.drop(name)
+	if !exist {
+		return
+	}
+
+	r.logWrite(aofEntry{Op: "QueueDelete", Key: name})
+	if nodeConfig != nil {
+		op := QueueOp{Queue: name, Drop: true}
+		r.applyQueueOp(nodeConfig, op, func(QueueOpResult) QueueOp { return op })
+	}
+}
+
+// remapQueues moves the queues of node from onto node to, like the dataMap
+// entries of keys when a node dies. The caller holds r.mu.
+func (r *MqRPC) remapQueues(from int, to int) {
+	for _, info := range r.queueMeta {
+		if info.Node == from {
+			info.Node = to
+		}
+	}
+}
+
+// queueNode returns the node holding queue name and its metadata. A queue that
+// does not exist yet is placed like a key when create is set, otherwise
+// ErrQueueEmpty is returned. The caller holds the queue lock.
+func (r *MqRPC) queueNode(name string, size int64, create bool) (*ServerConfig, queueInfo, error) {
+	r.mu.RLock()
+	info := queueInfo{Node: -1}
+	if current, exist := r.queueMeta[name]; exist {
+		info = *current
+	}
+	if info.Node >= 0 && info.Node < len(r.nodes) {
+		node := r.nodes[info.Node]
+		r.mu.RUnlock()
+		if size > 0 && node.DataSize+size >= node.AllocatedSize {
+			return nil, info, ErrOutOfMemory
+		}
+		return node.Config, info, nil
+	}
+	r.mu.RUnlock()
+
+	if !create {
+		if info.Node < 0 && info.LastSeq > 0 {
+			return nil, info, errors.New("Queue " + name + " is not available, its node is down")
+		}
+		return nil, info, ErrQueueEmpty
+	}
+
+	idx, e := r.pickNode(queueLockPrefix+name, size, nil)
+	if e != nil {
+		return nil, info, e
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if idx >= len(r.nodes) {
+		return nil, info, errors.New("Selected node has been removed")
+	}
+	// A queue lost with its node starts again empty
+	info.Node = idx
+	info.Len = 0
+	info.Leased = 0
+	info.Size = 0
+	return r.nodes[idx].Config, info, nil
+}
+
+// applyQueueOp runs op on the node holding the queue, then sends mirrorOp to
+// every mirror so their copy follows.
+func (r *MqRPC) applyQueueOp(nodeConfig *ServerConfig, op QueueOp, mirrorOp func(QueueOpResult) QueueOp) (QueueOpResult, error) {
+	result := QueueOpResult{}
+	e := r.callNode(nodeConfig, "QueueApply", op, &result)
+	if e != nil {
+		errorMsg := fmt.Sprintf("Unable to apply queue operation on node : %s", e.Error())
+		Logging(errorMsg, "ERROR")
+		return result, errors.New(errorMsg)
+	}
+
+	r.mu.RLock()
+	mirrors := append([]Node{}, r.mirrors...)
+	r.mu.RUnlock()
+	if len(mirrors) == 0 {
+		return result, nil
+	}
+
+	replica := mirrorOp(result)
+	for _, mirror := range mirrors {
+		e = r.callNode(mirror.Config, "QueueApply", replica, &QueueOpResult{})
+		if e != nil {
+			errorMsg := fmt.Sprintf("Unable to apply queue operation on mirror %s:%d : %s", mirror.Config.Name, mirror.Config.Port, e.Error())
+			Logging(errorMsg, "ERROR")
+		}
+	}
+	return result, nil
+}
+
+func (r *MqRPC) updateQueueInfo(name string, info queueInfo) {
+	r.mu.Lock()
+	r.setQueueInfo(name, info)
+	r.mu.Unlock()
+	r.logWrite(aofEntry{Op: "QueueInfo", Key: name, Queue: info})
+	if info.limited() {
+		r.room.signal(name)
+	}
+}
+
+// Push appends value.Value to the end of queue value.Key, creating the queue
+// on a node when needed. A push to a full queue fails with ErrQueueFull, or
+// waits for room when the queue blocks its producers.
+func (r *MqRPC) Push(value MqMsg, result *MqMsg) error {
+	name := value.Key
+	var deadline time.Time
+	for {
+		unlock, dlq := r.lockWithDeadLetter(name)
+		e := r.pushValue(value, dlq, result)
+		room := r.roomWaiter(name, e, &deadline)
+		unlock()
+		if room == nil {
+			return e
+		}
+
+		timer := time.NewTimer(time.Until(deadline))
+		select {
+		case <-room:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// pushValue pushes value to queue value.Key once. The caller holds the locks
+// of the queue and of its dead-letter queue dlq.
+func (r *MqRPC) pushValue(value MqMsg, dlq string, result *MqMsg) error {
+	name := value.Key
+	// A repeat of a push made with the same deduplication key is not applied
+	if stored, found := r.findDedup(queueLockPrefix+name, value.DedupKey); found {
+		*result = stored
+		return nil
+	}
+	msg := MqMsg{Key: name, Value: value.Value, Created: time.Now(), LastAccess: time.Now()}
+	msg.SetDefaults(&value)
+	msg.Priority = value.Priority
+	if e := r.pushOrDrop(name, msg, dlq, r.newDedup(queueLockPrefix+name, value.DedupKey)); e != nil {
+		return e
+	}
+	*result = msg
+	return nil
+}
+
+// push appends msg as it is to queue name. The caller holds the queue lock
+// but not the one of its dead-letter queue, so a full drop-head queue refuses
+// msg with ErrQueueFull rather than drop messages it has nowhere to put.
+func (r *MqRPC) push(name string, msg MqMsg) error {
+	return r.pushOrDrop(name, msg, "", nil)
+}
+
+// pushOrDrop appends msg as it is to queue name. A full drop-head queue moves
+// its oldest messages to dead-letter queue dlq to make room, without dlq it
+// refuses msg like a reject-publish queue. The deduplication entries dedup are
+// stored with msg. The caller holds the locks of the queue and of dlq.
+func (r *MqRPC) pushOrDrop(name string, msg MqMsg, dlq string, dedup []DedupEntry) error {
+	if _, exist := r.sessions.owner(name); IsReplyQueue(name) && !exist {
+		return ErrReplyQueueGone
+	}
+	buf, _ := Encode(msg.Value)
+	size := int64(buf.Len())
+
+	nodeConfig, info, e := r.queueNode(name, size, true)
+	if e != nil {
+		Logging("Message for queue '"+name+"' cannot be pushed : "+e.Error(), "INFO")
+		return e
+	}
+	if info.MaxBytes > 0 && size > info.MaxBytes {
+		Logging(fmt.Sprintf("Message for queue '%s' rejected, its %d bytes are more than the queue can hold, %d bytes", name, size, info.MaxBytes), "INFO")
+		return ErrTooLarge
+	}
+
+	if info.full(size) && info.Overflow == OverflowDropHead && dlq != "" {
+		if e := r.dropHead(nodeConfig, name, &info, size, dlq); e != nil {
+			return e
+		}
+	}
+	if info.full(size) {
+		Logging(fmt.Sprintf("Message for queue '%s' rejected, the queue is full : %s", name, queueDepth(&info)), "INFO")
+		return ErrQueueFull
+	}
+
+	msg.Key = name
+	item := QueueItem{Seq: info.LastSeq + 1, Msg: msg}
+	if info.Priority {
+		item.Priority = msg.Priority
+	}
+	if info.Partitions > 1 {
+		item.Partition = partitionOf(msg.PartitionKey, item.Seq, info.Partitions)
+	}
+	for i := range dedup {
+		dedup[i].Result = msg
+	}
+	op := QueueOp{Queue: name, Push: []QueueItem{item}, Dedup: dedup}
+	_, e = r.applyQueueOp(nodeConfig, op, func(QueueOpResult) QueueOp { return op })
+	if e != nil {
+		return e
+	}
+	r.noteDedup(dedup, info.Node)
+
+	info.Len += 1
+	info.Size += size
+	info.LastSeq = item.Seq
+	r.updateQueueInfo(name, info)
+	r.serveWaiter(name)
+	return nil
+}
+
+// lockQueues takes the locks of the named queues and returns the unlock function.
+func (r *MqRPC) lockQueues(names ...string) func() {
+	keys := []string{}
+	for _, name := range names {
+		keys = append(keys, queueLockPrefix+name)
+	}
+	return r.lockKeys(keys)
+}
+
+// Pop removes and returns the first message of queue name, or ErrQueueEmpty.
+func (r *MqRPC) Pop(name string, result *MqMsg) error {
+	if e := consumable(name); e != nil {
+		return e
+	}
+	unlock := r.lockQueues(name)
+	defer unlock()
+	return r.pop(name, result)
+}
+
+// popReplica returns the op removing from the mirrors the messages popped
+// from queue name on its node.
+func popReplica(name string) func(QueueOpResult) QueueOp {
+	return func(res QueueOpResult) QueueOp {
+		op := QueueOp{Queue: name}
+		for _, item := range res.Items {
+			op.Remove = append(op.Remove, item.Seq)
+		}
+		return op
+	}
+}
+
+// pop removes the first message of queue name. The caller holds the queue lock.
+func (r *MqRPC) pop(name string, result *MqMsg) error {
+	item, e := r.popItem(name)
+	if e != nil {
+		return e
+	}
+	*result = item.Msg
+	return nil
+}
+
+// popItem removes the first message of queue name and returns it with its
+// place in the queue. The caller holds the queue lock.
+func (r *MqRPC) popItem(name string) (QueueItem, error) {
+	nodeConfig, info, e := r.queueNode(name, 0, false)
+	if e != nil {
+		return QueueItem{}, e
+	}
+	if info.Len <= 0 {
+		return QueueItem{}, ErrQueueEmpty
+	}
+
+	popped, e := r.applyQueueOp(nodeConfig, QueueOp{Queue: name, Pop: 1}, popReplica(name))
+	if e != nil {
+		return QueueItem{}, e
+	}
+
+	info.Len -= int64(len(popped.Items))
+	info.Size -= itemsSize(popped.Items)
+	if len(popped.Items) == 0 || info.Len < 0 {
+		info.Len = 0
+		info.Size = 0
+	}
+	r.updateQueueInfo(name, info)
+
+	if len(popped.Items) == 0 {
+		return QueueItem{}, ErrQueueEmpty
+	}
+	return popped.Items[0], nil
+}
+
+// restore puts item, popped from queue name, back at its place and hands it
+// to the next waiting consumer. The caller holds the queue lock.
+func (r *MqRPC) restore(name string, item QueueItem) {
+	if e := r.putBack(name, item); e != nil {
+		Logging(fmt.Sprintf("Message %d of queue '%s' is lost, it cannot be put back : %s", item.Seq, name, e.Error()), "ERROR")
+		return
+	}
+	Logging(fmt.Sprintf("Message %d has been put back in queue '%s', its consumer is gone", item.Seq, name), "INFO")
+}
+
+// putBack puts item, taken from queue name, back at its place as a waiting
+// message and hands it to the next waiting consumer. The caller holds the
+// queue lock.
+func (r *MqRPC) putBack(name string, item QueueItem) error {
+	nodeConfig, info, e := r.queueNode(name, 0, false)
+	if e != nil {
+		return e
+	}
+	item.LeaseUntil = time.Time{}
+	op := QueueOp{Queue: name, Restore: []QueueItem{item}}
+	if _, e = r.applyQueueOp(nodeConfig, op, func(QueueOpResult) QueueOp { return op }); e != nil {
+		return e
+	}
+
+	info.Len += 1
+	info.Size += itemsSize([]QueueItem{item})
+	r.updateQueueInfo(name, info)
+	r.serveWaiter(name)
+	return nil
+}
+
+// Peek returns the first message of queue name without removing it.
+func (r *MqRPC) Peek(name string, result *MqMsg) error {
+	nodeConfig, info, e := r.queueNode(name, 0, false)
+	if e != nil {
+		return e
+	}
+	if info.Len <= 0 {
+		return ErrQueueEmpty
+	}
+
+	peeked := QueueOpResult{}
+	e = r.callNode(nodeConfig, "QueueApply", QueueOp{Queue: name, Peek: 1}, &peeked)
+	if e != nil {
+		errorMsg := fmt.Sprintf("Unable to read queue from node : %s", e.Error())
+		return errors.New(errorMsg)
+	}
+	if len(peeked.Items) == 0 {
+		return ErrQueueEmpty
+	}
+	*result = peeked.Items[0].Msg
+	return nil
+}
+
+// Browse lists the first args.Count messages waiting in queue args.Queue, 100
+// by default, in the order they are delivered.
+func (r *MqRPC) Browse(args BrowseArgs, result *MqMsg) error {
+	count := args.Count
+	if count <= 0 {
+		count = queueBrowsed
+	}
+
+	items, _, e := r.peekAll(args.Queue, count)
+	if e != nil {
+		return e
+	}
+	msgs := []QueuedMsg{}
+	for i, item := range items {
+		msgs = append(msgs, QueuedMsg{Position: i, ID: item.Seq, Msg: item.Msg})
+	}
+
+	buf, e := Encode(msgs)
+	if e != nil {
+		return e
+	}
+	result.Key = args.Queue
+	result.Value = buf.Bytes()
+	return nil
+}
+
+// Len returns the number of messages in queue name.
+func (r *MqRPC) Len(name string, result *MqMsg) error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	result.Key = name
+	result.Value = int64(0)
+	if info, exist := r.queueMeta[name]; exist {
+		result.Value = info.Len
+	}
+	return nil
+}
+
+// Purge removes every message of queue name and returns how many were removed.
+func (r *MqRPC) Purge(name string, result *MqMsg) error {
+	if e := consumable(name); e != nil {
+		return e
+	}
+	unlock := r.lockQueues(name)
+	defer unlock()
+
+	result.Key = name
+	result.Value = int64(0)
+	nodeConfig, info, e := r.queueNode(name, 0, false)
+	if e == ErrQueueEmpty {
+		return nil
+	}
+	if e != nil {
+		return e
+	}
+
+	op := QueueOp{Queue: name, Purge: true}
+	purged, e := r.applyQueueOp(nodeConfig, op, func(QueueOpResult) QueueOp { return op })
+	if e != nil {
+		return e
+	}
+
+	info.Len = 0
+	info.Leased = 0
+	info.Size = 0
+	r.updateQueueInfo(name, info)
+
+	result.Value = int64(len(purged.Items))
+	Logging(fmt.Sprintf("Queue '%s' has been purged, %d message(s) removed", name, len(purged.Items)), "INFO")
+	return nil
+}
+
+// copyQueuesFromMirror restores the queues of a dead node onto node idx from
+// the first mirror holding them.
+func (r *MqRPC) copyQueuesFromMirror(idx int, lost []string) {
+	r.mu.RLock()
+	mirrors := append([]Node{}, r.mirrors...)
+	var nodeConfig *ServerConfig
+	if idx < len(r.nodes) {
+		nodeConfig = r.nodes[idx].Config
+	}
+	r.mu.RUnlock()
+	if nodeConfig == nil || len(mirrors) == 0 {
+		return
+	}
+
+	for _, name := range lost {
+		r.copyQueueFromMirror(name, idx, nodeConfig, mirrors[0].Config)
+	}
+}
+
+func (r *MqRPC) copyQueueFromMirror(name string, idx int, nodeConfig *ServerConfig, mirrorConfig *ServerConfig) {
+	unlock := r.lockQueues(name)
+	defer unlock()
+
+	r.mu.RLock()
+	current, exist := r.queueMeta[name]
+	info := queueInfo{}
+	if exist {
+		info = *current
+	}
+	r.mu.RUnlock()
+	if !exist || info.Node >= 0 {
+		// Pushed again since the node died, the queue lives elsewhere now
+		return
+	}
+
+	state := QueueOpResult{}
+	e := r.callNode(mirrorConfig, "QueueApply", QueueOp{Queue: name, Peek: -1}, &state)
+	if e != nil {
+		Logging("Unable to read queue '"+name+"' from mirror : "+e.Error(), "ERROR")
+		return
+	}
+	op := QueueOp{Queue: name, Push: state.Items, Replace: true, Seq: info.LastSeq}
+	e = r.callNode(nodeConfig, "QueueApply", op, &QueueOpResult{})
+	if e != nil {
+		Logging("Unable to copy queue '"+name+"' to node : "+e.Error(), "ERROR")
+		return
+	}
+
+	info.Node = idx
+	info.Len = 0
+	info.Leased = 0
+	for _, item := range state.Items {
+		if item.LeaseUntil.IsZero() {
+			info.Len += 1
+		} else {
+			info.Leased += 1
+		}
+	}
+	info.Size = itemsSize(state.Items)
+	r.updateQueueInfo(name, info)
+}
+
+// copyQueues returns a copy of every queue held by this node. The caller
+// holds r.qmu.
+func (r *MqRPC) copyQueues() map[string]nodeQueue {
+	queues := make(map[string]nodeQueue, len(r.queues))
+	for name, q := range r.queues {
+		copied := newNodeQueue()
+		copied.setItems(q.allItems(), q.LastSeq)
+		queues[name] = *copied
+	}
+	return queues
+}
+
+// applyQueueEntry replays a queue record of the append-only log.
+func (r *MqRPC) applyQueueEntry(entry aofEntry) {
+	r.qmu.Lock()
+	defer r.qmu.Unlock()
+	if entry.Op == "QueueDrop" {
+		delete(r.queues, entry.Key)
+		return
+	}
+	q, exist := r.queues[entry.Key]
+	if !exist {
+		q = newNodeQueue()
+		r.queues[entry.Key] = q
+	}
+
+	switch entry.Op {
+	case "QueuePush":
+		for _, item := range entry.Items {
+			q.add(item)
+		}
+	case "QueueRestore":
+		for _, item := range entry.Items {
+			q.restore(item)
+		}
+	case "QueueRemove":
+		for _, seq := range entry.Seqs {
+			q.remove(seq)
+		}
+	case "QueueTrim":
+		q.trim(entry.Seq)
+	case "QueueState":
+		q.setItems(entry.Items, entry.Seq)
+	case "QueueLease":
+		for _, item := range entry.Items {
+			q.lease(item)
+		}
+	case "QueueRequeue":
+		for _, seq := range entry.Seqs {
+			q.requeue(seq)
+		}
+	case "QueueExtend":
+		for _, item := range entry.Items {
+			q.extend(LeaseRef{Seq: item.Seq, Attempts: item.Msg.Attempts, Until: item.LeaseUntil})
+		}
+	}
+}
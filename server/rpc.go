@@ -10,8 +10,11 @@ import (
 	"log"
 	"math"
 	"os"
+	"path"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	. "github.com/eaciit/mq/client"
@@ -20,7 +23,8 @@ import (
 )
 
 const (
-	secondsToKill int = 10
+	secondsToKill  int = 10
+	keyLockStripes int = 256
 )
 
 var (
@@ -44,9 +48,26 @@ type Node struct {
 	AllocatedSize int64
 }
 
+// MqRPC serves every connection concurrently. Items held by this node live in
+// the sharded keyspace; the master metadata (dataMap, expires, access, tables,
+// users, nodes and mirrors) is guarded by mu, which is never held while
+// calling another node. Master operations on a single key are serialized by
+// the key lock stripes.
 type MqRPC struct {
+	dirty  int64
+	saving int32
+
+	mu             sync.RWMutex
+	keyLocks       []sync.Mutex
 	dataMap        map[string]int
-	items          map[string]MqMsg
+	keys           *keyIndex
+	expires        map[string]time.Time
+	access         map[string]*keyAccess
+	items          *keyspace
+	queueMeta      map[string]*queueInfo
+	streamMeta     map[string]*streamInfo
+	exchanges      map[string]*exchangeInfo
+	dedupAt        map[string]dedupRef
 	tables         map[string]MqTable
 	Config         *ServerConfig
 	Host           *ServerConfig
@@ -56,6 +77,27 @@ type MqRPC struct {
 	nodes   []Node
 	mirrors []Node
 	exit    bool
+	aof     *appendLog
+	clients *nodeClients
+
+	qmu    sync.Mutex
+	queues map[string]*nodeQueue
+
+	smu            sync.Mutex
+	streams        map[string]*nodeStream
+	streamsTrimmed time.Time
+
+	dmu   sync.Mutex
+	dedup map[string]DedupEntry
+
+	waiters  *waiterList
+	room     *roomList
+	sessions *sessionList
+	groups   *groupList
+	pubsub   *pubsubHub
+	schedule *scheduler
+
+	lastSave time.Time
 }
 
 type Table struct {
@@ -78,8 +120,26 @@ func (n *Node) ActiveDuration() time.Duration {
 func NewRPC(cfg *ServerConfig) *MqRPC {
 	m := new(MqRPC)
 	m.dataMap = make(map[string]int)
+	m.keys = newKeyIndex()
+	m.expires = make(map[string]time.Time)
+	m.access = make(map[string]*keyAccess)
 	m.Config = cfg
-	m.items = make(map[string]MqMsg)
+	m.items = newKeyspace()
+	m.queueMeta = make(map[string]*queueInfo)
+	m.queues = make(map[string]*nodeQueue)
+	m.streamMeta = make(map[string]*streamInfo)
+	m.exchanges = make(map[string]*exchangeInfo)
+	m.streams = make(map[string]*nodeStream)
+	m.dedup = make(map[string]DedupEntry)
+	m.dedupAt = make(map[string]dedupRef)
+	m.waiters = newWaiterList()
+	m.room = newRoomList()
+	m.sessions = newSessionList()
+	m.groups = newGroupList()
+	m.pubsub = newPubsubHub()
+	m.schedule = newScheduler()
+	m.keyLocks = make([]sync.Mutex, keyLockStripes)
+	m.clients = newNodeClients()
 	m.tables = make(map[string]MqTable)
 	m.nodes = []Node{Node{cfg, 0, 0, nil, time.Now(), time.Now(), false, int64(cfg.Memory)}}
 	m.mirrors = []Node{}
@@ -87,31 +147,75 @@ func NewRPC(cfg *ServerConfig) *MqRPC {
 	return m
 }
 
+// lockKey serializes master operations on key and returns the unlock function.
+func (r *MqRPC) lockKey(key string) func() {
+	l := &r.keyLocks[shardIndex(key, len(r.keyLocks))]
+	l.Lock()
+	return l.Unlock
+}
+
+// tryLockKey takes the lock of key only when it is free, for callers already
+// holding other key locks.
+func (r *MqRPC) tryLockKey(key string) (func(), bool) {
+	l := &r.keyLocks[shardIndex(key, len(r.keyLocks))]
+	if !l.TryLock() {
+		return nil, false
+	}
+	return l.Unlock, true
+}
+
+func (r *MqRPC) exiting() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.exit
+}
+
 func (r *MqRPC) Ping(key string, result *MqMsg) error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
 	pingInfo := fmt.Sprintf("Server is running on port %s\n", strconv.Itoa(r.Config.Port))
+	pingInfo = pingInfo + fmt.Sprintf("Eviction policy: %s\n", r.evictionPolicy())
 	pingInfo = pingInfo + fmt.Sprintf("Node \t| Address \t| Role \t Active \t\t\t| DataCount \t\t\t| DataSize (MB) \t\t\t|  MaxMemorySize (MB)\t\t\t \n")
 	for i, n := range r.nodes {
 		pingInfo = pingInfo + fmt.Sprintf("Node %d \t| %s:%d \t| %s \t %v \t\t\t| %d \t\t\t| %d \t\t\t | %d \t\t\t \n", i, n.Config.Name, n.Config.Port,
 			n.Config.Role,
-			n.ActiveDuration(), n.DataCount, (n.DataSize), (n.AllocatedSize/1024/1024))
+			n.ActiveDuration(), n.DataCount, (n.DataSize/1024/1024), (n.AllocatedSize/1024/1024))
+	}
+	bounded := []string{}
+	for name, info := range r.queueMeta {
+		if info.limited() {
+			bounded = append(bounded, name)
+		}
+	}
+	if len(bounded) > 0 {
+		sort.Strings(bounded)
+		pingInfo = pingInfo + fmt.Sprintf("Queue \t| Depth \t\t\t| Overflow \n")
+		for _, name := range bounded {
+			info := r.queueMeta[name]
+			pingInfo = pingInfo + fmt.Sprintf("%s \t| %s \t| %s \n", name, queueDepth(info), info.Overflow)
+		}
 	}
 	(*result).Value = pingInfo
 	return nil
 }
 
 func (r *MqRPC) Items(key string, result *MqMsg) error {
-	buf, e := Encode(r.items)
+	buf, e := Encode(r.items.Copy())
 	result.Value = buf.Bytes()
 	return e
 }
 
 func (r *MqRPC) Nodes(key string, result *MqMsg) error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
 	buf, e := Encode(r.nodes)
 	result.Value = buf.Bytes()
 	return e
 }
 
 func (r *MqRPC) Users(key string, result *MqMsg) error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
 	buf, e := Encode(r.users)
 	result.Value = buf.Bytes()
 	return e
@@ -146,6 +250,8 @@ func (r *MqRPC) findUser(userName string) int {
 }
 
 func (r *MqRPC) GetListUsers(key string, result *MqMsg) error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
 
 	listUser := fmt.Sprintf("UserName \t|Password \n")
 	for _, u := range r.users {
@@ -163,6 +269,10 @@ func (r *MqRPC) RegisterExistingUser(key string, result *MqMsg) error {
 		fmt.Println("Can't open user file!")
 		return nil
 	}
+	defer file.Close()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
 	reader := bufio.NewReader(file)
 	scanner := bufio.NewScanner(reader)
 	for scanner.Scan() {
@@ -175,6 +285,9 @@ func (r *MqRPC) RegisterExistingUser(key string, result *MqMsg) error {
 		layout := "Mon, 01/02/06, 03:04PM"
 		t, _ := time.Parse(layout, rowSplit[3])
 		existingUser.DateCreated = t
+		if r.findUser(existingUser.UserName) >= 0 {
+			continue
+		}
 		r.users = append(r.users, existingUser)
 		infoMsg := fmt.Sprintf("Register User: %s", rowSplit[0])
 		fmt.Println(infoMsg)
@@ -196,13 +309,14 @@ func SaveUserToFile(userName string, password string, role string) error {
 
 	n, err := io.WriteString(file, userName+"|"+password+"|"+role+"\n")
 	if err != nil {
-		errorMsg := fmt.Sprintf("Error saving user to file, %s:%s", n, err)
+		errorMsg := fmt.Sprintf("Error saving user to file, %d:%s", n, err)
 		Logging(errorMsg, "ERROR")
 	}
 	file.Close()
 	return nil
 }
 
+// UpdateUserFile writes every user to the user file. The caller holds r.mu.
 func UpdateUserFile(r *MqRPC) {
 	//r := *MqRPC
 	file, err := os.OpenFile("user/user.txt", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0666)
@@ -215,7 +329,7 @@ func UpdateUserFile(r *MqRPC) {
 	}
 	n, err := io.WriteString(file, fileContent)
 	if err != nil {
-		errorMsg := fmt.Sprintf("Error update user to file, %s:%s", n, err)
+		errorMsg := fmt.Sprintf("Error update user to file, %d:%s", n, err)
 		Logging(errorMsg, "ERROR")
 	}
 	file.Close()
@@ -223,6 +337,8 @@ func UpdateUserFile(r *MqRPC) {
 
 func (r *MqRPC) DeleteUser(value MqMsg, result *MqMsg) error {
 	UserName := value.Value.(string)
+	r.mu.Lock()
+	defer r.mu.Unlock()
 	Users := []MqUser{}
 	for _, u := range r.users {
 		//listUser = listUser + fmt.Sprintf("%s \t|%s \n", u.UserName, u.Password)
@@ -232,6 +348,8 @@ func (r *MqRPC) DeleteUser(value MqMsg, result *MqMsg) error {
 	}
 	r.users = Users
 	UpdateUserFile(r)
+	r.markDirty()
+	r.logWrite(aofEntry{Op: "DeleteUser", Key: UserName})
 	(*result).Value = fmt.Sprintf("User:%s has been deleted", UserName)
 	return nil
 }
@@ -241,6 +359,8 @@ func (r *MqRPC) ChangePassword(value MqMsg, result *MqMsg) error {
 	Password := GetMD5Hash(value.Value.(string))
 	Role := "admin"
 	userFound := false
+	r.mu.Lock()
+	defer r.mu.Unlock()
 	for i, u := range r.users {
 		//listUser = listUser + fmt.Sprintf("%s \t|%s \n", u.UserName, u.Password)
 		if u.UserName == UserName {
@@ -255,6 +375,8 @@ func (r *MqRPC) ChangePassword(value MqMsg, result *MqMsg) error {
 	}
 	if userFound {
 		UpdateUserFile(r)
+		r.markDirty()
+		r.logWrite(aofEntry{Op: "ChangePassword", Key: UserName, User: r.users[r.findUser(UserName)]})
 		result.Value = "Password has changed successfully for user: " + UserName
 	} else {
 		result.Value = "Cant find user: " + UserName
@@ -272,6 +394,8 @@ func (r *MqRPC) ClientLogin(value MqMsg, result *MqMsg) error {
 		userFound = true
 		Role = "root"
 	} else {
+		r.mu.RLock()
+		defer r.mu.RUnlock()
 		for _, u := range r.users {
 			//listUser = listUser + fmt.Sprintf("%s \t|%s \n", u.UserName, u.Password)
 			if u.UserName == UserName {
@@ -299,6 +423,8 @@ func (r *MqRPC) AddUser(value MqMsg, result *MqMsg) error {
 		role = "admin"
 	}
 	password := GetMD5Hash(value.Value.(string))
+	r.mu.Lock()
+	defer r.mu.Unlock()
 	userIndex := r.findUser(userName)
 	userFound := userIndex >= 0
 	if userFound {
@@ -318,6 +444,8 @@ func (r *MqRPC) AddUser(value MqMsg, result *MqMsg) error {
 
 	//save user to file
 	UpdateUserFile(r)
+	r.markDirty()
+	r.logWrite(aofEntry{Op: "AddUser", Key: userName, User: newUser})
 
 	Logging("New User: "+userName+" has been added with password: "+password, "INFO")
 	return nil
@@ -325,10 +453,12 @@ func (r *MqRPC) AddUser(value MqMsg, result *MqMsg) error {
 
 func (r *MqRPC) AddNode(nodeConfig *ServerConfig, result *MqMsg) error {
 	//-- is server exist
+	r.mu.RLock()
 	nodeIndex, _ := r.findNode(nodeConfig.Name, nodeConfig.Port)
+	r.mu.RUnlock()
 	nodeFound := nodeIndex >= 0
 	if nodeFound {
-		errorMsg := fmt.Sprintf("Unable to add node %s:%s. It is already exist", nodeConfig.Name, nodeConfig.Port)
+		errorMsg := fmt.Sprintf("Unable to add node %s:%d. It is already exist", nodeConfig.Name, nodeConfig.Port)
 		Logging(errorMsg, "ERROR")
 		return errors.New(errorMsg)
 	}
@@ -356,29 +486,56 @@ func (r *MqRPC) AddNode(nodeConfig *ServerConfig, result *MqMsg) error {
 	newNode.StartTime = time.Now()
 	newNode.AllocatedSize = nodeConfig.Memory /// 1024 / 1024
 	newNode.isOffline = false
+	r.mu.Lock()
 	r.nodes = append(r.nodes, newNode)
-	Logging("New Node has been added successfully", "INFO")
-
-	if r.deadNodesCount > 0 {
+	lastNodeIndex := len(r.nodes) - 1
+	deadNodesCount := r.deadNodesCount
+	lostMeta := []string{}
+	lostQueues := []string{}
+	lostStreams := []string{}
+	lostDedup := []string{}
+	if deadNodesCount > 0 {
 		// There is dead node in master metadata
 		// Get meta for dead node
-		lostMeta := []string{}
 		for index, item := range r.dataMap {
-			if item == -r.deadNodesCount {
+			if item == -deadNodesCount {
 				lostMeta = append(lostMeta, index)
 			}
 		}
+		for name, info := range r.queueMeta {
+			if info.Node == -deadNodesCount {
+				lostQueues = append(lostQueues, name)
+			}
+		}
+		for name, info := range r.streamMeta {
+			for _, part := range info.Partitions {
+				if part.Node == -deadNodesCount {
+					lostStreams = append(lostStreams, name)
+					break
+				}
+			}
+		}
+		lostDedup = r.dedupOn(-deadNodesCount)
+	}
+	r.mu.Unlock()
+	r.markDirty()
+	Logging("New Node has been added successfully", "INFO")
 
-		lastNodeIndex := len(r.nodes) - 1
+	if deadNodesCount > 0 {
 		err := r.copyDataFromMirrorToNode(lastNodeIndex, lostMeta)
 		if err == nil {
 			// Copying data succes, update the dataMap
+			r.mu.Lock()
 			for index, item := range r.dataMap {
-				if item == -r.deadNodesCount {
+				if item == -deadNodesCount {
 					r.dataMap[index] = lastNodeIndex
 				}
 			}
+			r.mu.Unlock()
 		}
+		r.copyQueuesFromMirror(lastNodeIndex, lostQueues)
+		r.copyStreamsFromMirror(lastNodeIndex, lostStreams, -deadNodesCount)
+		r.copyDedupFromMirror(lastNodeIndex, lostDedup)
 	}
 
 	return nil
@@ -386,10 +543,12 @@ func (r *MqRPC) AddNode(nodeConfig *ServerConfig, result *MqMsg) error {
 
 // TODO: in AddMirror and AddNode there are some similar code, so merge them!
 func (r *MqRPC) AddMirror(mirrorConfig *ServerConfig, result *MqMsg) error {
+	r.mu.RLock()
 	nodeIndex, _ := r.findNode(mirrorConfig.Name, mirrorConfig.Port)
+	r.mu.RUnlock()
 	nodeFound := nodeIndex >= 0
 	if nodeFound {
-		errorMsg := fmt.Sprintf("Unable to add mirror %s:%s. It is already exist", mirrorConfig.Name, mirrorConfig.Port)
+		errorMsg := fmt.Sprintf("Unable to add mirror %s:%d. It is already exist", mirrorConfig.Name, mirrorConfig.Port)
 		Logging(errorMsg, "ERROR")
 		return errors.New(errorMsg)
 	}
@@ -417,17 +576,24 @@ func (r *MqRPC) AddMirror(mirrorConfig *ServerConfig, result *MqMsg) error {
 	newNode.StartTime = time.Now()
 	newNode.AllocatedSize = mirrorConfig.Memory /// 1024 / 1024
 	newNode.isOffline = false
+	r.mu.Lock()
 	r.mirrors = append(r.mirrors, newNode)
+	r.mu.Unlock()
+	r.markDirty()
 	Logging("New Node has been added successfully", "INFO")
 	return nil
 }
 
 func (r *MqRPC) GetConfig(key string, result *MqMsg) error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
 	result.Value = *r.Config
 	return nil
 }
 
 func (r *MqRPC) SetSlave(config *ServerConfig, result *MqMsg) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 	r.Config.Role = "Slave"
 	r.Host = config
 	r.nodes = []Node{}
@@ -435,6 +601,8 @@ func (r *MqRPC) SetSlave(config *ServerConfig, result *MqMsg) error {
 }
 
 func (r *MqRPC) SetMirror(config *ServerConfig, result *MqMsg) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 	r.Config.Role = "Slave"
 	r.Host = config
 	r.nodes = []Node{}
@@ -442,12 +610,17 @@ func (r *MqRPC) SetMirror(config *ServerConfig, result *MqMsg) error {
 }
 
 func (r *MqRPC) Kill(key string, result *MqMsg) error {
-	for _, n := range r.nodes {
+	r.mu.RLock()
+	nodes := append([]Node{}, r.nodes...)
+	r.mu.RUnlock()
+	for _, n := range nodes {
 		if n.Config.Role != "Master" {
-			n.client.Call("Kill", "")
+			r.callNode(n.Config, "Kill", "", &MqMsg{})
 		}
 	}
+	r.mu.Lock()
 	r.exit = true
+	r.mu.Unlock()
 	(*result).Value = ""
 	return nil
 }
@@ -461,7 +634,7 @@ func (r *MqRPC) SetLog(value MqMsg, result *MqMsg) error {
 }
 
 func (r *MqRPC) GetLog(key time.Time, result *MqMsg) error {
-	if r.exit {
+	if r.exiting() {
 		(*result).Value = fmt.Sprintf("Received EXIT command at %v \n", time.Now())
 	} else {
 		(*result).Value = ""
@@ -471,13 +644,37 @@ func (r *MqRPC) GetLog(key time.Time, result *MqMsg) error {
 
 func (r *MqRPC) CheckHealthSlaves(key string, result *MqMsg) error {
 	// fmt.Println(len(r.items))
+	// Dial every slave without holding the lock, then update the metadata
+	r.mu.RLock()
+	checked := append([]Node{}, r.nodes...)
+	r.mu.RUnlock()
+
+	alive := make([]bool, len(checked))
+	for i, n := range checked {
+		if strings.ToLower(n.Config.Role) == "slave" {
+			client, e := NewMqClient(fmt.Sprintf("%s:%d", n.Config.Name, n.Config.Port), 1*time.Second)
+			if e == nil {
+				client.Close()
+				alive[i] = true
+			}
+		}
+	}
+
+	r.mu.Lock()
+	if len(r.nodes) != len(checked) {
+		// Nodes changed while checking, try again on the next round
+		r.mu.Unlock()
+		(*result).Value = ""
+		return nil
+	}
+
+	reconnected := []int{}
 	newNodes := []Node{}
 	for i, n := range r.nodes {
 		//- check health of the slave
 		if strings.ToLower(n.Config.Role) == "slave" {
-			_, e := NewMqClient(fmt.Sprintf("%s:%d", n.Config.Name, n.Config.Port), 1*time.Second)
 			isActive := true
-			if e != nil {
+			if !alive[i] {
 
 				if !n.isOffline {
 					//--- set offline to true and start the offline
@@ -487,9 +684,6 @@ func (r *MqRPC) CheckHealthSlaves(key string, result *MqMsg) error {
 					Logging(msg, "ERROR")
 				}
 
-				//errorMsg := fmt.Sprintf("CHECK HEALTH OF %s:%d, Slave did not response since %s!", n.Config.Name, n.Config.Port, n.offlineStart)
-				//Logging(errorMsg, "ERROR")
-
 				//-- check timeout to kill
 				duration := time.Since(n.offlineStart)
 				kill := int(math.Floor(math.Mod(math.Mod(duration.Seconds(), 3600), 60)))
@@ -504,6 +698,9 @@ func (r *MqRPC) CheckHealthSlaves(key string, result *MqMsg) error {
 							r.dataMap[index] = -r.deadNodesCount
 						}
 					}
+					r.remapQueues(i, -r.deadNodesCount)
+					r.remapStreams(i, -r.deadNodesCount)
+					r.remapDedup(i, -r.deadNodesCount)
 
 					isActive = false
 					errorMsg := fmt.Sprintf("SHUTTING DOWN SLAVE %s:%d, after idle more than %d second(s)", n.Config.Name, n.Config.Port, secondsToKill)
@@ -514,14 +711,12 @@ func (r *MqRPC) CheckHealthSlaves(key string, result *MqMsg) error {
 
 			} else {
 				if n.isOffline {
-					r.checkReconnectedNode(i)
+					reconnected = append(reconnected, len(newNodes))
 					errorMsg := fmt.Sprintf("CHECK HEALTH OF %s:%d, Slave is Up Again!", n.Config.Name, n.Config.Port)
 					//fmt.Println(errorMsg)
 					Logging(errorMsg, "INFO")
 				}
 				n.isOffline = false
-				//errorMsg := fmt.Sprintf("CHECK HEALTH OF %s:%d, FINE!", n.Config.Name, n.Config.Port)
-				//fmt.Println(errorMsg)
 			}
 			if isActive {
 				newNodes = append(newNodes, n)
@@ -535,6 +730,9 @@ func (r *MqRPC) CheckHealthSlaves(key string, result *MqMsg) error {
 							r.dataMap[index] = i - (i - len(newNodes)) - 1
 						}
 					}
+					r.remapQueues(i, len(newNodes)-1)
+					r.remapStreams(i, len(newNodes)-1)
+					r.remapDedup(i, len(newNodes)-1)
 				}
 
 			}
@@ -545,6 +743,11 @@ func (r *MqRPC) CheckHealthSlaves(key string, result *MqMsg) error {
 
 	}
 	r.nodes = newNodes
+	r.mu.Unlock()
+
+	for _, i := range reconnected {
+		r.checkReconnectedNode(i)
+	}
 	(*result).Value = ""
 	return nil
 }
@@ -552,7 +755,10 @@ func (r *MqRPC) CheckHealthSlaves(key string, result *MqMsg) error {
 func (r *MqRPC) CheckHealthMaster(key string, result *MqMsg) error {
 	callbackCmd := ""
 	// fmt.Println(len(r.items))
-	_, e := NewMqClient(fmt.Sprintf(key), 1*time.Second)
+	client, e := NewMqClient(key, 1*time.Second)
+	if e == nil {
+		client.Close()
+	}
 	if e != nil {
 		//fmt.Println(e)
 		if !isServerIdle {
@@ -595,48 +801,29 @@ func (r *MqRPC) GetLogData(value MqMsg, result *MqMsg) error {
 	return nil
 }
 
-func parseValue(value string, result *MqMsg) error {
-
-	valsplit := strings.Split(value, "|")
-	for i := 0; i <= len(valsplit); i++ {
-		if i == 0 {
-
-		} else {
-			if strings.Contains(strings.ToLower(valsplit[i]), "owner") {
-				result.Owner = strings.Split(valsplit[i], "=")[1]
-			}
-			if strings.Contains(strings.ToLower(valsplit[i]), "duration") {
-				//result.Duration = int64(strings.Split(valsplit[i], "=")[1])
-			}
-			if strings.Contains(strings.ToLower(valsplit[i]), "table") {
-				result.Table = strings.Split(valsplit[i], "=")[1]
-			}
-			if strings.Contains(strings.ToLower(valsplit[i]), "permission") {
-				result.Permission = strings.Split(valsplit[i], "=")[1]
-			}
-
+func (r *MqRPC) checkReconnectedNode(nodeIndex int) error {
+	r.mu.RLock()
+	if nodeIndex >= len(r.nodes) {
+		r.mu.RUnlock()
+		return errors.New("Node has been removed")
+	}
+	n := r.nodes[nodeIndex]
+	args := []string{}
+	for key, value := range r.dataMap {
+		if value == nodeIndex {
+			args = append(args, key)
 		}
 	}
-	fmt.Println("parseValue", result)
-	//result.
-	return nil
-}
+	dedup := r.dedupOn(nodeIndex)
+	r.mu.RUnlock()
 
-func (r *MqRPC) checkReconnectedNode(nodeIndex int) error {
-	n := r.nodes[nodeIndex]
 	client, err := NewMqClient(fmt.Sprintf("%s:%d", n.Config.Name, n.Config.Port), 1*time.Second)
 	if err != nil {
 		errorMsg := fmt.Sprintf("Unable connect to node %s:%d\n", n.Config.Name, n.Config.Port)
 		Logging(errorMsg, "ERROR")
 		return errors.New(errorMsg)
 	}
-
-	args := []string{}
-	for key, value := range r.dataMap {
-		if value == nodeIndex {
-			args = append(args, key)
-		}
-	}
+	defer client.Close()
 
 	lostMeta := []string{}
 	err = client.CallDirect("CheckData", args, &lostMeta)
@@ -648,6 +835,7 @@ func (r *MqRPC) checkReconnectedNode(nodeIndex int) error {
 
 	if len(lostMeta) > 0 {
 		r.copyDataFromMirrorToNode(nodeIndex, lostMeta)
+		r.copyDedupFromMirror(nodeIndex, dedup)
 	} else {
 		Logging("All data still exist", "INFO")
 	}
@@ -657,19 +845,32 @@ func (r *MqRPC) checkReconnectedNode(nodeIndex int) error {
 
 func (r *MqRPC) copyDataFromMirrorToNode(nodeIndex int, lostMeta []string) error {
 	Logging("Data lost, copying data from mirror", "INFO")
-	if len(r.mirrors) > 0 {
+	r.mu.RLock()
+	mirrors := append([]Node{}, r.mirrors...)
+	var nodeConfig *ServerConfig
+	if nodeIndex < len(r.nodes) {
+		nodeConfig = r.nodes[nodeIndex].Config
+	}
+	r.mu.RUnlock()
+	if nodeConfig == nil {
+		return errors.New("Node has been removed")
+	}
 
-		for _, mirror := range r.mirrors {
+	if len(mirrors) > 0 {
+
+		for _, mirror := range mirrors {
 			//Getting data from mirror
 			mirrorClient, err := NewMqClient(fmt.Sprintf("%s:%d", mirror.Config.Name, mirror.Config.Port), 1*time.Second)
 			if err != nil {
 				errorMsg := fmt.Sprintf("Unable connect to mirror %s:%d\n", mirror.Config.Name, mirror.Config.Port)
 				Logging(errorMsg, "ERROR")
+				continue
 			}
 
 			result := false
-			args := Pair{r.nodes[nodeIndex].Config, lostMeta}
+			args := Pair{*nodeConfig, lostMeta}
 			err = mirrorClient.CallDirect("FindAndSendItems", args, &result)
+			mirrorClient.Close()
 			if err != nil {
 				errorMsg := fmt.Sprintf("Unable send command to mirror %s:%d, Error: %s \n", mirror.Config.Name, mirror.Config.Port, err.Error())
 				Logging(errorMsg, "ERROR")
@@ -690,9 +891,9 @@ func (r *MqRPC) copyDataFromMirrorToNode(nodeIndex int, lostMeta []string) error
 // Check existing data with master metadata
 func (r *MqRPC) CheckData(args []string, result *[]string) error {
 	for _, key := range args {
-		_, exist := r.items[key]
+		_, exist := r.items.Get(key)
 		if !exist {
-			args = append(*result, key)
+			*result = append(*result, key)
 		}
 	}
 
@@ -705,7 +906,9 @@ func (r *MqRPC) FindAndSendItems(args Pair, result *bool) error {
 
 	selectedItem := make(map[string]MqMsg)
 	for _, key := range lostMeta {
-		selectedItem[key] = r.items[key]
+		if item, exist := r.items.Get(key); exist {
+			selectedItem[key] = item
+		}
 	}
 
 	client, err := NewMqClient(fmt.Sprintf("%s:%d", nodeConfig.Name, nodeConfig.Port), 1*time.Second)
@@ -714,6 +917,7 @@ func (r *MqRPC) FindAndSendItems(args Pair, result *bool) error {
 		Logging(errorMsg, "ERROR")
 		return errors.New(errorMsg)
 	}
+	defer client.Close()
 
 	err = client.CallDirect("RetrieveDatas", selectedItem, result)
 	if err != nil {
@@ -727,156 +931,181 @@ func (r *MqRPC) FindAndSendItems(args Pair, result *bool) error {
 
 func (r *MqRPC) RetrieveDatas(datas map[string]MqMsg, result *bool) error {
 	for key, data := range datas {
-		r.items[key] = data
+		r.items.Set(key, data)
 	}
+	r.markDirty()
 
 	*result = true
 	return nil
 }
 
 func (r *MqRPC) Set(value MqMsg, result *MqMsg) error {
-	msg := MqMsg{}
-	// check if data already in items
-	_, exist := r.items[value.Key]
-	if exist {
-		msg = r.items[value.Key]
-	} else {
-		msg.Key = value.Key
+	// Writes to the same key are applied one at a time
+	unlock := r.lockKey(value.Key)
+	defer unlock()
+
+	// A repeat of a write made with the same deduplication key is not applied
+	if stored, found := r.findDedup(value.Key, value.DedupKey); found {
+		*result = stored
+		return nil
 	}
-	msg.Value = value.Value
+	return r.set(value, r.newDedup(value.Key, value.DedupKey), result)
+}
 
-	buf, _ := Encode(msg.Value)
+// newItem builds the item stored for value and returns it with its encoded
+// size. Created is left zero, so the node storing it keeps the creation time
+// of the current item and starts the expiry from there.
+func (r *MqRPC) newItem(value MqMsg) (MqMsg, int64) {
+	msg := MqMsg{Key: value.Key, Value: value.Value}
 
-	// Search for available node
-	idxmasuk := make(map[int]int)
-	counteridx := 1
-	for j := 0; j < len(r.nodes); j++ {
-		if r.nodes[j].DataSize+int64(buf.Len()) < r.nodes[j].AllocatedSize {
-			idxmasuk[j] = j
-			counteridx++
-		}
-	}
-
-	if len(idxmasuk) > 0 {
-		var countNd int64
-		var idx int
-
-		// Pick min node
-		for i := 0; i < len(r.nodes); i++ {
-			if _, ok := idxmasuk[i]; ok {
-				if i == 0 {
-					countNd = r.nodes[0].DataCount
-					idx = 0
-				} else {
-					if countNd > r.nodes[i].DataCount {
-						countNd = r.nodes[i].DataCount
-						idx = i
-					}
-				}
-			}
-		}
+	buf, _ := Encode(msg.Value)
+	size := int64(buf.Len())
 
-		// Store data to all existing mirror
-		for key, mirror := range r.mirrors {
-			r.mirrors[key].DataCount += 1
-			r.mirrors[key].DataSize += int64(buf.Len()) / 1024 / 1024
+	msg.LastAccess = time.Now()
+	msg.SetDefaults(&value)
+	msg.Version = 0 // assigned by the node
+	return msg, size
+}
 
-			client, e := NewMqClient(fmt.Sprintf("%s:%d", mirror.Config.Name, mirror.Config.Port), 10*time.Second)
-			if e != nil {
-				errorMsg := fmt.Sprintf("Unable connect to node %s:%d\n", r.nodes[idx].Config.Name, r.nodes[idx].Config.Port)
-				Logging(errorMsg, "ERROR")
-				return errors.New(errorMsg)
-			}
+// set stores value on a node and its mirrors, with the deduplication entries
+// dedup of the write. The caller holds the key lock. A value stored on its
+// node but not on every mirror is kept, and reported with ErrMirrorDegraded.
+func (r *MqRPC) set(value MqMsg, dedup []DedupEntry, result *MqMsg) error {
+	msg, size := r.newItem(value)
 
-			client.Call("SetItem", msg)
-			if e != nil {
-				errorMsg := fmt.Sprintf("Unable to set data to node : %s", e.Error())
-				return errors.New(errorMsg)
-			}
+	// Search for available node, evicting keys if the policy allows it
+	idx, e := r.pickNode(value.Key, size, nil)
+	if e != nil {
+		Logging("New Key : '"+msg.Key+"' with value: '"+FormatValue(msg.Value)+"', data cannot be transmit, because of memory Allocation all node reach max limit", "INFO")
+		return e
+	}
+	// A key moving to another node keeps its old copy until the new one is stored
+	from, old, e := r.relocation(value.Key, idx)
+	if e != nil {
+		return e
+	}
+	if from >= 0 {
+		moveItem(&msg, old)
+	}
+	*result = msg
 
-			fmt.Printf("Data has been mirrored to Address: %s:%d, Size: %d DataCount: %d\n", mirror.Config.Name, mirror.Config.Port, r.mirrors[key].DataSize, r.mirrors[key].DataCount)
+	r.mu.RLock()
+	if idx >= len(r.nodes) {
+		r.mu.RUnlock()
+		return errors.New("Selected node has been removed")
+	}
+	nodeConfig := r.nodes[idx].Config
+	mirrors := append([]Node{}, r.mirrors...)
+	r.mu.RUnlock()
+
+	// Set item to selected node
+	op := ItemOp{Items: []MqMsg{msg}, Dedup: dedup}
+	stored := []MqMsg{}
+	e = r.callNode(nodeConfig, "SetItems", op, &stored)
+	if e == nil && len(stored) != 1 {
+		e = errors.New("Node returned an incomplete batch")
+	}
+	if e != nil {
+		errorMsg := fmt.Sprintf("Unable to set data to node : %s", e.Error())
+		return errors.New(errorMsg)
+	}
+	msg = stored[0]
+	*result = msg
+	op = ItemOp{Items: stored, Dedup: fillDedup(dedup, stored)}
+
+	// Store data to all existing mirror. The node holds it already, so it is
+	// recorded anyway and the failure reported with ErrMirrorDegraded
+	degraded := false
+	for _, mirror := range mirrors {
+		e = r.callNode(mirror.Config, "SetItems", op, &[]MqMsg{})
+		if e != nil {
+			errorMsg := fmt.Sprintf("Unable to set key '%s' to mirror %s:%d : %s", msg.Key, mirror.Config.Name, mirror.Config.Port, e.Error())
+			Logging(errorMsg, "ERROR")
+			degraded = true
 		}
+	}
 
-		if r.nodes[idx].AllocatedSize > (r.nodes[idx].DataSize + int64(buf.Len())) {
-			r.nodes[idx].DataCount += 1
-			r.nodes[idx].DataSize += int64(buf.Len()) / 1024 / 1024
-
-			fmt.Println("Data has been set to node, ", "Address : ", r.nodes[idx].Config.Name, " Port : ", r.nodes[idx].Config.Port, " Size : ", r.nodes[idx].DataSize, " DataCount : ", r.nodes[idx].DataCount)
-			msg.LastAccess = time.Now()
-			msg.SetDefaults(&msg)
-
-			// Decode data
-			valsplit := strings.Split(value.Value.(string), "|")
-			for i := 0; i < len(valsplit); i++ {
-				field := strings.ToLower(strings.Split(valsplit[i], "=")[0])
-				if strings.TrimSpace(field) == "owner" {
-					msg.Owner = strings.TrimSpace(strings.Split(valsplit[i], "=")[1])
-					msg.Owner = strings.Trim(msg.Owner, "\"")
-				}
-				if strings.TrimSpace(field) == "duration" {
-					x, _ := strconv.ParseInt(strings.Split(valsplit[i], "=")[1], 0, 64)
-					msg.Duration = x //strings.Split(valsplit[i], "=")[1].(int64))
-				}
-				if strings.TrimSpace(field) == "table" {
-					msg.Table = strings.TrimSpace(strings.Split(valsplit[i], "=")[1])
-					msg.Table = strings.Trim(msg.Table, "\"")
-				}
-				if strings.TrimSpace(field) == "permission" {
-					msg.Permission = strings.TrimSpace(strings.Split(valsplit[i], "=")[1])
-					msg.Permission = strings.Trim(msg.Permission, "\"")
-				}
-			}
-			msg.Key = value.Key
-			*result = msg
-
-			// Set item to selected node
-			client, e := NewMqClient(fmt.Sprintf("%s:%d", r.nodes[idx].Config.Name, r.nodes[idx].Config.Port), 10*time.Second)
-			if e != nil {
-				errorMsg := fmt.Sprintf("Unable connect to node %s:%d\n", r.nodes[idx].Config.Name, r.nodes[idx].Config.Port)
-				Logging(errorMsg, "ERROR")
-				return errors.New(errorMsg)
-			}
-
-			client.Call("SetItem", msg)
-			if e != nil {
-				errorMsg := fmt.Sprintf("Unable to set data to node : %s", e.Error())
-				return errors.New(errorMsg)
-			}
-
-			r.dataMap[msg.Key] = idx
-			r.setTableProperties(msg)
-			Logging("New Key : '"+msg.Key+"' has already set with value: '"+msg.Value.(string)+"'", "INFO")
-		} else {
-			Logging("New Key : '"+msg.Key+"' with value: '"+msg.Value.(string)+"', data cannot be transmit, because of memory Allocation all node reach max limit", "INFO")
-		}
-	} else {
-		Logging("Data cannot be transmit, because of All node reach max limit", "INFO")
+	r.mu.Lock()
+	r.recordSet(msg, idx, size)
+	r.indexTables(msg.Key)
+	node := r.nodes[idx]
+	r.mu.Unlock()
+	r.logWrite(aofEntry{Op: "Set", Key: msg.Key, Msg: msg, Node: idx, Size: size})
+	r.noteDedup(dedup, idx)
+	if from >= 0 {
+		r.dropMovedKeys(from, []string{msg.Key})
 	}
+	fmt.Println("Data has been set to node, ", "Address : ", node.Config.Name, " Port : ", node.Config.Port, " Size : ", node.DataSize, " DataCount : ", node.DataCount)
+	Logging("New Key : '"+msg.Key+"' has already set with value: '"+FormatValue(msg.Value)+"'", "INFO")
 
+	if degraded {
+		return ErrMirrorDegraded
+	}
 	return nil
 }
 
+// recordSet updates the master metadata of msg after it has been stored on node
+// idx. The caller holds r.mu and rebuilds the table indexes with indexTables.
+func (r *MqRPC) recordSet(msg MqMsg, idx int, size int64) {
+	if idx >= 0 && idx < len(r.nodes) {
+		r.trackSet(msg.Key, idx, size)
+	}
+	r.dataMap[msg.Key] = idx
+	r.keys.add(msg.Key)
+	r.setExpire(msg.Key, msg.ExpireAt())
+	if strings.Contains(msg.Key, "|") {
+		r.setTableProperties(msg)
+	}
+	r.markDirty()
+}
+
+// SetItem stores data on this node. A zero data.Version is replaced by the
+// next version of the key, and a zero data.Created by the creation time of the
+// current item, data.Duration then counting from now. Copies sent to mirrors
+// keep what the node owning the key assigned.
 func (r *MqRPC) SetItem(data MqMsg, result *MqMsg) error {
-	r.items[data.Key] = data
+	data, _ = r.items.Update(data.Key, func(item MqMsg, exist bool) (MqMsg, bool, error) {
+		if data.Version == 0 {
+			data.Version = item.Version + 1
+		}
+		if data.Created.IsZero() {
+			data.Created = time.Now()
+			if exist && !item.IsExpired() {
+				data.Created = item.Created
+			}
+			startExpiry(&data)
+		}
+		return data, true, nil
+	})
+	r.markDirty()
+	r.logWrite(aofEntry{Op: "SetItem", Key: data.Key, Msg: data})
 	*result = data
 	return nil
 }
 
+// Inc overwrites the value of key on this process only. Use IncrBy, DecrBy or
+// IncrByFloat to change a number atomically on the node owning it.
 func (r *MqRPC) Inc(key map[string]interface{}, result *MqMsg) error {
 	k := key["key"]
 	data := key["data"]
-	v, e := r.items[k.(string)]
-	if e == false {
-		return errors.New("Data for key  is not exist")
-	} else {
+	v, e := r.items.Update(k.(string), func(v MqMsg, exist bool) (MqMsg, bool, error) {
+		if !exist {
+			return v, false, errors.New("Data for key  is not exist")
+		}
 		v.Value = data
-		r.items[k.(string)] = v
+		v.Version += 1
+		return v, true, nil
+	})
+	if e != nil {
+		return e
 	}
+	r.markDirty()
+	r.logWrite(aofEntry{Op: "Inc", Key: k.(string), Msg: v})
 	return nil
 }
 
 func (r *MqRPC) GetItem(key string, result *MqMsg) error {
-	v, e := r.items[key]
+	v, e := r.items.GetLive(key)
 	if e == false {
 		return errors.New("Data for key " + key + " is not exist")
 	}
@@ -884,21 +1113,46 @@ func (r *MqRPC) GetItem(key string, result *MqMsg) error {
 	return nil
 }
 
+// DeleteItem removes key from the items held by this node.
+func (r *MqRPC) DeleteItem(key string, result *MqMsg) error {
+	exist := r.items.Delete(key)
+	if exist {
+		r.markDirty()
+		r.logWrite(aofEntry{Op: "DeleteItem", Key: key})
+	}
+	result.Key = key
+	result.Value = exist
+	return nil
+}
+
 func (r *MqRPC) Get(key string, result *MqMsg) error {
-	node := r.nodes[r.dataMap[key]]
-	client, err := NewMqClient(fmt.Sprintf("%s:%d", node.Config.Name, node.Config.Port), 10*time.Second)
-	if err != nil {
-		errorMsg := fmt.Sprintf("Unable connect to node %s:%d\n", node.Config.Name, node.Config.Port)
-		Logging(errorMsg, "ERROR")
-		return errors.New(errorMsg)
+	r.mu.RLock()
+	expired := r.isExpired(key)
+	idx, exist := r.dataMap[key]
+	var node Node
+	if exist && idx >= 0 && idx < len(r.nodes) {
+		node = r.nodes[idx]
+	}
+	r.mu.RUnlock()
+
+	if expired {
+		r.mu.Lock()
+		r.forgetKey(key)
+		r.indexTables(key)
+		r.mu.Unlock()
+		return errors.New("Data for key " + key + " is not exist")
+	}
+	if node.Config == nil {
+		return errors.New("Data for key " + key + " is not exist")
 	}
 
-	err = client.CallDirect("GetItem", key, result)
+	err := r.callNode(node.Config, "GetItem", key, result)
 	if err != nil {
 		errorMsg := fmt.Sprintf("Unable to get data from node : %s", err.Error())
 		return errors.New(errorMsg)
 	}
 
+	r.touchKey(key)
 	return nil
 }
 
@@ -910,14 +1164,17 @@ func (r *MqRPC) GetTable(key MqMsg, result *MqMsg) error {
 	//fmt.Println("Owner: ", owner)
 	//fmt.Println("Table: ", table)
 	var tableContent []Table
-	for k, v := range r.items {
+	r.items.Range(func(k string, v MqMsg) bool {
 		splitKey := strings.Split(k, "|")
+		if len(splitKey) < 2 {
+			return true
+		}
 		tableOwner := splitKey[0]
 		tableName := splitKey[1]
 		if tableName == table {
 			row := Table{}
 			row.Key = k
-			row.Value = v.Value.(string)
+			row.Value = FormatValue(v.Value)
 			row.Owner = tableOwner
 			if filterOwner == "" {
 				if tableOwner == "public" || tableOwner == ActiveUser {
@@ -929,7 +1186,8 @@ func (r *MqRPC) GetTable(key MqMsg, result *MqMsg) error {
 				}
 			}
 		}
-	}
+		return true
+	})
 	//table := Table{}
 	buf, _ := Encode(tableContent)
 	result.Value = buf.Bytes()
@@ -937,7 +1195,7 @@ func (r *MqRPC) GetTable(key MqMsg, result *MqMsg) error {
 }
 
 func (r *MqRPC) GetWithBuildKey(key string, result *MqMsg) error {
-	v, e := r.items[key]
+	v, e := r.items.GetLive(key)
 	if e == false {
 		return errors.New("Data for key " + key + " is not exist")
 	}
@@ -945,15 +1203,71 @@ func (r *MqRPC) GetWithBuildKey(key string, result *MqMsg) error {
 	return nil
 }
 
+// Delete removes key from the node owning it, from every mirror and from the
+// master metadata. result.Value tells whether a live key existed.
 func (r *MqRPC) Delete(key string, result *MqMsg) error {
-	_, e := r.items[key]
-	if e == true {
-		delete(r.items, key)
+	result.Key = key
+	result.Value = r.deleteKey(key)
+	return nil
+}
+
+func (r *MqRPC) deleteKey(key string) bool {
+	return r.deleteKeys([]string{key})[0]
+}
+
+// deleteKeys removes keys from the cluster and returns for every key whether a
+// live copy existed. A key listed twice only counts once.
+func (r *MqRPC) deleteKeys(keys []string) []bool {
+	unlock := r.lockKeys(keys)
+	defer unlock()
+
+	existed := make([]bool, len(keys))
+	seen := make(map[string]bool)
+	for i, key := range keys {
+		existed[i] = !seen[key] && r.keyExists(key)
+		seen[key] = true
+	}
+	r.removeKeys(keys)
+
+	for i, key := range keys {
+		if existed[i] {
+			Logging("Key : '"+key+"' has been deleted", "INFO")
+		}
+	}
+	return existed
+}
+
+// DeleteMany deletes every key of keys and returns how many existed.
+func (r *MqRPC) DeleteMany(keys []string, result *MqMsg) error {
+	var count int64
+	for _, existed := range r.deleteKeys(keys) {
+		if existed {
+			count += 1
+		}
 	}
-	Logging("Key : '"+key+"' has been deleted", "INFO")
+	result.Value = count
 	return nil
 }
 
+// DeleteByPattern deletes every key matching the glob pattern, using the
+// syntax of path.Match, and returns how many were deleted.
+func (r *MqRPC) DeleteByPattern(pattern string, result *MqMsg) error {
+	if _, e := path.Match(pattern, ""); e != nil {
+		return errors.New("Invalid pattern " + pattern + " : " + e.Error())
+	}
+
+	keys := []string{}
+	r.mu.RLock()
+	for key := range r.dataMap {
+		if matched, _ := path.Match(pattern, key); matched {
+			keys = append(keys, key)
+		}
+	}
+	r.mu.RUnlock()
+
+	return r.DeleteMany(keys, result)
+}
+
 
 func GetTableByKey(key string) string{
 	tablePositionAtIndex := len(strings.Split(key, "|")) - 2
@@ -984,7 +1298,6 @@ func (r *MqRPC) setTableProperties(value MqMsg) {
 		message := fmt.Sprintf("Succesfull add item, key->%s, value->%s, in table %s",value.Key,value.Value,tableName)
 		Logging (message, "INFO")
 	}
-	setIndex(table)
 	// fmt.Println(r.tables)
 }
 
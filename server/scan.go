@@ -0,0 +1,140 @@
+package server
+
+import (
+	"errors"
+	"path"
+	"sort"
+	"strings"
+
+	. "github.com/eaciit/mq/helper"
+	. "github.com/eaciit/mq/msg"
+)
+
+const (
+	keyIndexBuckets  int = 1024
+	scanDefaultCount int = 10
+	scanWorkFactor   int = 10
+)
+
+// keyIndex keeps the keys known by the master in a fixed set of sorted
+// buckets. Scans walk the buckets in order, so the last key returned is a
+// stable cursor: keys present during the whole iteration are returned once,
+// whatever is added or removed meanwhile.
+type keyIndex struct {
+	buckets [][]string
+}
+
+func newKeyIndex() *keyIndex {
+	return &keyIndex{buckets: make([][]string, keyIndexBuckets)}
+}
+
+func (k *keyIndex) add(key string) {
+	b := shardIndex(key, len(k.buckets))
+	keys := k.buckets[b]
+	i := sort.SearchStrings(keys, key)
+	if i < len(keys) && keys[i] == key {
+		return
+	}
+	keys = append(keys, "")
+	copy(keys[i+1:], keys[i:])
+	keys[i] = key
+	k.buckets[b] = keys
+}
+
+func (k *keyIndex) remove(key string) {
+	b := shardIndex(key, len(k.buckets))
+	keys := k.buckets[b]
+	i := sort.SearchStrings(keys, key)
+	if i < len(keys) && keys[i] == key {
+		k.buckets[b] = append(keys[:i], keys[i+1:]...)
+	}
+}
+
+// after calls fn for every key following cursor until fn returns false, and
+// returns the key fn stopped at, or an empty string when the end was reached.
+func (k *keyIndex) after(cursor string, fn func(key string) bool) string {
+	b, start := 0, 0
+	if cursor != "" {
+		b = shardIndex(cursor, len(k.buckets))
+		start = sort.SearchStrings(k.buckets[b], cursor)
+		if start < len(k.buckets[b]) && k.buckets[b][start] == cursor {
+			start++
+		}
+	}
+
+	for ; b < len(k.buckets); b++ {
+		keys := k.buckets[b]
+		for i := start; i < len(keys); i++ {
+			if !fn(keys[i]) {
+				return keys[i]
+			}
+		}
+		start = 0
+	}
+	return ""
+}
+
+// rebuildKeyIndex indexes every key of dataMap. The caller holds r.mu.
+func (r *MqRPC) rebuildKeyIndex() {
+	r.keys = newKeyIndex()
+	for key := range r.dataMap {
+		r.keys.add(key)
+	}
+}
+
+func scanMatches(args ScanArgs, key string) bool {
+	parts := strings.Split(key, "|")
+	if args.Owner != "" && parts[0] != args.Owner {
+		return false
+	}
+	if args.Table != "" && (len(parts) < 3 || GetTableByKey(key) != args.Table) {
+		return false
+	}
+	if args.Match != "" {
+		if matched, _ := path.Match(args.Match, key); !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// Scan returns the next page of keys stored in the cluster. About args.Count
+// keys are returned; a page may hold fewer, even none, when the filters skip
+// most keys, so callers iterate until the returned cursor is empty.
+func (r *MqRPC) Scan(args ScanArgs, result *MqMsg) error {
+	if args.Match != "" {
+		if _, e := path.Match(args.Match, ""); e != nil {
+			return errors.New("Invalid pattern " + args.Match + " : " + e.Error())
+		}
+	}
+	if args.Count <= 0 {
+		args.Count = scanDefaultCount
+	}
+
+	page := ScanResult{Keys: []string{}}
+	examined := 0
+	r.mu.RLock()
+	page.Cursor = r.keys.after(args.Cursor, func(key string) bool {
+		examined++
+		if !r.isExpired(key) && scanMatches(args, key) {
+			page.Keys = append(page.Keys, key)
+		}
+		return len(page.Keys) < args.Count && examined < args.Count*scanWorkFactor
+	})
+	r.mu.RUnlock()
+
+	if args.WithValues {
+		for _, item := range r.getItems(page.Keys) {
+			if item.Found {
+				page.Items = append(page.Items, item.Msg)
+			}
+		}
+	}
+
+	buf, e := Encode(page)
+	if e != nil {
+		return e
+	}
+	result.Value = buf.Bytes()
+	return nil
+}
@@ -0,0 +1,67 @@
+package server
+
+import (
+	"fmt"
+	"testing"
+
+	. "github.com/eaciit/mq/msg"
+)
+
+// TestScanCursorStability scans keys page by page while other keys are added
+// and deleted. Every key present during the whole scan must be returned once
+// and no key may be returned twice.
+func TestScanCursorStability(t *testing.T) {
+	_, c := startServer(t)
+	defer c.Close()
+
+	set := func(key string) {
+		if _, e := c.Call("Set", MqMsg{Key: key, Value: key}); e != nil {
+			t.Fatalf("Set %s: %v", key, e)
+		}
+	}
+	for i := 0; i < 100; i++ {
+		set(fmt.Sprintf("public|scan|stable%d", i))
+		set(fmt.Sprintf("public|scan|gone%d", i))
+	}
+	set("public|other|key")
+
+	seen := make(map[string]int)
+	args := ScanArgs{Match: "public|scan|*", Count: 7}
+	for page := 0; ; page++ {
+		result, e := c.Scan(args)
+		if e != nil {
+			t.Fatal(e)
+		}
+		for _, key := range result.Keys {
+			seen[key]++
+		}
+		if result.Cursor == "" {
+			break
+		}
+		if page > 1000 {
+			t.Fatal("Scan does not end")
+		}
+		args.Cursor = result.Cursor
+
+		set(fmt.Sprintf("public|scan|added%d", page))
+		if page < 100 {
+			if _, e := c.Delete(fmt.Sprintf("public|scan|gone%d", page)); e != nil {
+				t.Fatal(e)
+			}
+		}
+	}
+
+	for i := 0; i < 100; i++ {
+		if key := fmt.Sprintf("public|scan|stable%d", i); seen[key] != 1 {
+			t.Errorf("Key %s returned %d times", key, seen[key])
+		}
+	}
+	for key, n := range seen {
+		if n > 1 {
+			t.Errorf("Key %s returned %d times", key, n)
+		}
+	}
+	if seen["public|other|key"] > 0 {
+		t.Errorf("Key not matching the pattern returned")
+	}
+}
@@ -0,0 +1,316 @@
+package server
+
+import (
+	"container/heap"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	. "github.com/eaciit/mq/helper"
+	. "github.com/eaciit/mq/msg"
+)
+
+const (
+	schedulerTick    time.Duration = time.Second
+	scheduleRetry    time.Duration = 5 * time.Second
+	scheduleAttempts int           = 60
+	scheduleListed   int           = 100
+)
+
+type scheduleEntry struct {
+	ScheduledMsg
+	index int
+}
+
+// scheduleHeap orders the scheduled messages by due time, then by id.
+type scheduleHeap []*scheduleEntry
+
+func dueBefore(a, b ScheduledMsg) bool {
+	if a.Due.Equal(b.Due) {
+		return a.ID < b.ID
+	}
+	return a.Due.Before(b.Due)
+}
+
+func (h scheduleHeap) Len() int           { return len(h) }
+func (h scheduleHeap) Less(i, j int) bool { return dueBefore(h[i].ScheduledMsg, h[j].ScheduledMsg) }
+func (h scheduleHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+func (h *scheduleHeap) Push(x interface{}) {
+	entry := x.(*scheduleEntry)
+	entry.index = len(*h)
+	*h = append(*h, entry)
+}
+func (h *scheduleHeap) Pop() interface{} {
+	old := *h
+	entry := old[len(old)-1]
+	*h = old[:len(old)-1]
+	entry.index = -1
+	return entry
+}
+
+// scheduler holds the messages waiting for their due time on the master. The
+// schedule is written to the append-only log and the snapshot, so it survives
+// a restart when persistence is enabled.
+type scheduler struct {
+	sync.Mutex
+	due    scheduleHeap
+	byID   map[int64]*scheduleEntry
+	lastID int64
+	wake   chan struct{}
+}
+
+func newScheduler() *scheduler {
+	return &scheduler{byID: make(map[int64]*scheduleEntry), wake: make(chan struct{}, 1)}
+}
+
+// add schedules m, replacing a message with the same id. The caller holds s.
+func (s *scheduler) add(m ScheduledMsg) {
+	if current, exist := s.byID[m.ID]; exist {
+		heap.Remove(&s.due, current.index)
+	}
+	entry := &scheduleEntry{ScheduledMsg: m}
+	heap.Push(&s.due, entry)
+	s.byID[m.ID] = entry
+	if m.ID > s.lastID {
+		s.lastID = m.ID
+	}
+
+	if s.due[0] == entry {
+		select {
+		case s.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// remove drops the message id and reports whether it was scheduled. The
+// caller holds s.
+func (s *scheduler) remove(id int64) bool {
+	entry, exist := s.byID[id]
+	if !exist {
+		return false
+	}
+	heap.Remove(&s.due, entry.index)
+	delete(s.byID, id)
+	return true
+}
+
+// takeDue removes and returns the messages due at now.
+func (s *scheduler) takeDue(now time.Time) []ScheduledMsg {
+	s.Lock()
+	defer s.Unlock()
+	due := []ScheduledMsg{}
+	for len(s.due) > 0 && !s.due[0].Due.After(now) {
+		entry := heap.Pop(&s.due).(*scheduleEntry)
+		delete(s.byID, entry.ID)
+		due = append(due, entry.ScheduledMsg)
+	}
+	return due
+}
+
+// next returns how long until the first message is due, at most max.
+func (s *scheduler) next(max time.Duration) time.Duration {
+	s.Lock()
+	defer s.Unlock()
+	if len(s.due) == 0 {
+		return max
+	}
+	wait := time.Until(s.due[0].Due)
+	if wait > max {
+		return max
+	}
+	return wait
+}
+
+// list returns the scheduled messages sorted by due time.
+func (s *scheduler) list() []ScheduledMsg {
+	s.Lock()
+	defer s.Unlock()
+	return s.sorted()
+}
+
+// sorted returns the scheduled messages sorted by due time. The caller holds s.
+func (s *scheduler) sorted() []ScheduledMsg {
+	msgs := make([]ScheduledMsg, 0, len(s.due))
+	for _, entry := range s.due {
+		msgs = append(msgs, entry.ScheduledMsg)
+	}
+	sort.Slice(msgs, func(i, j int) bool { return dueBefore(msgs[i], msgs[j]) })
+	return msgs
+}
+
+// Schedule pushes args.Msg.Value to the queue args.Msg.Key once args.At is
+// reached, or args.Delay from now. The message keeps the Created time of the
+// call, so its expiry counts from there. The id of the scheduled message is
+// returned in result.Value.
+func (r *MqRPC) Schedule(args ScheduleArgs, result *MqMsg) error {
+	name := args.Msg.Key
+	if name == "" {
+		return errors.New("Queue name is empty")
+	}
+	due := args.At
+	if due.IsZero() {
+		due = time.Now().Add(args.Delay)
+	}
+
+	msg := MqMsg{Key: name, Value: args.Msg.Value, Created: time.Now(), LastAccess: time.Now()}
+	msg.SetDefaults(&args.Msg)
+	msg.Priority = args.Msg.Priority
+
+	s := r.schedule
+	s.Lock()
+	m := ScheduledMsg{ID: s.lastID + 1, Queue: name, Due: due, Msg: msg}
+	s.add(m)
+	s.Unlock()
+
+	r.logWrite(aofEntry{Op: "Schedule", Key: name, Seq: m.ID, Time: due, Msg: msg})
+	r.markDirty()
+	Logging(fmt.Sprintf("Message %d scheduled for queue '%s' at %s", m.ID, name, due.Format(time.RFC3339)), "INFO")
+
+	result.Key = name
+	result.Value = m.ID
+	return nil
+}
+
+// Scheduled lists the messages waiting to be pushed, sorted by due time, at
+// most args.Count of them, 100 by default.
+func (r *MqRPC) Scheduled(args ScheduledArgs, result *MqMsg) error {
+	count := args.Count
+	if count <= 0 {
+		count = scheduleListed
+	}
+
+	msgs := []ScheduledMsg{}
+	for _, m := range r.schedule.list() {
+		if len(msgs) >= count {
+			break
+		}
+		if args.Queue == "" || m.Queue == args.Queue {
+			msgs = append(msgs, m)
+		}
+	}
+
+	buf, e := Encode(msgs)
+	if e != nil {
+		return e
+	}
+	result.Key = args.Queue
+	result.Value = buf.Bytes()
+	return nil
+}
+
+// CancelSchedule drops the scheduled message id before it is pushed.
+func (r *MqRPC) CancelSchedule(id int64, result *MqMsg) error {
+	s := r.schedule
+	s.Lock()
+	removed := s.remove(id)
+	s.Unlock()
+	if !removed {
+		return ErrScheduleNotFound
+	}
+
+	r.logWrite(aofEntry{Op: "Unschedule", Seq: id})
+	r.markDirty()
+	Logging(fmt.Sprintf("Scheduled message %d cancelled", id), "INFO")
+	result.Value = id
+	return nil
+}
+
+// deliverScheduled pushes m to its queue. A message that cannot be pushed for
+// now is tried again a bit later, up to scheduleAttempts times. One the queue
+// will never take, or still refused after that, goes to the dead-letter queue
+// of its queue, or is dropped when there is none.
+func (r *MqRPC) deliverScheduled(m ScheduledMsg) {
+	unlock, dlq := r.lockWithDeadLetter(m.Queue)
+	defer unlock()
+	e := r.pushOrDrop(m.Queue, m.Msg, dlq, nil)
+
+	if e != nil {
+		m.Attempts += 1
+		if !r.undeliverable(m.Queue, e) && m.Attempts < scheduleAttempts {
+			Logging(fmt.Sprintf("Scheduled message %d cannot be pushed to queue '%s', retrying : %s", m.ID, m.Queue, e.Error()), "WARNING")
+			m.Due = time.Now().Add(scheduleRetry)
+			r.schedule.Lock()
+			r.schedule.add(m)
+			r.schedule.Unlock()
+			return
+		}
+		r.dropScheduled(m, dlq, e)
+	}
+
+	// The entry is only dropped from the log once pushed: a crash in between
+	// pushes the message again after the restart rather than losing it
+	r.logWrite(aofEntry{Op: "Unschedule", Seq: m.ID})
+	r.markDirty()
+}
+
+// undeliverable tells whether queue name will never take a message it
+// refused with e: its requester is gone, the message is larger than the
+// queue can hold or the full queue rejects its producers.
+func (r *MqRPC) undeliverable(name string, e error) bool {
+	switch e {
+	case ErrReplyQueueGone, ErrTooLarge:
+		return true
+	case ErrQueueFull:
+		r.mu.RLock()
+		defer r.mu.RUnlock()
+		info, exist := r.queueMeta[name]
+		return exist && (info.Overflow == "" || info.Overflow == OverflowReject)
+	}
+	return false
+}
+
+// dropScheduled moves m, refused by its queue with e, to dead-letter queue dlq
+// or drops it. The caller holds the locks of the queue and of dlq.
+func (r *MqRPC) dropScheduled(m ScheduledMsg, dlq string, e error) {
+	reason := fmt.Sprintf("scheduled message refused after %d attempt(s) : %s", m.Attempts, e.Error())
+	if dlq != "" {
+		msg := m.Msg
+		msg.Origin = m.Queue
+		msg.Reason = reason
+		msg.LastAccess = time.Now()
+		moved := r.push(dlq, msg)
+		if moved == nil {
+			Logging(fmt.Sprintf("Scheduled message %d for queue '%s' moved to dead-letter queue '%s', %s", m.ID, m.Queue, dlq, reason), "WARNING")
+			return
+		}
+		reason += ", and by dead-letter queue '" + dlq + "' : " + moved.Error()
+	}
+	Logging(fmt.Sprintf("Scheduled message %d for queue '%s' dropped, %s", m.ID, m.Queue, reason), "ERROR")
+}
+
+// runScheduler pushes the scheduled messages to their queue when they are due.
+func (r *MqRPC) runScheduler() {
+	for !r.exiting() {
+		if wait := r.schedule.next(schedulerTick); wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-r.schedule.wake:
+			case <-timer.C:
+			}
+			timer.Stop()
+		}
+
+		for _, m := range r.schedule.takeDue(time.Now()) {
+			r.deliverScheduled(m)
+		}
+	}
+}
+
+// applyScheduleEntry replays a Schedule or Unschedule record.
+func (r *MqRPC) applyScheduleEntry(entry aofEntry) {
+	s := r.schedule
+	s.Lock()
+	defer s.Unlock()
+	if entry.Op == "Schedule" {
+		s.add(ScheduledMsg{ID: entry.Seq, Queue: entry.Key, Due: entry.Time, Msg: entry.Msg})
+	} else {
+		s.remove(entry.Seq)
+	}
+}
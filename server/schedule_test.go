@@ -0,0 +1,71 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/eaciit/mq/msg"
+)
+
+// TestScheduledDelivery pushes a message once its delay has passed, never
+// pushes a cancelled one, and dead-letters one its full queue rejects
+// instead of retrying it.
+func TestScheduledDelivery(t *testing.T) {
+	_, c := startServer(t)
+	defer c.Close()
+
+	id, e := c.PushDelayed("later", "due", 300*time.Millisecond)
+	if e != nil {
+		t.Fatal(e)
+	}
+	cancelled, e := c.PushDelayed("later", "cancelled", 300*time.Millisecond)
+	if e != nil {
+		t.Fatal(e)
+	}
+	msgs, e := c.Scheduled("later", 0)
+	if e != nil || len(msgs) != 2 || msgs[0].ID != id {
+		t.Fatalf("Scheduled = %+v, %v, want both messages", msgs, e)
+	}
+	if _, e = c.Pop("later"); e != ErrQueueEmpty {
+		t.Fatalf("Pop before the delay = %v, want %v", e, ErrQueueEmpty)
+	}
+	if e = c.CancelSchedule(cancelled); e != nil {
+		t.Fatal(e)
+	}
+	if e = c.CancelSchedule(cancelled); e != ErrScheduleNotFound {
+		t.Errorf("CancelSchedule twice = %v, want %v", e, ErrScheduleNotFound)
+	}
+
+	var got *MqMsg
+	within(t, "the scheduled message", func() bool {
+		got, e = c.Pop("later")
+		return e != ErrQueueEmpty
+	})
+	if e != nil || got.Value != "due" {
+		t.Errorf("Pop after the delay = %v, %v, want due", got, e)
+	}
+	if _, e = c.Pop("later"); e != ErrQueueEmpty {
+		t.Errorf("Cancelled message has been pushed")
+	}
+
+	if e = c.DeclareQueue(QueueConfig{Name: "small", MaxLen: 1, DeadLetter: "small.dead"}); e != nil {
+		t.Fatal(e)
+	}
+	if _, e = c.Push("small", "filler"); e != nil {
+		t.Fatal(e)
+	}
+	if _, e = c.PushDelayed("small", "refused", time.Millisecond); e != nil {
+		t.Fatal(e)
+	}
+	var letters []DeadLetter
+	within(t, "the refused message to be dead-lettered", func() bool {
+		letters, e = c.DeadLetters("small.dead", 0)
+		return e != nil || len(letters) > 0
+	})
+	if e != nil || len(letters) != 1 || letters[0].Msg.Value != "refused" {
+		t.Errorf("DeadLetters = %+v, %v, want the refused scheduled message", letters, e)
+	}
+	if msgs, e = c.Scheduled("small", 0); e != nil || len(msgs) != 0 {
+		t.Errorf("Refused message is still scheduled: %+v, %v", msgs, e)
+	}
+}
@@ -2,25 +2,65 @@ package server
 
 import (
 	"encoding/gob"
+	"errors"
 	//"fmt"
 	"net"
-	"net/rpc"
 	"strconv"
+	"time"
 )
 
 type ServerConfig struct {
-	Name   string
-	Port   int
-	Role   string
-	Memory int64
+	Name           string
+	Port           int
+	Role           string
+	Memory         int64
+	EvictionPolicy string
+
+	DataDir          string
+	SnapshotInterval int64
+	SnapshotWrites   int64
+	AppendOnly       bool
+	AppendFsync      string
+	DedupWindow      time.Duration
 }
 
-func StartMQServer(server string, port int, memory int64) error {
+func StartMQServer(config *ServerConfig) error {
 	//fmt.Println("StartMQServer - Memory", memory)
 	gob.Register(ServerConfig{})
-	mqrpc := NewRPC(&ServerConfig{server, port, "Master", memory})
-	rpc.Register(mqrpc)
-	l, e := net.Listen("tcp", ":"+strconv.Itoa(port))
+	if config.Role == "" {
+		config.Role = "Master"
+	}
+	if !isEvictionPolicy(config.EvictionPolicy) {
+		return errors.New("Unknown eviction policy " + config.EvictionPolicy)
+	}
+	if !isFsyncMode(config.AppendFsync) {
+		return errors.New("Unknown fsync mode " + config.AppendFsync)
+	}
+	if config.AppendOnly && config.DataDir == "" {
+		return errors.New("Append only file needs a data directory")
+	}
+	mqrpc := NewRPC(config)
+	if config.DataDir != "" {
+		if e := mqrpc.loadSnapshot(); e != nil {
+			return e
+		}
+	}
+	if config.AppendOnly {
+		aof, e := openAppendLog(config.DataDir, config.Port, config.AppendFsync)
+		if e != nil {
+			return e
+		}
+		if e = aof.replay(mqrpc); e != nil {
+			return e
+		}
+		mqrpc.aof = aof
+	}
+	mqrpc.dropReplyQueues()
+	go mqrpc.runReaper(reaperInterval)
+	go mqrpc.runSnapshotSchedule()
+	go mqrpc.runAppendLog()
+	go mqrpc.runScheduler()
+	l, e := net.Listen("tcp", ":"+strconv.Itoa(config.Port))
 	defer l.Close()
 	if e != nil {
 		return e
@@ -32,7 +72,7 @@ func StartMQServer(server string, port int, memory int64) error {
 		}
 		go func(c net.Conn) {
 			defer c.Close()
-			rpc.ServeConn(c)
+			mqrpc.serveConn(c)
 		}(conn)
 	}
 	return nil
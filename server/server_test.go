@@ -0,0 +1,182 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/eaciit/mq/client"
+	. "github.com/eaciit/mq/msg"
+)
+
+const (
+	stressClients    int = 16
+	stressIterations int = 100
+)
+
+// sparePort returns a port nothing listens on.
+func sparePort(t *testing.T) int {
+	l, e := net.Listen("tcp", "127.0.0.1:0")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// startServer runs StartMQServer on a spare port and returns a client of it
+// once it accepts connections. The server runs until the test binary exits.
+func startServer(t *testing.T) (*ServerConfig, *MqClient) {
+	return startConfigured(t, &ServerConfig{Memory: 64 << 20})
+}
+
+// startConfigured is startServer with cfg, on a spare port when cfg has none.
+func startConfigured(t *testing.T, cfg *ServerConfig) (*ServerConfig, *MqClient) {
+	cfg.Name = "127.0.0.1"
+	if cfg.Port == 0 {
+		cfg.Port = sparePort(t)
+	}
+	failed := make(chan error, 1)
+	go func() {
+		failed <- StartMQServer(cfg)
+	}()
+
+	addr := fmt.Sprintf("127.0.0.1:%d", cfg.Port)
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		select {
+		case e := <-failed:
+			t.Fatalf("Unable to start server on %s: %v", addr, e)
+		default:
+		}
+		c, e := NewMqClient(addr, time.Second)
+		if e == nil {
+			return cfg, c
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Server on %s does not accept connections: %v", addr, e)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// within polls done until it reports true, failing the test after 5 seconds.
+func within(t *testing.T, what string, done func() bool) {
+	for deadline := time.Now().Add(5 * time.Second); !done(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// TestConcurrentClients hammers a master and its slave node from many clients
+// at once, run it with -race. Every increment must be counted.
+func TestConcurrentClients(t *testing.T) {
+	masterConfig, master := startServer(t)
+	defer master.Close()
+	_, slave := startServer(t)
+	defer slave.Close()
+
+	slaveConfig, e := slave.Call("GetConfig", "")
+	if e != nil {
+		t.Fatal(e)
+	}
+	if _, e = master.Call("AddNode", slaveConfig.Value.(ServerConfig)); e != nil {
+		t.Fatal(e)
+	}
+
+	const counter = "public|stress|counter"
+	const queue = "stress"
+	addr := fmt.Sprintf("127.0.0.1:%d", masterConfig.Port)
+	var pushed, popped int64
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for w := 0; w < stressClients; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			c, e := NewMqClient(addr, 10*time.Second)
+			if e != nil {
+				t.Error(e)
+				return
+			}
+			defer c.Close()
+
+			own := fmt.Sprintf("public|stress|counter%d", w)
+			for i := 0; i < stressIterations; i++ {
+				key := fmt.Sprintf("public|stress|k%d_%d", w, i%10)
+				value := fmt.Sprintf("v%d_%d", w, i)
+				if _, e := c.Call("Set", MqMsg{Key: key, Value: value}); e != nil {
+					t.Errorf("Set %s: %v", key, e)
+					return
+				}
+				got, e := c.Call("Get", key)
+				if e != nil || got.Value != value {
+					t.Errorf("Get %s = %v, %v, want %s", key, got.Value, e, value)
+					return
+				}
+
+				if _, e := c.IncrBy(counter, 1); e != nil {
+					t.Errorf("IncrBy %s: %v", counter, e)
+					return
+				}
+				if n, e := c.IncrBy(own, 2); e != nil || n != int64(2*(i+1)) {
+					t.Errorf("IncrBy %s = %d, %v, want %d", own, n, e, 2*(i+1))
+					return
+				}
+
+				if _, e := c.Push(queue, value); e != nil {
+					t.Errorf("Push %s: %v", queue, e)
+					return
+				}
+				mu.Lock()
+				pushed++
+				mu.Unlock()
+				if _, e := c.Pop(queue); e == nil {
+					mu.Lock()
+					popped++
+					mu.Unlock()
+				} else if e != ErrQueueEmpty {
+					t.Errorf("Pop %s: %v", queue, e)
+					return
+				}
+
+				if i%10 == 0 {
+					if _, e := c.Call("Ping", ""); e != nil {
+						t.Errorf("Ping: %v", e)
+					}
+					if _, e := c.Call("CheckHealthSlaves", ""); e != nil {
+						t.Errorf("CheckHealthSlaves: %v", e)
+					}
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	if t.Failed() {
+		return
+	}
+
+	total, e := master.IncrBy(counter, 0)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if want := int64(stressClients * stressIterations); total != want {
+		t.Errorf("Counter is %d after %d increments", total, want)
+	}
+
+	for {
+		if _, e := master.Pop(queue); e == ErrQueueEmpty {
+			break
+		} else if e != nil {
+			t.Fatal(e)
+		}
+		popped++
+	}
+	if popped != pushed {
+		t.Errorf("Popped %d messages of %d pushed", popped, pushed)
+	}
+}
@@ -0,0 +1,202 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/rpc"
+	"sync"
+	"time"
+
+	. "github.com/eaciit/mq/msg"
+)
+
+// sessionList tells which connection owns each temporary reply queue.
+type sessionList struct {
+	sync.Mutex
+	next   int64
+	owners map[string]int64
+}
+
+func newSessionList() *sessionList {
+	return &sessionList{owners: make(map[string]int64)}
+}
+
+func (l *sessionList) open() int64 {
+	l.Lock()
+	defer l.Unlock()
+	l.next += 1
+	return l.next
+}
+
+func (l *sessionList) add(session int64, name string) {
+	l.Lock()
+	defer l.Unlock()
+	l.owners[name] = session
+}
+
+func (l *sessionList) owner(name string) (int64, bool) {
+	l.Lock()
+	defer l.Unlock()
+	session, exist := l.owners[name]
+	return session, exist
+}
+
+// remove forgets reply queue name and tells whether it was there.
+func (l *sessionList) remove(name string) bool {
+	l.Lock()
+	defer l.Unlock()
+	_, exist := l.owners[name]
+	delete(l.owners, name)
+	return exist
+}
+
+func (l *sessionList) queuesOf(session int64) []string {
+	l.Lock()
+	defer l.Unlock()
+	names := []string{}
+	for name, owner := range l.owners {
+		if owner == session {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// MqSession holds the calls bound to one client connection, next to the
+// MqRPC calls served on it. The reply queues it declares are deleted when the
+// connection closes.
+type MqSession struct {
+	r  *MqRPC
+	id int64
+}
+
+// sessionConn runs closed once a read fails. The server stops reading then
+// but still waits for the running calls, ReceiveReply among them, before
+// ServeConn returns.
+type sessionConn struct {
+	net.Conn
+	once   sync.Once
+	closed func()
+}
+
+func (c *sessionConn) Read(p []byte) (int, error) {
+	n, e := c.Conn.Read(p)
+	if e != nil {
+		c.once.Do(c.closed)
+	}
+	return n, e
+}
+
+// serveConn serves the calls of conn until it closes, and as soon as it does
+// stops the waits of its session and deletes the reply queues it left.
+func (r *MqRPC) serveConn(conn net.Conn) {
+	session := &MqSession{r: r, id: r.sessions.open()}
+	server := rpc.NewServer()
+	server.Register(r)
+	server.Register(session)
+	server.ServeConn(&sessionConn{Conn: conn, closed: func() {
+		r.waiters.cancelSession(session.id)
+		for _, name := range r.sessions.queuesOf(session.id) {
+			r.deleteReplyQueue(name)
+		}
+	}})
+}
+
+// DeclareReplyQueue creates a reply queue owned by the session. The result
+// Key is its name.
+func (s *MqSession) DeclareReplyQueue(key string, result *MqMsg) error {
+	name := ReplyQueuePrefix + NewMessageID()
+	s.r.sessions.add(s.id, name)
+	result.Key = name
+	return nil
+}
+
+// DeleteReplyQueue deletes a reply queue of the session and its messages.
+func (s *MqSession) DeleteReplyQueue(name string, result *MqMsg) error {
+	if owner, exist := s.r.sessions.owner(name); !exist || owner != s.id {
+		return ErrReplyQueueGone
+	}
+	s.r.deleteReplyQueue(name)
+	result.Key = name
+	return nil
+}
+
+// ReceiveReply waits on a reply queue of the session for the reply with
+// args.CorrelationID, dropping any other message, then deletes the queue.
+// ErrTimeout is returned when no reply arrived in time.
+func (s *MqSession) ReceiveReply(args ReplyWait, result *MqMsg) error {
+	if owner, exist := s.r.sessions.owner(args.Queue); !exist || owner != s.id {
+		return ErrReplyQueueGone
+	}
+	defer s.r.deleteReplyQueue(args.Queue)
+
+	deadline := time.Now().Add(args.Timeout)
+	for {
+		var timeout time.Duration
+		if args.Timeout > 0 {
+			timeout = time.Until(deadline)
+			if timeout <= 0 {
+				return ErrTimeout
+			}
+		}
+		e := s.r.blockingPop(BlockingPopArgs{Queues: []string{args.Queue}, Timeout: timeout}, s.id, result)
+		if _, exist := s.r.sessions.owner(args.Queue); !exist {
+			return ErrReplyQueueGone
+		}
+		if e != nil || args.CorrelationID == "" || result.CorrelationID == args.CorrelationID {
+			return e
+		}
+		Logging(fmt.Sprintf("Reply queue '%s' dropped a message with correlation id '%s', expected '%s'", args.Queue, result.CorrelationID, args.CorrelationID), "WARNING")
+	}
+}
+
+// Reply pushes msg to msg.ReplyTo, the reply-to queue of the request it
+// answers, with the correlation id of the request. A reply to a reply queue
+// whose requester is gone fails with ErrReplyQueueGone.
+func (r *MqRPC) Reply(msg MqMsg, result *MqMsg) error {
+	if msg.ReplyTo == "" {
+		return ErrNoReplyTo
+	}
+	msg.Key = msg.ReplyTo
+	msg.ReplyTo = ""
+	return r.Push(msg, result)
+}
+
+// deleteReplyQueue forgets reply queue name and drops its messages.
+func (r *MqRPC) deleteReplyQueue(name string) {
+	unlock := r.lockQueues(name)
+	defer unlock()
+	if r.sessions.remove(name) {
+		r.dropQueue(name)
+	}
+}
+
+// consumable refuses reply queues to every call but ReceiveReply.
+func consumable(names ...string) error {
+	for _, name := range names {
+		if IsReplyQueue(name) {
+			return ErrExclusiveQueue
+		}
+	}
+	return nil
+}
+
+// dropReplyQueues forgets the reply queues loaded from disk, their
+// connections are gone with the previous run.
+func (r *MqRPC) dropReplyQueues() {
+	r.mu.Lock()
+	for name := range r.queueMeta {
+		if IsReplyQueue(name) {
+			r.forgetQueue(name)
+		}
+	}
+	r.mu.Unlock()
+
+	r.qmu.Lock()
+	for name := range r.queues {
+		if IsReplyQueue(name) {
+			delete(r.queues, name)
+		}
+	}
+	r.qmu.Unlock()
+}
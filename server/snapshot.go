@@ -0,0 +1,384 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	. "github.com/eaciit/mq/helper"
+	. "github.com/eaciit/mq/msg"
+)
+
+const (
+	snapshotMagic   string        = "MQSNAP"
+	snapshotVersion uint32        = 1
+	snapshotTick    time.Duration = time.Second
+)
+
+var (
+	ErrSnapshotCorrupt = errors.New("Snapshot file is corrupt")
+	ErrSnapshotVersion = errors.New("Snapshot file has an unsupported format version")
+)
+
+// Snapshot is the point-in-time state of a server written to the data directory.
+type Snapshot struct {
+	Created        time.Time
+	Items          map[string]MqMsg
+	DataMap        map[string]int
+	Expires        map[string]time.Time
+	Access         map[string]keyAccess
+	Tables         map[string]MqTable
+	Users          []MqUser
+	Nodes          []Node
+	Mirrors        []Node
+	DeadNodesCount int
+	Queues         map[string]queueInfo
+	QueueItems     map[string]nodeQueue
+	Scheduled      []ScheduledMsg
+	Streams        map[string]streamInfo
+	StreamEntries  map[string]nodeStream
+	Exchanges      map[string]exchangeInfo
+	Dedup          []DedupEntry
+	DedupAt        map[string]dedupRef
+}
+
+func (r *MqRPC) snapshotPath() string {
+	return filepath.Join(r.Config.DataDir, fmt.Sprintf("dump-%d.mqs", r.Config.Port))
+}
+
+// lockState blocks every write to the master metadata and to the data held
+// by this node, so it can be copied as of one point in time, and returns the
+// unlock function. The locks taken are never held while taking another one,
+// r.mu aside, so taking them all in this order cannot deadlock.
+func (r *MqRPC) lockState() func() {
+	r.mu.RLock()
+	r.qmu.Lock()
+	r.smu.Lock()
+	r.schedule.Lock()
+	r.dmu.Lock()
+	return func() {
+		r.dmu.Unlock()
+		r.schedule.Unlock()
+		r.smu.Unlock()
+		r.qmu.Unlock()
+		r.mu.RUnlock()
+	}
+}
+
+// takeSnapshot copies the current state so it can be encoded while the server
+// keeps serving writes.
+func (r *MqRPC) takeSnapshot() *Snapshot {
+	unlock := r.lockState()
+	defer unlock()
+
+	s := new(Snapshot)
+	s.Created = time.Now()
+	s.Items = r.items.Copy()
+	s.QueueItems = r.copyQueues()
+	s.Scheduled = r.schedule.sorted()
+	s.StreamEntries = r.copyStreams()
+	s.Dedup = r.copyDedup()
+	s.Streams = make(map[string]streamInfo, len(r.streamMeta))
+	for k, v := range r.streamMeta {
+		s.Streams[k] = v.clone()
+	}
+	s.Exchanges = make(map[string]exchangeInfo, len(r.exchanges))
+	for k, v := range r.exchanges {
+		s.Exchanges[k] = v.clone()
+	}
+	s.DedupAt = make(map[string]dedupRef, len(r.dedupAt))
+	for k, v := range r.dedupAt {
+		s.DedupAt[k] = v
+	}
+	s.Queues = make(map[string]queueInfo, len(r.queueMeta))
+	for k, v := range r.queueMeta {
+		s.Queues[k] = *v
+	}
+	s.DataMap = make(map[string]int, len(r.dataMap))
+	for k, v := range r.dataMap {
+		s.DataMap[k] = v
+	}
+	s.Expires = make(map[string]time.Time, len(r.expires))
+	for k, v := range r.expires {
+		s.Expires[k] = v
+	}
+	s.Access = make(map[string]keyAccess, len(r.access))
+	for k, v := range r.access {
+		s.Access[k] = *v
+	}
+	s.Tables = make(map[string]MqTable, len(r.tables))
+	for k, v := range r.tables {
+		table := *NewTable(v.TableId, v.Owner)
+		table.Created = v.Created
+		table.LastAccess = v.LastAccess
+		table.Expiry = v.Expiry
+		for ik, iv := range v.Items {
+			table.Items[ik] = iv
+		}
+		s.Tables[k] = table
+	}
+	s.Users = append([]MqUser{}, r.users...)
+	s.Nodes = append([]Node{}, r.nodes...)
+	s.Mirrors = append([]Node{}, r.mirrors...)
+	s.DeadNodesCount = r.deadNodesCount
+	return s
+}
+
+// writeSnapshot stores s as: magic, format version, crc32 and length of the
+// payload, then the gob encoded payload. The file is written next to the
+// previous one and renamed, so a crash never leaves a half written snapshot.
+func (r *MqRPC) writeSnapshot(s *Snapshot) error {
+	buf, e := Encode(s)
+	if e != nil {
+		return e
+	}
+	payload := buf.Bytes()
+
+	header := new(bytes.Buffer)
+	header.WriteString(snapshotMagic)
+	binary.Write(header, binary.BigEndian, snapshotVersion)
+	binary.Write(header, binary.BigEndian, crc32.ChecksumIEEE(payload))
+	binary.Write(header, binary.BigEndian, uint64(len(payload)))
+
+	e = os.MkdirAll(r.Config.DataDir, 0755)
+	if e != nil {
+		return e
+	}
+
+	path := r.snapshotPath()
+	tmpPath := path + ".tmp"
+	file, e := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0666)
+	if e != nil {
+		return e
+	}
+	_, e = file.Write(header.Bytes())
+	if e == nil {
+		_, e = file.Write(payload)
+	}
+	if e == nil {
+		e = file.Sync()
+	}
+	file.Close()
+	if e != nil {
+		os.Remove(tmpPath)
+		return e
+	}
+
+	return os.Rename(tmpPath, path)
+}
+
+func readSnapshot(path string) (*Snapshot, error) {
+	data, e := ioutil.ReadFile(path)
+	if e != nil {
+		return nil, e
+	}
+
+	headerSize := len(snapshotMagic) + 4 + 4 + 8
+	if len(data) < headerSize || string(data[:len(snapshotMagic)]) != snapshotMagic {
+		return nil, ErrSnapshotCorrupt
+	}
+
+	header := bytes.NewReader(data[len(snapshotMagic):headerSize])
+	var version, checksum uint32
+	var length uint64
+	binary.Read(header, binary.BigEndian, &version)
+	binary.Read(header, binary.BigEndian, &checksum)
+	binary.Read(header, binary.BigEndian, &length)
+
+	if version != snapshotVersion {
+		return nil, ErrSnapshotVersion
+	}
+
+	payload := data[headerSize:]
+	if uint64(len(payload)) != length || crc32.ChecksumIEEE(payload) != checksum {
+		return nil, ErrSnapshotCorrupt
+	}
+
+	s := new(Snapshot)
+	e = Decode(payload, s)
+	if e != nil {
+		return nil, ErrSnapshotCorrupt
+	}
+	return s, nil
+}
+
+// loadSnapshot restores the latest snapshot of this server, if there is one.
+func (r *MqRPC) loadSnapshot() error {
+	path := r.snapshotPath()
+	if _, e := os.Stat(path); os.IsNotExist(e) {
+		return nil
+	}
+
+	s, e := readSnapshot(path)
+	if e != nil {
+		return fmt.Errorf("Unable to load snapshot %s: %s", path, e.Error())
+	}
+
+	if s.Items != nil {
+		r.items.Load(s.Items)
+	}
+	r.qmu.Lock()
+	for k, v := range s.QueueItems {
+		q := newNodeQueue()
+		q.setItems(v.allItems(), v.LastSeq)
+		r.queues[k] = q
+	}
+	r.qmu.Unlock()
+	r.smu.Lock()
+	for k, v := range s.StreamEntries {
+		stream := v
+		r.streams[k] = &stream
+	}
+	r.smu.Unlock()
+	r.schedule.Lock()
+	for _, m := range s.Scheduled {
+		r.schedule.add(m)
+	}
+	r.schedule.Unlock()
+	r.loadDedup(s.Dedup)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if s.DataMap != nil {
+		r.dataMap = s.DataMap
+		r.rebuildKeyIndex()
+	}
+	if s.Expires != nil {
+		r.expires = s.Expires
+	}
+	for k, v := range s.Access {
+		a := v
+		r.access[k] = &a
+	}
+	if s.Tables != nil {
+		r.tables = s.Tables
+		for k, table := range r.tables {
+			setIndex(&table)
+			r.tables[k] = table
+		}
+	}
+	for k, v := range s.Queues {
+		info := v
+		r.queueMeta[k] = &info
+	}
+	for k, v := range s.Streams {
+		info := v.clone()
+		r.streamMeta[k] = &info
+	}
+	for k, v := range s.Exchanges {
+		r.setExchangeInfo(k, v)
+	}
+	for k, v := range s.DedupAt {
+		r.dedupAt[k] = v
+	}
+	r.users = s.Users
+	r.mirrors = s.Mirrors
+	r.deadNodesCount = s.DeadNodesCount
+	if len(s.Nodes) > 0 {
+		r.nodes = s.Nodes
+		for i := range r.nodes {
+			if r.nodes[i].Config.Name == r.Config.Name && r.nodes[i].Config.Port == r.Config.Port {
+				r.nodes[i].Config = r.Config
+				r.nodes[i].AllocatedSize = r.Config.Memory
+			}
+		}
+	}
+
+	r.lastSave = s.Created
+	Logging(fmt.Sprintf("Snapshot %s taken at %v has been loaded, %d item(s)", path, s.Created, len(s.Items)), "INFO")
+	return nil
+}
+
+func (r *MqRPC) markDirty() {
+	atomic.AddInt64(&r.dirty, 1)
+}
+
+func (r *MqRPC) save(s *Snapshot, dirty int64) error {
+	e := r.writeSnapshot(s)
+	if e != nil {
+		errorMsg := "Unable to save snapshot: " + e.Error()
+		Logging(errorMsg, "ERROR")
+		return errors.New(errorMsg)
+	}
+
+	atomic.AddInt64(&r.dirty, -dirty)
+	r.mu.Lock()
+	r.lastSave = s.Created
+	r.mu.Unlock()
+	Logging(fmt.Sprintf("Snapshot has been saved to %s, %d item(s)", r.snapshotPath(), len(s.Items)), "INFO")
+	return nil
+}
+
+// Save writes a snapshot to the data directory and returns when it is on disk.
+func (r *MqRPC) Save(key string, result *MqMsg) error {
+	if r.Config.DataDir == "" {
+		return errors.New("Unable to save snapshot, no data directory configured")
+	}
+	if !atomic.CompareAndSwapInt32(&r.saving, 0, 1) {
+		return errors.New("Background save already in progress")
+	}
+	defer atomic.StoreInt32(&r.saving, 0)
+
+	dirty := atomic.LoadInt64(&r.dirty)
+	e := r.save(r.takeSnapshot(), dirty)
+	if e != nil {
+		return e
+	}
+	result.Value = r.snapshotPath()
+	return nil
+}
+
+// BgSave takes a snapshot and writes it to the data directory in the background.
+func (r *MqRPC) BgSave(key string, result *MqMsg) error {
+	if r.Config.DataDir == "" {
+		return errors.New("Unable to save snapshot, no data directory configured")
+	}
+	if !atomic.CompareAndSwapInt32(&r.saving, 0, 1) {
+		return errors.New("Background save already in progress")
+	}
+
+	dirty := atomic.LoadInt64(&r.dirty)
+	s := r.takeSnapshot()
+	go func() {
+		r.save(s, dirty)
+		atomic.StoreInt32(&r.saving, 0)
+	}()
+	result.Value = "Background saving started"
+	return nil
+}
+
+// runSnapshotSchedule starts a background save every SnapshotInterval seconds
+// or after SnapshotWrites writes, whichever comes first.
+func (r *MqRPC) runSnapshotSchedule() {
+	interval := time.Duration(r.Config.SnapshotInterval) * time.Second
+	writes := r.Config.SnapshotWrites
+	if r.Config.DataDir == "" || (interval <= 0 && writes <= 0) {
+		return
+	}
+
+	r.mu.Lock()
+	if r.lastSave.IsZero() {
+		r.lastSave = time.Now()
+	}
+	r.mu.Unlock()
+	for !r.exiting() {
+		time.Sleep(snapshotTick)
+		dirty := atomic.LoadInt64(&r.dirty)
+		if dirty <= 0 || atomic.LoadInt32(&r.saving) != 0 {
+			continue
+		}
+		r.mu.RLock()
+		lastSave := r.lastSave
+		r.mu.RUnlock()
+		if (writes > 0 && dirty >= writes) || (interval > 0 && time.Since(lastSave) >= interval) {
+			r.BgSave("", &MqMsg{})
+		}
+	}
+}
@@ -0,0 +1,825 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	. "github.com/eaciit/mq/helper"
+	. "github.com/eaciit/mq/msg"
+)
+
+const (
+	// streamLockPrefix keeps the lock of a stream apart from a key or a queue of the same name.
+	streamLockPrefix string = "\x00stream|"
+
+	streamRead      int           = 100
+	streamReadMax   int           = 1000
+	streamMaxParts  int           = 256
+	streamTrimEvery time.Duration = 10 * time.Second
+)
+
+// StreamOp is applied to a stream partition by the node holding it and, with
+// the trimming found by the node, by every mirror. Parts are applied in field
+// order.
+type StreamOp struct {
+	Partition string
+	Append    []StreamEntry
+	Replace   bool  // Append replaces the whole partition and LastID becomes LastID
+	LastID    int64 // used with Replace
+
+	TrimTo int64 // removes every entry up to TrimTo
+	MaxLen int64
+	MaxAge time.Duration
+
+	From  int64
+	To    int64
+	Count int  // reads up to Count entries from From to To
+	Dump  bool // returns every entry
+}
+
+// StreamOpResult holds the entries read by a StreamOp and what it trimmed.
+type StreamOpResult struct {
+	Entries     []StreamEntry
+	TrimTo      int64
+	Trimmed     int64
+	TrimmedSize int64
+}
+
+// nodeStream is a stream partition stored by a node, entries in ID order.
+// LastID only grows, so an append replayed from the append-only log is
+// recognised and skipped.
+type nodeStream struct {
+	Entries []StreamEntry
+	LastID  int64
+}
+
+func (s *nodeStream) add(entry StreamEntry) bool {
+	if entry.ID <= s.LastID {
+		return false
+	}
+	s.Entries = append(s.Entries, entry)
+	s.LastID = entry.ID
+	return true
+}
+
+func (s *nodeStream) search(id int64) int {
+	return sort.Search(len(s.Entries), func(i int) bool { return s.Entries[i].ID >= id })
+}
+
+func (s *nodeStream) read(from int64, to int64, count int) []StreamEntry {
+	entries := []StreamEntry{}
+	for i := s.search(from); i < len(s.Entries) && len(entries) < count; i++ {
+		if to > 0 && s.Entries[i].ID > to {
+			break
+		}
+		entries = append(entries, s.Entries[i])
+	}
+	return entries
+}
+
+// trimTo removes every entry up to id and returns them.
+func (s *nodeStream) trimTo(id int64) []StreamEntry {
+	i := s.search(id + 1)
+	removed := append([]StreamEntry{}, s.Entries[:i]...)
+	s.Entries = append([]StreamEntry{}, s.Entries[i:]...)
+	return removed
+}
+
+// trimPoint returns the ID up to which entries are beyond maxLen or older
+// than maxAge, zero when there is nothing to trim.
+func (s *nodeStream) trimPoint(maxLen int64, maxAge time.Duration) int64 {
+	var id int64
+	if maxLen > 0 && int64(len(s.Entries)) > maxLen {
+		id = s.Entries[int64(len(s.Entries))-maxLen-1].ID
+	}
+	if maxAge > 0 {
+		limit := time.Now().Add(-maxAge)
+		i := sort.Search(len(s.Entries), func(i int) bool { return !s.Entries[i].Msg.Created.Before(limit) })
+		if i > 0 && s.Entries[i-1].ID > id {
+			id = s.Entries[i-1].ID
+		}
+	}
+	return id
+}
+
+func entriesSize(entries []StreamEntry) int64 {
+	var size int64
+	for _, entry := range entries {
+		buf, _ := Encode(entry.Msg.Value)
+		size += int64(buf.Len())
+	}
+	return size
+}
+
+// streamPartition is what the master knows of one partition of a stream.
+type streamPartition struct {
+	Node   int
+	Len    int64
+	Size   int64
+	LastID int64
+}
+
+// streamInfo is what the master knows of a stream. Groups holds the offset
+// committed by each consumer group, one per partition.
+type streamInfo struct {
+	Partitions []streamPartition
+	LastID     int64
+	MaxLen     int64
+	MaxAge     time.Duration
+	Groups     map[string][]int64
+}
+
+func newStreamInfo(partitions int) streamInfo {
+	info := streamInfo{Groups: make(map[string][]int64)}
+	for p := 0; p < partitions; p++ {
+		info.Partitions = append(info.Partitions, streamPartition{Node: -1})
+	}
+	return info
+}
+
+// clone returns a copy of info sharing nothing with it.
+func (info streamInfo) clone() streamInfo {
+	copied := info
+	copied.Partitions = append([]streamPartition{}, info.Partitions...)
+	copied.Groups = make(map[string][]int64, len(info.Groups))
+	for group, offsets := range info.Groups {
+		copied.Groups[group] = append([]int64{}, offsets...)
+	}
+	return copied
+}
+
+// partitionName is the name a node stores partition p of stream name under.
+func partitionName(name string, p int) string {
+	return name + "#" + strconv.Itoa(p)
+}
+
+// partitionOf returns the partition of info an entry with key goes to. Entries
+// without a key are spread in turn.
+func (info streamInfo) partitionOf(key string) int {
+	return partitionOf(key, info.LastID+1, len(info.Partitions))
+}
+
+// partitionOf returns which of partitions a message with key goes to, the
+// one of its seq when key is empty.
+func partitionOf(key string, seq int64, partitions int) int {
+	if key == "" {
+		return int(seq % int64(partitions))
+	}
+	return shardIndex(key, partitions)
+}
+
+// StreamApply applies op to a stream partition held by this node.
+func (r *MqRPC) StreamApply(op StreamOp, result *StreamOpResult) error {
+	entries := []aofEntry{}
+
+	r.smu.Lock()
+	s, exist := r.streams[op.Partition]
+	if !exist {
+		s = &nodeStream{}
+		r.streams[op.Partition] = s
+	}
+
+	if op.Replace {
+		s.Entries = append([]StreamEntry{}, op.Append...)
+		s.LastID = op.LastID
+		entries = append(entries, aofEntry{Op: "StreamState", Key: op.Partition, Entries: s.Entries, Seq: s.LastID})
+	} else {
+		appended := []StreamEntry{}
+		for _, entry := range op.Append {
+			if s.add(entry) {
+				appended = append(appended, entry)
+			}
+		}
+		if len(appended) > 0 {
+			entries = append(entries, aofEntry{Op: "StreamAppend", Key: op.Partition, Entries: appended})
+		}
+	}
+
+	trimTo := op.TrimTo
+	if id := s.trimPoint(op.MaxLen, op.MaxAge); id > trimTo {
+		trimTo = id
+	}
+	if trimTo > 0 {
+		removed := s.trimTo(trimTo)
+		if len(removed) > 0 {
+			result.TrimTo = trimTo
+			result.Trimmed = int64(len(removed))
+			result.TrimmedSize = entriesSize(removed)
+			entries = append(entries, aofEntry{Op: "StreamTrim", Key: op.Partition, Seq: trimTo})
+		}
+	}
+
+	if op.Dump {
+		result.Entries = append(result.Entries, s.Entries...)
+	} else if op.Count > 0 {
+		result.Entries = append(result.Entries, s.read(op.From, op.To, op.Count)...)
+	}
+	r.smu.Unlock()
+
+	if len(entries) > 0 {
+		r.markDirty()
+	}
+	for _, entry := range entries {
+		r.logWrite(entry)
+	}
+	return nil
+}
+
+// setStreamInfo stores the metadata of a stream and moves the difference in
+// size and length onto the nodes holding its partitions and onto every
+// mirror. The caller holds r.mu.
+func (r *MqRPC) setStreamInfo(name string, info streamInfo) {
+	old := streamInfo{}
+	if current, exist := r.streamMeta[name]; exist {
+		old = *current
+	}
+
+	var oldLen, oldSize, newLen, newSize int64
+	for _, part := range old.Partitions {
+		if part.Node >= 0 && part.Node < len(r.nodes) {
+			r.nodes[part.Node].DataCount -= part.Len
+			r.nodes[part.Node].DataSize -= part.Size
+		}
+		oldLen += part.Len
+		oldSize += part.Size
+	}
+	for _, part := range info.Partitions {
+		if part.Node >= 0 && part.Node < len(r.nodes) {
+			r.nodes[part.Node].DataCount += part.Len
+			r.nodes[part.Node].DataSize += part.Size
+		}
+		newLen += part.Len
+		newSize += part.Size
+	}
+	for i := range r.mirrors {
+		r.mirrors[i].DataCount += newLen - oldLen
+		r.mirrors[i].DataSize += newSize - oldSize
+	}
+
+	copied := info.clone()
+	r.streamMeta[name] = &copied
+	r.markDirty()
+}
+
+func (r *MqRPC) updateStreamInfo(name string, info streamInfo) {
+	r.mu.Lock()
+	r.setStreamInfo(name, info)
+	r.mu.Unlock()
+	r.logWrite(aofEntry{Op: "StreamInfo", Key: name, Stream: info.clone()})
+}
+
+// streamInfoOf returns a copy of the metadata of stream name.
+func (r *MqRPC) streamInfoOf(name string) (streamInfo, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	current, exist := r.streamMeta[name]
+	if !exist {
+		return streamInfo{}, false
+	}
+	return current.clone(), true
+}
+
+// remapStreams moves the stream partitions of node from onto node to, like
+// the dataMap entries of keys when a node dies. The caller holds r.mu.
+func (r *MqRPC) remapStreams(from int, to int) {
+	for _, info := range r.streamMeta {
+		for i := range info.Partitions {
+			if info.Partitions[i].Node == from {
+				info.Partitions[i].Node = to
+			}
+		}
+	}
+}
+
+// partitionNode returns the node holding partition p of stream name. A
+// partition without a node is placed like a key when create is set; one lost
+// with its node then starts again empty. The caller holds the stream lock.
+func (r *MqRPC) partitionNode(name string, info *streamInfo, p int, size int64, create bool) (*ServerConfig, error) {
+	part := &info.Partitions[p]
+	r.mu.RLock()
+	if part.Node >= 0 && part.Node < len(r.nodes) {
+		node := r.nodes[part.Node]
+		r.mu.RUnlock()
+		if size > 0 && node.DataSize+size >= node.AllocatedSize {
+			return nil, ErrOutOfMemory
+		}
+		return node.Config, nil
+	}
+	r.mu.RUnlock()
+
+	if !create {
+		if part.LastID > 0 {
+			return nil, errors.New("Partition " + strconv.Itoa(p) + " of stream " + name + " is not available, its node is down")
+		}
+		return nil, nil
+	}
+
+	idx, e := r.pickNode(streamLockPrefix+partitionName(name, p), size, nil)
+	if e != nil {
+		return nil, e
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if idx >= len(r.nodes) {
+		return nil, errors.New("Selected node has been removed")
+	}
+	part.Node = idx
+	part.Len = 0
+	part.Size = 0
+	return r.nodes[idx].Config, nil
+}
+
+// applyStreamOp runs op on the node holding the partition, then trims every
+// mirror the same way and appends there what op appended.
+func (r *MqRPC) applyStreamOp(nodeConfig *ServerConfig, op StreamOp) (StreamOpResult, error) {
+	result := StreamOpResult{}
+	e := r.callNode(nodeConfig, "StreamApply", op, &result)
+	if e != nil {
+		errorMsg := fmt.Sprintf("Unable to apply stream operation on node : %s", e.Error())
+		Logging(errorMsg, "ERROR")
+		return result, errors.New(errorMsg)
+	}
+
+	r.mu.RLock()
+	mirrors := append([]Node{}, r.mirrors...)
+	r.mu.RUnlock()
+	if len(mirrors) == 0 || (len(op.Append) == 0 && result.TrimTo == 0) {
+		return result, nil
+	}
+
+	replica := StreamOp{Partition: op.Partition, Append: op.Append, Replace: op.Replace, LastID: op.LastID, TrimTo: result.TrimTo}
+	for _, mirror := range mirrors {
+		e = r.callNode(mirror.Config, "StreamApply", replica, &StreamOpResult{})
+		if e != nil {
+			errorMsg := fmt.Sprintf("Unable to apply stream operation on mirror %s:%d : %s", mirror.Config.Name, mirror.Config.Port, e.Error())
+			Logging(errorMsg, "ERROR")
+		}
+	}
+	return result, nil
+}
+
+func (r *MqRPC) lockStream(name string) func() {
+	return r.lockKeys([]string{streamLockPrefix + name})
+}
+
+// DeclareStream creates stream config.Name or changes its trimming. The
+// number of partitions of a stream cannot change once it holds entries.
+func (r *MqRPC) DeclareStream(config StreamConfig, result *MqMsg) error {
+	if config.Name == "" {
+		return errors.New("Stream name is empty")
+	}
+	if config.Partitions <= 0 {
+		config.Partitions = 1
+	}
+	if config.Partitions > streamMaxParts {
+		return fmt.Errorf("A stream cannot have more than %d partitions", streamMaxParts)
+	}
+	if config.MaxLen < 0 || config.MaxAge < 0 {
+		return errors.New("Max length and max age cannot be negative")
+	}
+
+	unlock := r.lockStream(config.Name)
+	defer unlock()
+
+	info, exist := r.streamInfoOf(config.Name)
+	if !exist {
+		info = newStreamInfo(config.Partitions)
+	} else if len(info.Partitions) != config.Partitions {
+		if info.LastID > 0 {
+			return errors.New("Stream " + config.Name + " holds entries, its partitions cannot be changed")
+		}
+		info.Partitions = newStreamInfo(config.Partitions).Partitions
+		info.Groups = make(map[string][]int64)
+	}
+	info.MaxLen = config.MaxLen
+	info.MaxAge = config.MaxAge
+	r.updateStreamInfo(config.Name, info)
+
+	Logging(fmt.Sprintf("Stream '%s' declared, %d partition(s), max length %d, max age %v", config.Name, config.Partitions, config.MaxLen, config.MaxAge), "INFO")
+	result.Key = config.Name
+	return nil
+}
+
+// Append adds args.Msg to the end of the partition of args.PartitionKey in
+// stream args.Stream, creating a stream with one partition when needed. The
+// ID of the entry is returned in result.Value.
+func (r *MqRPC) Append(args AppendArgs, result *MqMsg) error {
+	name := args.Stream
+	if name == "" {
+		return errors.New("Stream name is empty")
+	}
+
+	unlock := r.lockStream(name)
+	defer unlock()
+
+	info, exist := r.streamInfoOf(name)
+	if !exist {
+		info = newStreamInfo(1)
+	}
+
+	msg := MqMsg{Key: name, Value: args.Msg.Value, Created: time.Now(), LastAccess: time.Now()}
+	msg.SetDefaults(&args.Msg)
+	buf, _ := Encode(msg.Value)
+	size := int64(buf.Len())
+
+	key := args.PartitionKey
+	if key == "" {
+		key = args.Msg.PartitionKey
+	}
+	p := info.partitionOf(key)
+	nodeConfig, e := r.partitionNode(name, &info, p, size, true)
+	if e != nil {
+		Logging("Entry for stream '"+name+"' cannot be appended : "+e.Error(), "INFO")
+		return e
+	}
+
+	entry := StreamEntry{ID: info.LastID + 1, Partition: p, Msg: msg}
+	op := StreamOp{Partition: partitionName(name, p), Append: []StreamEntry{entry}, MaxLen: info.MaxLen, MaxAge: info.MaxAge}
+	trimmed, e := r.applyStreamOp(nodeConfig, op)
+	if e != nil {
+		return e
+	}
+
+	part := &info.Partitions[p]
+	part.Len += 1 - trimmed.Trimmed
+	part.Size += size - trimmed.TrimmedSize
+	part.LastID = entry.ID
+	info.LastID = entry.ID
+	r.updateStreamInfo(name, info)
+
+	result.Key = name
+	result.Value = entry.ID
+	return nil
+}
+
+// selectPartitions checks the partitions asked for, all of them when empty.
+func selectPartitions(name string, info streamInfo, asked []int) ([]int, error) {
+	if len(asked) == 0 {
+		all := []int{}
+		for p := range info.Partitions {
+			all = append(all, p)
+		}
+		return all, nil
+	}
+	for _, p := range asked {
+		if p < 0 || p >= len(info.Partitions) {
+			return nil, fmt.Errorf("Stream %s has no partition %d", name, p)
+		}
+	}
+	return asked, nil
+}
+
+// readPartitions reads up to count entries from the partitions of stream
+// name, starting after the offset returned by after for each of them, and
+// merges them in ID order.
+func (r *MqRPC) readPartitions(name string, info streamInfo, partitions []int, after func(p int) int64, to int64, count int) ([]StreamEntry, error) {
+	entries := []StreamEntry{}
+	for _, p := range partitions {
+		nodeConfig, e := r.partitionNode(name, &info, p, 0, false)
+		if e != nil {
+			return nil, e
+		}
+		if nodeConfig == nil {
+			continue
+		}
+
+		read := StreamOpResult{}
+		op := StreamOp{Partition: partitionName(name, p), From: after(p) + 1, To: to, Count: count}
+		e = r.callNode(nodeConfig, "StreamApply", op, &read)
+		if e != nil {
+			errorMsg := fmt.Sprintf("Unable to read stream from node : %s", e.Error())
+			Logging(errorMsg, "ERROR")
+			return nil, errors.New(errorMsg)
+		}
+		entries = append(entries, read.Entries...)
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].ID < entries[j].ID })
+	if len(entries) > count {
+		entries = entries[:count]
+	}
+	return entries, nil
+}
+
+func streamReadCount(count int) int {
+	if count <= 0 {
+		return streamRead
+	}
+	if count > streamReadMax {
+		return streamReadMax
+	}
+	return count
+}
+
+// ReadStream returns the entries of stream args.Stream with an ID from
+// args.From to args.To, in ID order, 100 by default and at most 1000.
+func (r *MqRPC) ReadStream(args StreamReadArgs, result *MqMsg) error {
+	info, exist := r.streamInfoOf(args.Stream)
+	entries := []StreamEntry{}
+	if exist {
+		partitions, e := selectPartitions(args.Stream, info, args.Partitions)
+		if e != nil {
+			return e
+		}
+		after := func(int) int64 { return args.From - 1 }
+		entries, e = r.readPartitions(args.Stream, info, partitions, after, args.To, streamReadCount(args.Count))
+		if e != nil {
+			return e
+		}
+	}
+
+	buf, e := Encode(entries)
+	if e != nil {
+		return e
+	}
+	result.Key = args.Stream
+	result.Value = buf.Bytes()
+	return nil
+}
+
+// ReadGroup returns the entries of stream args.Stream following the offsets
+// committed by consumer group args.Group, in ID order. A group that never
+// committed reads from the first entry kept. Reading does not move the
+// offsets, CommitOffsets does. With args.Consumer the consumer joins the
+// group and only reads the partitions the group gives to it, a partition
+// moving to it once the consumer holding it before committed what it read,
+// left or timed out.
+func (r *MqRPC) ReadGroup(args GroupReadArgs, result *MqMsg) error {
+	if args.Group == "" {
+		return errors.New("Consumer group name is empty")
+	}
+	group := GroupArgs{Stream: args.Stream, Group: args.Group, Consumer: args.Consumer}
+	if args.Consumer != "" {
+		unlock := r.lockStream(args.Stream)
+		defer unlock()
+	}
+
+	info, exist := r.streamInfoOf(args.Stream)
+	entries := []StreamEntry{}
+	if exist {
+		partitions, e := selectPartitions(args.Stream, info, args.Partitions)
+		if e != nil {
+			return e
+		}
+		offsets := info.Groups[args.Group]
+		after := func(p int) int64 {
+			if p < len(offsets) {
+				return offsets[p]
+			}
+			return 0
+		}
+		if args.Consumer != "" {
+			committed := make([]int64, len(info.Partitions))
+			for p := range committed {
+				committed[p] = after(p)
+			}
+			held := make(map[int]bool)
+			for _, p := range r.groups.takeStream(group, committed) {
+				held[p] = true
+			}
+			asked := partitions
+			partitions = []int{}
+			for _, p := range asked {
+				if held[p] {
+					partitions = append(partitions, p)
+				}
+			}
+		}
+		entries, e = r.readPartitions(args.Stream, info, partitions, after, 0, streamReadCount(args.Count))
+		if e != nil {
+			return e
+		}
+		if args.Consumer != "" {
+			r.groups.deliver(group, entries)
+		}
+	}
+
+	buf, e := Encode(entries)
+	if e != nil {
+		return e
+	}
+	result.Key = args.Stream
+	result.Value = buf.Bytes()
+	return nil
+}
+
+// CommitOffsets stores the offsets of consumer group args.Group, so it goes
+// on from there after a restart.
+func (r *MqRPC) CommitOffsets(args CommitArgs, result *MqMsg) error {
+	if args.Group == "" {
+		return errors.New("Consumer group name is empty")
+	}
+
+	unlock := r.lockStream(args.Stream)
+	defer unlock()
+
+	info, exist := r.streamInfoOf(args.Stream)
+	if !exist {
+		return errors.New("Stream " + args.Stream + " does not exist")
+	}
+	offsets := info.Groups[args.Group]
+	for len(offsets) < len(info.Partitions) {
+		offsets = append(offsets, 0)
+	}
+	for p, id := range args.Offsets {
+		if p < 0 || p >= len(info.Partitions) {
+			return fmt.Errorf("Stream %s has no partition %d", args.Stream, p)
+		}
+		if id < 0 {
+			return errors.New("Offset cannot be negative")
+		}
+		offsets[p] = id
+	}
+	info.Groups[args.Group] = offsets
+	r.updateStreamInfo(args.Stream, info)
+
+	result.Key = args.Stream
+	result.Value = args.Group
+	return nil
+}
+
+// trimStream removes the entries of every partition of stream name beyond
+// maxLen or older than maxAge and returns how many were removed. The caller
+// holds the stream lock.
+func (r *MqRPC) trimStream(name string, maxLen int64, maxAge time.Duration) (int64, error) {
+	info, exist := r.streamInfoOf(name)
+	if !exist {
+		return 0, nil
+	}
+
+	var trimmed int64
+	for p := range info.Partitions {
+		nodeConfig, e := r.partitionNode(name, &info, p, 0, false)
+		if e != nil || nodeConfig == nil {
+			continue
+		}
+		result, e := r.applyStreamOp(nodeConfig, StreamOp{Partition: partitionName(name, p), MaxLen: maxLen, MaxAge: maxAge})
+		if e != nil {
+			return trimmed, e
+		}
+		info.Partitions[p].Len -= result.Trimmed
+		info.Partitions[p].Size -= result.TrimmedSize
+		trimmed += result.Trimmed
+	}
+	if trimmed > 0 {
+		r.updateStreamInfo(name, info)
+	}
+	return trimmed, nil
+}
+
+// TrimStream removes the entries of stream args.Stream beyond args.MaxLen per
+// partition or older than args.MaxAge and returns how many were removed.
+func (r *MqRPC) TrimStream(args StreamTrimArgs, result *MqMsg) error {
+	if args.MaxLen <= 0 && args.MaxAge <= 0 {
+		return errors.New("Either max length or max age is needed to trim a stream")
+	}
+
+	unlock := r.lockStream(args.Stream)
+	defer unlock()
+
+	trimmed, e := r.trimStream(args.Stream, args.MaxLen, args.MaxAge)
+	if e != nil {
+		return e
+	}
+	Logging(fmt.Sprintf("%d entries of stream '%s' trimmed", trimmed, args.Stream), "INFO")
+	result.Key = args.Stream
+	result.Value = trimmed
+	return nil
+}
+
+// Streams returns the status of every stream, sorted by name.
+func (r *MqRPC) Streams(key string, result *MqMsg) error {
+	r.mu.RLock()
+	streams := []StreamStatus{}
+	for name, info := range r.streamMeta {
+		status := StreamStatus{LastID: info.LastID, Groups: info.clone().Groups}
+		status.Name = name
+		status.Partitions = len(info.Partitions)
+		status.MaxLen = info.MaxLen
+		status.MaxAge = info.MaxAge
+		for _, part := range info.Partitions {
+			status.Len += part.Len
+			status.Size += part.Size
+		}
+		streams = append(streams, status)
+	}
+	r.mu.RUnlock()
+	sort.Slice(streams, func(i, j int) bool { return streams[i].Name < streams[j].Name })
+
+	buf, e := Encode(streams)
+	if e != nil {
+		return e
+	}
+	result.Value = buf.Bytes()
+	return nil
+}
+
+// trimAgedStreams applies MaxAge to every stream having one, every ten
+// seconds at most. It is called by the reaper.
+func (r *MqRPC) trimAgedStreams() {
+	if time.Since(r.streamsTrimmed) < streamTrimEvery {
+		return
+	}
+	r.streamsTrimmed = time.Now()
+
+	r.mu.RLock()
+	aged := map[string]time.Duration{}
+	for name, info := range r.streamMeta {
+		if info.MaxAge > 0 {
+			aged[name] = info.MaxAge
+		}
+	}
+	r.mu.RUnlock()
+
+	for name, maxAge := range aged {
+		unlock := r.lockStream(name)
+		if _, e := r.trimStream(name, 0, maxAge); e != nil {
+			Logging("Unable to trim stream '"+name+"' : "+e.Error(), "ERROR")
+		}
+		unlock()
+	}
+}
+
+// copyStreamsFromMirror restores the stream partitions of a dead node onto
+// node idx from the first mirror.
+func (r *MqRPC) copyStreamsFromMirror(idx int, lost []string, deadNode int) {
+	r.mu.RLock()
+	mirrors := append([]Node{}, r.mirrors...)
+	var nodeConfig *ServerConfig
+	if idx < len(r.nodes) {
+		nodeConfig = r.nodes[idx].Config
+	}
+	r.mu.RUnlock()
+	if nodeConfig == nil || len(mirrors) == 0 {
+		return
+	}
+
+	for _, name := range lost {
+		unlock := r.lockStream(name)
+		info, exist := r.streamInfoOf(name)
+		copied := false
+		for p := range info.Partitions {
+			part := &info.Partitions[p]
+			if !exist || part.Node != deadNode {
+				// Appended again since the node died, the partition lives elsewhere now
+				continue
+			}
+
+			state := StreamOpResult{}
+			e := r.callNode(mirrors[0].Config, "StreamApply", StreamOp{Partition: partitionName(name, p), Dump: true}, &state)
+			if e != nil {
+				Logging("Unable to read stream '"+name+"' from mirror : "+e.Error(), "ERROR")
+				continue
+			}
+			op := StreamOp{Partition: partitionName(name, p), Append: state.Entries, Replace: true, LastID: part.LastID}
+			if e = r.callNode(nodeConfig, "StreamApply", op, &StreamOpResult{}); e != nil {
+				Logging("Unable to copy stream '"+name+"' to node : "+e.Error(), "ERROR")
+				continue
+			}
+			part.Node = idx
+			part.Len = int64(len(state.Entries))
+			part.Size = entriesSize(state.Entries)
+			copied = true
+		}
+		if copied {
+			r.updateStreamInfo(name, info)
+		}
+		unlock()
+	}
+}
+
+// copyStreams returns a copy of every stream partition held by this node.
+// The caller holds r.smu.
+func (r *MqRPC) copyStreams() map[string]nodeStream {
+	streams := make(map[string]nodeStream, len(r.streams))
+	for name, s := range r.streams {
+		streams[name] = nodeStream{Entries: append([]StreamEntry{}, s.Entries...), LastID: s.LastID}
+	}
+	return streams
+}
+
+// applyStreamEntry replays a stream partition record of the append-only log.
+func (r *MqRPC) applyStreamEntry(entry aofEntry) {
+	r.smu.Lock()
+	defer r.smu.Unlock()
+	s, exist := r.streams[entry.Key]
+	if !exist {
+		s = &nodeStream{}
+		r.streams[entry.Key] = s
+	}
+
+	switch entry.Op {
+	case "StreamAppend":
+		for _, e := range entry.Entries {
+			s.add(e)
+		}
+	case "StreamTrim":
+		s.trimTo(entry.Seq)
+	case "StreamState":
+		s.Entries = append([]StreamEntry{}, entry.Entries...)
+		s.LastID = entry.Seq
+	}
+}
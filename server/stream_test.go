@@ -0,0 +1,92 @@
+package server
+
+import (
+	"testing"
+
+	. "github.com/eaciit/mq/msg"
+)
+
+// TestStreamOffsetsAndTrim reads a partitioned stream as a consumer group,
+// which resumes after the offsets it committed, then trims the stream to a
+// max length per partition.
+func TestStreamOffsetsAndTrim(t *testing.T) {
+	_, c := startServer(t)
+	defer c.Close()
+
+	const stream = "events"
+	if e := c.DeclareStream(StreamConfig{Name: stream, Partitions: 2}); e != nil {
+		t.Fatal(e)
+	}
+	var last int64
+	for i := 0; i < 10; i++ {
+		key := "a"
+		if i%2 == 1 {
+			key = "b"
+		}
+		id, e := c.Append(stream, key, i)
+		if e != nil {
+			t.Fatal(e)
+		}
+		if id <= last {
+			t.Fatalf("Append returned ID %d after %d", id, last)
+		}
+		last = id
+	}
+
+	all, e := c.ReadStream(stream, 0, 0, 0)
+	if e != nil || len(all) != 10 {
+		t.Fatalf("ReadStream = %d entries, %v, want 10", len(all), e)
+	}
+	perPartition := make(map[int][]int64)
+	for _, entry := range all {
+		perPartition[entry.Partition] = append(perPartition[entry.Partition], entry.ID)
+	}
+
+	seen := make(map[int64]bool)
+	for read := 0; read < 10; {
+		entries, e := c.ReadGroup(stream, "g", 3)
+		if e != nil {
+			t.Fatal(e)
+		}
+		if len(entries) == 0 {
+			t.Fatalf("ReadGroup returned nothing after %d of 10 entries", read)
+		}
+		for _, entry := range entries {
+			if seen[entry.ID] {
+				t.Fatalf("Entry %d read again after its offset was committed", entry.ID)
+			}
+			seen[entry.ID] = true
+		}
+		if e = c.Commit(stream, "g", entries...); e != nil {
+			t.Fatal(e)
+		}
+		read += len(entries)
+	}
+	if entries, e := c.ReadGroup(stream, "g", 3); e != nil || len(entries) != 0 {
+		t.Errorf("ReadGroup past the last entry = %d entries, %v", len(entries), e)
+	}
+
+	var want int64
+	kept := make(map[int64]bool)
+	for _, ids := range perPartition {
+		if len(ids) > 2 {
+			want += int64(len(ids) - 2)
+			ids = ids[len(ids)-2:]
+		}
+		for _, id := range ids {
+			kept[id] = true
+		}
+	}
+	if removed, e := c.TrimStream(stream, 2, 0); e != nil || removed != want {
+		t.Fatalf("TrimStream = %d, %v, want %d", removed, e, want)
+	}
+	all, e = c.ReadStream(stream, 0, 0, 0)
+	if e != nil || len(all) != len(kept) {
+		t.Fatalf("ReadStream after trim = %d entries, %v, want %d", len(all), e, len(kept))
+	}
+	for _, entry := range all {
+		if !kept[entry.ID] {
+			t.Errorf("Entry %d kept by the trim, it is not among the last 2 of its partition", entry.ID)
+		}
+	}
+}